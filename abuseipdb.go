@@ -0,0 +1,63 @@
+// abuseipdb.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	abuseIPDBCheckURL       = "https://api.abuseipdb.com/api/v2/check"
+	abuseIPDBMaxAgeInDays   = 90
+	abuseIPDBTimeoutSeconds = 10
+
+	// ips with abuse confidence scores higher than this will be listed as high-risk ones in reports
+	highRiskAbuseScore = 75
+)
+
+// fetch the abuse confidence score (0 ~ 100) of given ip from AbuseIPDB
+func fetchAbuseScore(key, ip string) (score int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), abuseIPDBTimeoutSeconds*time.Second)
+	defer cancel()
+
+	query := url.Values{}
+	query.Set("ipAddress", ip)
+	query.Set("maxAgeInDays", fmt.Sprintf("%d", abuseIPDBMaxAgeInDays))
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, abuseIPDBCheckURL+"?"+query.Encode(), nil); err != nil {
+		return 0, err
+	}
+	req.Header.Set("Key", key)
+	req.Header.Set("Accept", "application/json")
+
+	var res *http.Response
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return 0, fmt.Errorf("abuseipdb responded with status: %s", res.Status)
+	}
+
+	var result struct {
+		Data struct {
+			AbuseConfidenceScore *int `json:"abuseConfidenceScore"`
+		} `json:"data"`
+	}
+	if err = json.NewDecoder(io.LimitReader(res.Body, maxGeoResponseBytes)).Decode(&result); err != nil {
+		return 0, err
+	}
+	if result.Data.AbuseConfidenceScore == nil {
+		return 0, fmt.Errorf("no abuse confidence score in the response")
+	}
+
+	return *result.Data.AbuseConfidenceScore, nil
+}
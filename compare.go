@@ -0,0 +1,154 @@
+// compare.go
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Comparison represents a comparison of ban counts between a period and its prior period of the same length
+type Comparison struct {
+	GeneratedDatetime string `json:"generated_datetime"`
+	NumDays           int    `json:"num_days"`
+	Since             string `json:"since"`
+	Until             string `json:"until"`
+	PriorSince        string `json:"prior_since"`
+
+	Total     PeriodComparison   `json:"total"`
+	Protocols []PeriodComparison `json:"protocols"`
+	Countries []PeriodComparison `json:"countries"`
+}
+
+// PeriodComparison represents counts of a key (eg. protocol, country) in the period and the prior one
+type PeriodComparison struct {
+	Key           string   `json:"key"`
+	Count         int      `json:"count"`
+	PriorCount    int      `json:"prior_count"`
+	ChangePercent *float64 `json:"change_percent,omitempty"` // nil if prior count is 0
+	New           bool     `json:"new,omitempty"`            // appeared in the period (prior count is 0)
+	Gone          bool     `json:"gone,omitempty"`           // disappeared in the period (count is 0)
+}
+
+// compare given counts of a key
+func comparePeriods(key string, count, priorCount int) PeriodComparison {
+	result := PeriodComparison{
+		Key:        key,
+		Count:      count,
+		PriorCount: priorCount,
+	}
+
+	if priorCount > 0 {
+		change := float64(count-priorCount) / float64(priorCount) * 100
+		result.ChangePercent = &change
+
+		result.Gone = count <= 0
+	} else {
+		result.New = count > 0
+	}
+
+	return result
+}
+
+// compare counts of all keys in given key-values, larger counts first
+func compareKeyValues(kvs, priorKVs KeyValues) (result []PeriodComparison) {
+	result = []PeriodComparison{}
+
+	for _, kv := range kvs {
+		prior, _ := priorKVs.Get(kv.Key)
+		result = append(result, comparePeriods(kv.Key, kv.Value, prior))
+	}
+	for _, kv := range priorKVs {
+		if _, exists := kvs.Get(kv.Key); !exists {
+			result = append(result, comparePeriods(kv.Key, 0, kv.Value))
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		if result[i].PriorCount != result[j].PriorCount {
+			return result[i].PriorCount > result[j].PriorCount
+		}
+		return result[i].Key < result[j].Key
+	})
+
+	return result
+}
+
+// CompareReports compares ban counts (per protocol and country) of the last `windowDays` days with the prior `windowDays` days.
+//
+// Both periods end `offsetDays` days from now. Filters and time formats of `opts` are applied.
+func (d *Database) CompareReports(offsetDays, windowDays int, opts reportOptions) (result Comparison, err error) {
+	if windowDays <= 0 {
+		return result, fmt.Errorf("number of days should be positive: %d", windowDays)
+	}
+
+	until := time.Now().AddDate(0, 0, offsetDays)
+	since := until.AddDate(0, 0, -windowDays)
+	priorSince := since.AddDate(0, 0, -windowDays)
+
+	var sub, prior SubReport
+	if sub, err = d.generateSubReport(since, &until, opts); err != nil {
+		return result, err
+	}
+	if prior, err = d.generateSubReport(priorSince, &since, opts); err != nil {
+		return result, err
+	}
+
+	return Comparison{
+		GeneratedDatetime: opts.formatTime(until),
+		NumDays:           windowDays,
+		Since:             opts.formatTime(since),
+		Until:             opts.formatTime(until),
+		PriorSince:        opts.formatTime(priorSince),
+
+		Total:     comparePeriods("Total", sub.TotalCount, prior.TotalCount),
+		Protocols: compareKeyValues(sub.ProtocolCounts, prior.ProtocolCounts),
+		Countries: compareKeyValues(sub.CountryCounts, prior.CountryCounts),
+	}, nil
+}
+
+// format comparison as plain text
+func (c Comparison) plain() string {
+	line := func(prefix string, pc PeriodComparison) string {
+		change := "-"
+		if pc.ChangePercent != nil {
+			change = fmt.Sprintf("%+.1f%%", *pc.ChangePercent)
+		}
+		flag := ""
+		if pc.New {
+			flag = " (!) new"
+		} else if pc.Gone {
+			flag = " (!) gone"
+		}
+		return fmt.Sprintf("%s%s: %d (prior: %d, %s)%s", prefix, pc.Key, pc.Count, pc.PriorCount, change, flag)
+	}
+	lines := func(pcs []PeriodComparison) string {
+		if len(pcs) <= 0 {
+			return "  (none)"
+		}
+		result := []string{}
+		for _, pc := range pcs {
+			result = append(result, line("  ", pc))
+		}
+		return strings.Join(result, "\n")
+	}
+
+	return fmt.Sprintf(`
+>>> Comparison of the last %[2]d days with the prior %[2]d days generated on: %[1]s
+
+> %[3]s ~ %[4]s (prior: %[5]s ~ %[3]s):
+---
+%[6]s
+
+* Protocols:
+%[7]s
+
+* Countries:
+%[8]s
+`, c.GeneratedDatetime, c.NumDays, c.Since, c.Until, c.PriorSince, line("* ", c.Total), lines(c.Protocols), lines(c.Countries))
+}
@@ -3,29 +3,75 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"io"
+	"io/fs"
 	"log"
+	"math"
+	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"time"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 
-	"github.com/meinside/ipgeolocation.io-go"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/time/rate"
 )
 
 const (
-	unknownLocation = "Unknown"
+	unknownLocation  = "Unknown"
+	unknownNetwork   = "Unknown Network"
+	reservedLocation = "Reserved" // for ips in reserved ranges (see `isReservedIP`)
 
 	slowQueryThresholdSeconds = 10
 
+	defaultReportTimeFormat = "2006-01-02 15:04:05"
+
+	sqliteHeader = "SQLite format 3\x00" // first bytes of sqlite database files
+
 	projectURL = "https://github.com/meinside/balog"
 
-	googleAIModel = "gemini-1.5-flash-latest"
+	emptyReportMessage = "No ban actions recorded yet."
+
+	unknownHost = "unknown-host" // for logs saved without host names
+
+	groupByTagPrefix = "tag:"
+	noTagValue       = "(none)"
+
+	otherBucket = "Other" // for entries collapsed with `MinCount` option
+
+	eventTypeBan   = "ban"
+	eventTypeUnban = "unban"
+
+	numRowsForBatchInsert = 100
+
+	defaultNumTopIPs = 10
+
+	defaultResolveRetryHours  = 24
+	defaultResolveMaxFailures = 5
+
+	defaultInsightCacheTTLHours = 24
+
+	defaultResolveRequestsPerSecond = 2.0
+	resolveProgressInterval         = 100 // progress of resolving unknown ips is logged every this number of ips
+
+	defaultGoogleAIModel = "gemini-1.5-flash-latest"
+
+	defaultDBBusyTimeoutMillis = 5000
+	defaultDBJournalMode       = "WAL"
 )
 
 // BanActionLog represents a log of ban action
@@ -37,6 +83,35 @@ type BanActionLog struct {
 	IP        string    `gorm:"index:idx_logs_4"`
 
 	Location *string
+
+	// tags extracted from the protocol string (JSON object)
+	Tags *string
+
+	// type of the event ("ban" or "unban")
+	EventType string `gorm:"default:ban;index:idx_logs_5"`
+
+	// name of the fail2ban jail (eg. "sshd", "nginx-badbots")
+	Jail *string `gorm:"index:idx_logs_6"`
+
+	// host name of the server where it was saved
+	Host *string `gorm:"index:idx_logs_7"`
+
+	// whether the ip was masked by anonymization (masked ips are not geolocated)
+	Anonymized bool `gorm:"default:false"`
+}
+
+// tagValue returns the value of given tag name, or `noTagValue` if there is no such tag.
+func (b BanActionLog) tagValue(name string) string {
+	if b.Tags != nil {
+		tags := map[string]string{}
+		if err := json.Unmarshal([]byte(*b.Tags), &tags); err == nil {
+			if value, exists := tags[name]; exists && len(value) > 0 {
+				return value
+			}
+		}
+	}
+
+	return noTagValue
 }
 
 // Location represents location of an ip
@@ -45,30 +120,239 @@ type Location struct {
 
 	IP          string `gorm:"unique;index:idx_locations_1"`
 	CountryName string `gorm:"index:idx_locations_2"`
+	City        string
+	Region      string
+
+	ASN          string
+	Organization string
+
+	// time of the last lookup attempt by `ResolveUnknownIPs` (nil if never tried)
+	ResolvedAt *time.Time
+
+	// number of consecutive failed lookups by `ResolveUnknownIPs`
+	LookupFailures int
+
+	// raw response of the geolocation provider (only with `store_raw_geolocation`)
+	RawResponse string `gorm:"type:text"`
+
+	// abuse confidence score from AbuseIPDB (nil if not fetched, or failed)
+	AbuseScore *int
+}
+
+// Insight represents a cached insight (generated text) of reports
+type Insight struct {
+	gorm.Model
+
+	Hash string `gorm:"unique;index:idx_insights_1"` // hash of the model, prompts, and reports
+	Text string
+}
+
+// GeoLocation represents a fetched geolocation of an ip
+type GeoLocation struct {
+	CountryName string
+	City        string
+	Region      string
+
+	ASN          string
+	Organization string
+
+	RawResponse string // raw (json) response of the provider, if any
+}
+
+// key of the city (with its region and country) for reports, or empty if the city is unknown
+func (loc Location) cityKey() string {
+	if loc.City == "" {
+		return ""
+	}
+
+	parts := []string{loc.City}
+	if loc.Region != "" && loc.Region != loc.City {
+		parts = append(parts, loc.Region)
+	}
+	if loc.CountryName != "" && loc.CountryName != unknownLocation {
+		parts = append(parts, loc.CountryName)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// key of the network (organization and/or asn) for reports
+func (loc Location) networkKey() string {
+	switch {
+	case loc.Organization != "" && loc.ASN != "":
+		return fmt.Sprintf("%s (%s)", loc.Organization, loc.ASN)
+	case loc.Organization != "":
+		return loc.Organization
+	case loc.ASN != "":
+		return loc.ASN
+	default:
+		return unknownNetwork
+	}
 }
 
 // Database struct
 type Database struct {
 	db *gorm.DB
+
+	host string // host name to be saved with new logs (not saved if empty)
+}
+
+// SetHost sets the host name to be saved with new logs
+func (d *Database) SetHost(host string) {
+	d.host = host
+}
+
+// host name to be saved with new logs, nil if not set
+func (d *Database) hostName() *string {
+	if len(d.host) > 0 {
+		host := d.host
+		return &host
+	}
+	return nil
 }
 
 // Report represents a report of ban action logs
 type Report struct {
-	GeneratedDatetime string    `json:"generated_datetime"`
-	LastDaysReport1   SubReport `json:"last_days_report1"`
-	LastDaysReport2   SubReport `json:"last_days_report2"`
+	GeneratedDatetime string      `json:"generated_datetime"`
+	Windows           []SubReport `json:"windows"` // sub reports of windows (last N days)
+
+	GroupBy *string `json:"group_by,omitempty"`
+
+	// true if there is no ban action in any window
+	Empty bool `json:"empty,omitempty"`
 
 	Insight *string `json:"insight,omitempty"`
+
+	DailyCounts []DayCount `json:"daily_counts,omitempty"` // daily counts of the largest window (with `Timeseries` option)
+}
+
+// DayCount represents the number of ban actions of a day
+type DayCount struct {
+	Date  string `json:"date"` // YYYY-MM-DD (in UTC)
+	Count int    `json:"count"`
+}
+
+// report options
+type reportOptions struct {
+	Days []int // number of days of windows (`defaultReportDays` if empty)
+
+	Since, Until *time.Time // absolute period of a single window (overrides `Days` if set)
+
+	NumTopIPs int  // number of top offending ips (`defaultNumTopIPs` if not positive)
+	Anonymize bool // mask ips in rendered reports (see `maskIP`)
+
+	GroupBy string    // eg. "tag:region"
+	Sort    sortOrder // order of key-values
+
+	TelegraphWindows []int // number of days of windows to be included in telegraph reports (all if empty)
+
+	TrustedCountries []string // names of countries where bans are not expected
+
+	Sections []reportSection // enabled sections in order (all if empty)
+
+	ShowPrompt bool // print the prompt for insight generation to stderr
+	DryRun     bool // don't send the prompt for insight generation (eg. for only checking it with `ShowPrompt`)
+
+	InsightSystemInstruction, InsightPromptTemplate string // for insight generation (default ones if empty)
+
+	InsightCacheTTL time.Duration // reuse insights of identical reports for this duration (no caching if 0)
+
+	TelegraphSkipEmpty bool // don't post empty reports to telegra.ph
+
+	FilterProtocol string // only ban actions of this protocol (all if empty)
+	FilterCountry  string // only ban actions from this country (case-insensitive, all if empty)
+
+	Timeseries bool // include daily counts of the largest window
+
+	ISOCodes bool // include ISO 3166-1 alpha-2 codes of countries
+
+	MinCount int // protocols and countries with fewer counts will be collapsed into `otherBucket` in rendered reports (no collapsing if not positive)
+
+	Location   *time.Location // timezone of times in reports (UTC if nil)
+	TimeFormat string         // layout of times in reports (`defaultReportTimeFormat` if empty)
+}
+
+// format given time for reports, in the timezone and layout of the options
+//
+// (times are stored in UTC, and only converted for rendering)
+func (o reportOptions) formatTime(t time.Time) string {
+	location := o.Location
+	if location == nil {
+		location = time.UTC
+	}
+	layout := o.TimeFormat
+	if len(layout) <= 0 {
+		layout = defaultReportTimeFormat
+	}
+	return t.In(location).Format(layout)
+}
+
+// restrict given query of ban action logs with the filters
+func (o reportOptions) filter(tx *gorm.DB) *gorm.DB {
+	if len(o.FilterProtocol) > 0 {
+		tx = tx.Where("ban_action_logs.protocol = ?", o.FilterProtocol)
+	}
+	if len(o.FilterCountry) > 0 {
+		tx = tx.Where("LOWER(ban_action_logs.location) = LOWER(?)", o.FilterCountry)
+	}
+	return tx
+}
+
+// description of the active filters (empty if there is none)
+func (o reportOptions) filters() string {
+	filters := []string{}
+	if len(o.FilterProtocol) > 0 {
+		filters = append(filters, fmt.Sprintf("protocol: %s", o.FilterProtocol))
+	}
+	if len(o.FilterCountry) > 0 {
+		filters = append(filters, fmt.Sprintf("country: %s", o.FilterCountry))
+	}
+	return strings.Join(filters, ", ")
+}
+
+// number of days of windows in order
+func (o reportOptions) days() []int {
+	if len(o.Days) <= 0 {
+		return defaultReportDays
+	}
+	return o.Days
+}
+
+// number of top offending ips
+func (o reportOptions) numTopIPs() int {
+	if o.NumTopIPs <= 0 {
+		return defaultNumTopIPs
+	}
+	return o.NumTopIPs
 }
 
-type keyValue struct {
+// tag name of the group-by option (eg. "region" for "tag:region"), or empty string if not grouped by a tag
+func (o reportOptions) groupByTag() string {
+	if strings.HasPrefix(o.GroupBy, groupByTagPrefix) {
+		return strings.TrimPrefix(o.GroupBy, groupByTagPrefix)
+	}
+	return ""
+}
+
+type sortOrder string
+
+// sort orders of key-values
+const (
+	sortByCount    sortOrder = "count"     // descending by count (default)
+	sortByCountAsc sortOrder = "count-asc" // ascending by count
+	sortByName     sortOrder = "name"      // alphabetical
+)
+
+// KeyValue represents a count (value) of a key (eg. protocol, country)
+type KeyValue struct {
 	Key   string
 	Value int
 }
 
-type keyValues []keyValue
+// KeyValues is an ordered list of key-values
+type KeyValues []KeyValue
 
-func (kvs *keyValues) Set(key string, value int) {
+// Set sets the value of given key, appending it if it doesn't exist
+func (kvs *KeyValues) Set(key string, value int) {
 	for i, kv := range *kvs {
 		if kv.Key == key {
 			(*kvs)[i].Value = value
@@ -76,13 +360,14 @@ func (kvs *keyValues) Set(key string, value int) {
 		}
 	}
 
-	*kvs = append(*kvs, keyValue{
+	*kvs = append(*kvs, KeyValue{
 		Key:   key,
 		Value: value,
 	})
 }
 
-func (kvs *keyValues) Get(key string) (value int, exists bool) {
+// Get returns the value of given key
+func (kvs *KeyValues) Get(key string) (value int, exists bool) {
 	for _, kv := range *kvs {
 		if kv.Key == key {
 			return kv.Value, true
@@ -92,250 +377,1508 @@ func (kvs *keyValues) Get(key string) (value int, exists bool) {
 	return 0, false
 }
 
-func sortKeyValues(kvs keyValues) keyValues {
-	sorted := keyValues{}
+// sort given key-values in given order (without modifying them)
+func sortKeyValues(kvs KeyValues, order sortOrder) KeyValues {
+	sorted := KeyValues{}
 	for _, kv := range kvs {
-		sorted = append(sorted, keyValue{kv.Key, kv.Value})
+		sorted = append(sorted, KeyValue{kv.Key, kv.Value})
 	}
 
-	sort.Slice(sorted, func(i, j int) bool {
-		return sorted[i].Value > sorted[j].Value
+	// (ties in counts are broken by names, for stable orders between runs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		switch order {
+		case sortByName:
+			return sorted[i].Key < sorted[j].Key
+		case sortByCountAsc:
+			if sorted[i].Value == sorted[j].Value {
+				return sorted[i].Key < sorted[j].Key
+			}
+			return sorted[i].Value < sorted[j].Value
+		default:
+			if sorted[i].Value == sorted[j].Value {
+				return sorted[i].Key < sorted[j].Key
+			}
+			return sorted[i].Value > sorted[j].Value
+		}
 	})
 
 	return sorted
 }
 
-// SubReport represents a sub report of a Report
-type SubReport struct {
-	TotalCount     int       `json:"total_count"`
-	ProtocolCounts keyValues `json:"protocol_counts"`
-	CountryCounts  keyValues `json:"country_counts"`
+type reportSection string
+
+// report sections
+const (
+	reportSectionTotal     reportSection = "total"
+	reportSectionProtocols reportSection = "protocols"
+	reportSectionJails     reportSection = "jails" // with jail data
+	reportSectionHosts     reportSection = "hosts" // with host data
+	reportSectionCountries reportSection = "countries"
+	reportSectionSeen      reportSection = "countries_seen"
+	reportSectionCities    reportSection = "cities" // with city data
+	reportSectionNetworks  reportSection = "networks"
+	reportSectionTopIPs    reportSection = "top_ips"
+	reportSectionHours     reportSection = "hours"
+	reportSectionGroups    reportSection = "groups"    // with `-group-by`
+	reportSectionTrusted   reportSection = "trusted"   // with `trusted_countries`
+	reportSectionHighRisk  reportSection = "high_risk" // with `abuseipdb_key`
+	reportSectionInsight   reportSection = "insight"
+)
+
+// default number of days of report windows (last 7 days, and last 30 days)
+var defaultReportDays = []int{7, 30}
+
+// all report sections in their default order
+var defaultReportSections = []reportSection{
+	reportSectionTotal,
+	reportSectionProtocols,
+	reportSectionJails,
+	reportSectionHosts,
+	reportSectionCountries,
+	reportSectionSeen,
+	reportSectionCities,
+	reportSectionNetworks,
+	reportSectionTopIPs,
+	reportSectionHours,
+	reportSectionGroups,
+	reportSectionTrusted,
+	reportSectionHighRisk,
+	reportSectionInsight,
 }
 
-// OpenDB opens database from given path.
-func OpenDB(path string) (result *Database, err error) {
-	var db *gorm.DB
-	if db, err = gorm.Open(sqlite.Open(path), &gorm.Config{
-		Logger: logger.New(
-			log.New(os.Stdout, "\r\n", log.LstdFlags),
-			logger.Config{
-				SlowThreshold:             slowQueryThresholdSeconds * time.Second,
-				LogLevel:                  logger.Warn,
-				IgnoreRecordNotFoundError: true,
-				ParameterizedQueries:      true,
-				Colorful:                  false,
-			},
-		),
-	}); err == nil {
-		// migrate database
-		if err := db.AutoMigrate(&BanActionLog{}, &Location{}); err != nil {
-			l("Failed to migrate database: %s", err)
-		}
+// enabled report sections in order
+func (o reportOptions) sections() []reportSection {
+	if len(o.Sections) <= 0 {
+		return defaultReportSections
+	}
+	return o.Sections
+}
 
-		return &Database{db}, nil
+// collapse key-values with fewer counts than `MinCount` into `otherBucket` (at the end)
+func (o reportOptions) collapse(kvs KeyValues) KeyValues {
+	if o.MinCount <= 0 {
+		return kvs
 	}
 
-	return nil, err
+	collapsed := KeyValues{}
+	other, numOthers := 0, 0
+	for _, kv := range kvs {
+		if kv.Value < o.MinCount {
+			other += kv.Value
+			numOthers++
+		} else {
+			collapsed = append(collapsed, kv)
+		}
+	}
+	if numOthers > 0 {
+		collapsed = append(collapsed, KeyValue{Key: otherBucket, Value: other})
+	}
+
+	return collapsed
 }
 
-// CloseDB closes database.
-func (d *Database) CloseDB() {
-	if db, err := d.db.DB(); err == nil {
-		db.Close()
-	}
+// check if given report section is enabled
+func (o reportOptions) hasSection(section reportSection) bool {
+	return slices.Contains(o.sections(), section)
 }
 
-// SaveBanAction to local database
-func (d *Database) SaveBanAction(protocol, ip string) (id uint, err error) {
-	bal := BanActionLog{
-		Protocol:  protocol,
-		CreatedAt: time.Now(),
-		IP:        ip,
+// build enabled sections of a sub report in order, with given formatters
+//
+// sections without data (eg. `groups` without `-group-by`) are omitted.
+func (o reportOptions) buildSections(report Report, sub SubReport, total func(sub SubReport) string, list func(section reportSection, title string, kvs KeyValues) string) (sections []string) {
+	sections = []string{}
+
+	for _, section := range o.sections() {
+		switch section {
+		case reportSectionTotal:
+			sections = append(sections, total(sub))
+		case reportSectionProtocols:
+			sections = append(sections, list(section, "Protocols", o.collapse(sortKeyValues(sub.ProtocolCounts, o.Sort))))
+		case reportSectionJails:
+			if len(sub.JailCounts) > 0 {
+				sections = append(sections, list(section, "Jails", sortKeyValues(sub.JailCounts, o.Sort)))
+			}
+		case reportSectionHosts:
+			if len(sub.HostCounts) > 0 {
+				sections = append(sections, list(section, "Hosts", sortKeyValues(sub.HostCounts, o.Sort)))
+			}
+		case reportSectionCountries:
+			sections = append(sections, list(section, "Originating Countries", o.collapse(sortKeyValues(sub.CountryCounts, o.Sort))))
+		case reportSectionSeen:
+			if len(sub.CountriesSeen) > 0 {
+				// NOTE: already ordered by last seen times, so not sorted again
+				sections = append(sections, list(section, "First/Last Seen Countries", sub.countrySeenKeyValues(o)))
+			}
+		case reportSectionCities:
+			if len(sub.CityCounts) > 0 {
+				sections = append(sections, list(section, "Originating Cities", sortKeyValues(sub.CityCounts, o.Sort)))
+			}
+		case reportSectionNetworks:
+			sections = append(sections, list(section, "Top Networks", sortKeyValues(sub.OrgCounts, o.Sort)))
+		case reportSectionTopIPs:
+			// NOTE: already ordered by count, so not sorted again
+			sections = append(sections, list(section, "Top Offending IPs", sub.topIPKeyValues(o.Anonymize)))
+		case reportSectionHours:
+			if sub.HourCounts != nil && sub.TotalCount > 0 {
+				sections = append(sections, list(section, "Bans by hour of day (UTC)", sub.hourKeyValues()))
+			}
+		case reportSectionGroups:
+			if report.GroupBy != nil {
+				sections = append(sections, list(section, fmt.Sprintf("By %s", o.groupByTag()), sortKeyValues(sub.GroupedCounts, o.Sort)))
+			}
+		case reportSectionTrusted:
+			if len(sub.TrustedCountryCounts) > 0 {
+				sections = append(sections, list(section, "Unexpected bans from trusted regions", sortKeyValues(sub.TrustedCountryCounts, o.Sort)))
+			}
+		case reportSectionHighRisk:
+			if len(sub.HighRiskIPs) > 0 {
+				// NOTE: already ordered by score, so not sorted again
+				sections = append(sections, list(section, fmt.Sprintf("High-risk IPs (score > %d)", highRiskAbuseScore), sub.highRiskIPKeyValues(o.Anonymize)))
+			}
+		}
 	}
-	res := d.db.Create(&bal)
 
-	return bal.ID, res.Error
+	return sections
 }
 
-func (d *Database) UpdateBanActionLocation(id uint, location string) (err error) {
-	res := d.db.Model(&BanActionLog{}).Where(id).Update("location", location)
-
-	return res.Error
+// format key-values as lines with given prefix
+func keyValueLines(kvs KeyValues, prefix string) (lines []string) {
+	lines = []string{}
+	for _, kv := range kvs {
+		lines = append(lines, fmt.Sprintf("%s%s: %d", prefix, kv.Key, kv.Value))
+	}
+	return lines
 }
 
-// LookupLocation from local database
-func (d *Database) LookupLocation(ip string) (result Location, err error) {
-	res := d.db.Limit(1).Where("ip = ?", ip).Find(&result)
+// SubReport represents a sub report of a Report
+type SubReport struct {
+	NumDays        int               `json:"num_days,omitempty"`
+	Since          *string           `json:"since,omitempty"` // only for absolute periods
+	Until          *string           `json:"until,omitempty"` // only for absolute periods
+	TotalCount     int               `json:"total_count"`
+	TotalV4        int               `json:"total_v4"`
+	TotalV6        int               `json:"total_v6"`
+	ActiveCount    int               `json:"active_count"` // number of bans not lifted yet (by unban events)
+	ProtocolCounts KeyValues         `json:"protocol_counts"`
+	JailCounts     KeyValues         `json:"jail_counts,omitempty"` // only when jail data is present
+	HostCounts     KeyValues         `json:"host_counts,omitempty"` // only when host data is present (`unknownHost` for logs without hosts)
+	CountryCounts  KeyValues         `json:"country_counts"`
+	CountryCodes   map[string]string `json:"country_codes,omitempty"` // ISO 3166-1 alpha-2 codes of countries (empty if unmapped; with `ISOCodes` option)
+	CityCounts     KeyValues         `json:"city_counts,omitempty"`   // only when city data is present
+	OrgCounts      KeyValues         `json:"org_counts"`              // organizations/asns (or `unknownNetwork`)
+	TopIPs         []IPCount         `json:"top_ips"`                 // ips with the most bans
+	GroupedCounts  KeyValues         `json:"grouped_counts,omitempty"`
+	Filters        string            `json:"filters,omitempty"` // active filters (eg. "protocol: sshd, country: China")
+
+	// counts of bans from trusted countries (which are unexpected)
+	TrustedCountryCounts KeyValues `json:"trusted_country_counts,omitempty"`
+
+	// ips with high abuse confidence scores (only when scores are present)
+	HighRiskIPs []IPCount `json:"high_risk_ips,omitempty"`
+
+	// numbers of bans by hour of day (in UTC, 0 ~ 23)
+	HourCounts *[24]int `json:"hour_counts,omitempty"`
+
+	// first/last seen times of countries in the window
+	CountriesSeen []CountrySeen `json:"countries_seen,omitempty"`
+}
 
-	return result, res.Error
+// CountrySeen represents the first/last seen times (and the number of bans) of a country
+type CountrySeen struct {
+	Country   string    `json:"country"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"` // same as `FirstSeen` if seen only once
+	Count     int       `json:"count"`
 }
 
-func (d *Database) UpdateLocation(ip, location string) (err error) {
-	res := d.db.Model(&Location{}).Where("ip = ?", ip).Update("country_name", location)
+// IPCount represents the number of bans of an ip
+type IPCount struct {
+	IP      string  `json:"ip"`
+	Country *string `json:"country,omitempty"`
+	Count   int     `json:"count"`
 
-	return res.Error
+	CountryCode *string `json:"country_code,omitempty"` // ISO 3166-1 alpha-2 code of the country (with `ISOCodes` option)
+
+	AbuseScore *int `json:"abuse_score,omitempty"` // abuse confidence score (only for high-risk ips)
 }
 
-// SaveLocation to local database
-func (d *Database) SaveLocation(ip, location string) (id uint, err error) {
-	loc := Location{
-		IP:          ip,
-		CountryName: location,
+// fill ISO 3166-1 alpha-2 codes of countries (empty codes for unmapped ones)
+func (s *SubReport) fillCountryCodes() {
+	s.CountryCodes = map[string]string{}
+	for _, kv := range s.CountryCounts {
+		s.CountryCodes[kv.Key] = countryCode(kv.Key)
+	}
+	for i, ip := range s.TopIPs {
+		if ip.Country != nil {
+			code := countryCode(*ip.Country)
+			s.TopIPs[i].CountryCode = &code
+			s.CountryCodes[*ip.Country] = code
+		}
 	}
-	res := d.db.Create(&loc)
-
-	return loc.ID, res.Error
 }
 
-// generate report data (`offsetDays` in number of days; positive for future, negative for past)
-func (d *Database) generateReport(offsetDays, numDaysForReport1, numDaysForReport2 int) (result Report, err error) {
-	timestamp := time.Now().AddDate(0, 0, offsetDays)
-
-	result = Report{
-		GeneratedDatetime: timestamp.Format("2006-01-02 15:04:05"),
-		LastDaysReport1: SubReport{
-			ProtocolCounts: keyValues{},
-			CountryCounts:  keyValues{},
-		},
-		LastDaysReport2: SubReport{
-			ProtocolCounts: keyValues{},
-			CountryCounts:  keyValues{},
-		},
+// top offending ips (with their countries) as key-values, masked if `anonymize` is true
+func (s SubReport) topIPKeyValues(anonymize bool) (kvs KeyValues) {
+	kvs = KeyValues{}
+	for _, ip := range s.TopIPs {
+		key := ip.IP
+		if anonymize {
+			key = maskIP(ip.IP)
+		}
+		if ip.Country != nil {
+			key = fmt.Sprintf("%s (%s)", key, *ip.Country)
+		}
+		kvs = append(kvs, KeyValue{Key: key, Value: ip.Count})
 	}
+	return kvs
+}
 
-	var oldCount int
-
-	// last `numDaysForReport1` days
-	var lastDaysForReport1 []BanActionLog
-	if res := d.db.Model(&BanActionLog{}).Where("created_at >= ?", time.Now().AddDate(0, 0, offsetDays-numDaysForReport1)).Find(&lastDaysForReport1); res.Error == nil {
-		// total count
-		result.LastDaysReport1.TotalCount = len(lastDaysForReport1)
-
-		for _, log := range lastDaysForReport1 {
-			// counts for protocols
-			oldCount, _ = result.LastDaysReport1.ProtocolCounts.Get(log.Protocol)
-			result.LastDaysReport1.ProtocolCounts.Set(log.Protocol, oldCount+1)
+// first/last seen times of countries as key-values (eg. "China (2024-03-01 12:34:56 ~ 2024-03-05 01:23:45)")
+func (s SubReport) countrySeenKeyValues(opts reportOptions) (kvs KeyValues) {
+	kvs = KeyValues{}
+	for _, seen := range s.CountriesSeen {
+		kvs = append(kvs, KeyValue{
+			Key:   fmt.Sprintf("%s (%s ~ %s)", seen.Country, opts.formatTime(seen.FirstSeen), opts.formatTime(seen.LastSeen)),
+			Value: seen.Count,
+		})
+	}
+	return kvs
+}
 
-			// counts for countries
-			if log.Location != nil {
-				oldCount, _ = result.LastDaysReport1.CountryCounts.Get(*log.Location)
-				result.LastDaysReport1.CountryCounts.Set(*log.Location, oldCount+1)
-			}
+// numbers of bans by hour of day as key-values (eg. "00" ~ "23")
+func (s SubReport) hourKeyValues() (kvs KeyValues) {
+	kvs = KeyValues{}
+	if s.HourCounts != nil {
+		for hour, count := range s.HourCounts {
+			kvs = append(kvs, KeyValue{Key: fmt.Sprintf("%02d", hour), Value: count})
 		}
-	} else {
-		return result, res.Error
 	}
+	return kvs
+}
 
-	// last `numDaysForReport2` days
-	var lastDaysForReport2 []BanActionLog
-	if res := d.db.Model(&BanActionLog{}).Where("created_at >= ?", time.Now().AddDate(0, 0, offsetDays-numDaysForReport2)).Find(&lastDaysForReport2); res.Error == nil {
-		result.LastDaysReport2.TotalCount = len(lastDaysForReport2)
+// format key-values as lines of a horizontal ascii bar chart with given prefix
+func barChartLines(kvs KeyValues, prefix string) (lines []string) {
+	const maxWidth = 40
 
-		for _, log := range lastDaysForReport2 {
-			// counts for protocols
-			oldCount, _ = result.LastDaysReport2.ProtocolCounts.Get(log.Protocol)
-			result.LastDaysReport2.ProtocolCounts.Set(log.Protocol, oldCount+1)
+	largest := 0
+	for _, kv := range kvs {
+		largest = max(largest, kv.Value)
+	}
 
-			// counts for countries
-			if log.Location != nil {
-				oldCount, _ = result.LastDaysReport2.CountryCounts.Get(*log.Location)
-				result.LastDaysReport2.CountryCounts.Set(*log.Location, oldCount+1)
-			}
+	lines = []string{}
+	for _, kv := range kvs {
+		bar := ""
+		if largest > 0 && kv.Value > 0 {
+			bar = strings.Repeat("#", max(int(math.Round(float64(kv.Value)/float64(largest)*maxWidth)), 1)) + " "
 		}
-	} else {
-		return result, res.Error
+		lines = append(lines, fmt.Sprintf("%s%s | %s%d", prefix, kv.Key, bar, kv.Value))
 	}
-
-	return result, err
+	return lines
 }
 
-// GetReportAsPlain generates report in plain text format.
-func (d *Database) GetReportAsPlain(offsetDays, numDaysForReport1, numDaysForReport2 int) (result []byte, err error) {
-	// generate report text
-	var report Report
-	if report, err = d.generateReport(offsetDays, numDaysForReport1, numDaysForReport2); err == nil {
-		protocolsForReport1 := []string{}
-		for _, kv := range sortKeyValues(report.LastDaysReport1.ProtocolCounts) {
-			protocolsForReport1 = append(protocolsForReport1, fmt.Sprintf("  %s: %d", kv.Key, kv.Value))
+// high-risk ips (with their countries and scores) as key-values, masked if `anonymize` is true
+func (s SubReport) highRiskIPKeyValues(anonymize bool) (kvs KeyValues) {
+	kvs = KeyValues{}
+	for _, ip := range s.HighRiskIPs {
+		key := ip.IP
+		if anonymize {
+			key = maskIP(ip.IP)
 		}
-		countriesForReport1 := []string{}
-		for _, kv := range sortKeyValues(report.LastDaysReport1.CountryCounts) {
-			countriesForReport1 = append(countriesForReport1, fmt.Sprintf("  %s: %d", kv.Key, kv.Value))
+		details := []string{}
+		if ip.Country != nil {
+			details = append(details, *ip.Country)
 		}
-		protocolsForReport2 := []string{}
-		for _, kv := range report.LastDaysReport2.ProtocolCounts {
-			protocolsForReport2 = append(protocolsForReport2, fmt.Sprintf("  %s: %d", kv.Key, kv.Value))
+		if ip.AbuseScore != nil {
+			details = append(details, fmt.Sprintf("score %d", *ip.AbuseScore))
 		}
-		countriesForReport2 := []string{}
-		for _, kv := range report.LastDaysReport2.CountryCounts {
-			countriesForReport2 = append(countriesForReport2, fmt.Sprintf("  %s: %d", kv.Key, kv.Value))
+		if len(details) > 0 {
+			key = fmt.Sprintf("%s (%s)", key, strings.Join(details, ", "))
 		}
+		kvs = append(kvs, KeyValue{Key: key, Value: ip.Count})
+	}
+	return kvs
+}
 
-		return []byte(fmt.Sprintf(`
->>> Report generated on: %[1]s
+// period of the sub report (eg. "Last 7 days", or "2024-03-01 00:00:00 ~ 2024-04-01 00:00:00")
+func (s SubReport) period() string {
+	if s.Since != nil && s.Until != nil {
+		return fmt.Sprintf("%s ~ %s", *s.Since, *s.Until)
+	}
+	return fmt.Sprintf("Last %d days", s.NumDays)
+}
 
+// note of the active filters for headers (eg. " [protocol: sshd]"), empty if there is none
+func (s SubReport) filterNote() string {
+	if len(s.Filters) > 0 {
+		return fmt.Sprintf(" [%s]", s.Filters)
+	}
+	return ""
+}
 
-> Last %[2]d days from the generated time:
----
-* Total: %[3]d ban action(s)
+// isDSN checks if given database path is a DSN/URI (eg. `file:/path/to/db.sqlite?cache=shared`)
+// rather than a plain filepath.
+//
+// A path is treated as a DSN when it starts with `file:` or contains `?`.
+func isDSN(path string) bool {
+	return strings.HasPrefix(path, "file:") || strings.Contains(path, "?")
+}
 
-* Protocols:
-%[4]s
+// check if given path is for an in-memory database (eg. ":memory:", "file::memory:?cache=shared", "file:test?mode=memory")
+func isMemoryDB(path string) bool {
+	return path == ":memory:" || strings.HasPrefix(path, "file::memory:") || strings.Contains(path, "mode=memory")
+}
 
-* Originating Countries:
-%[5]s
+// dbOptions represents options for opening a database
+type dbOptions struct {
+	BusyTimeoutMillis int    // milliseconds to wait for locks (`defaultDBBusyTimeoutMillis` if not positive)
+	JournalMode       string // eg. "WAL", "DELETE" (`defaultDBJournalMode` if empty)
+}
 
+// sqlite dsn parameters of the options
+func (o dbOptions) params() string {
+	busyTimeout := o.BusyTimeoutMillis
+	if busyTimeout <= 0 {
+		busyTimeout = defaultDBBusyTimeoutMillis
+	}
+	journalMode := o.JournalMode
+	if len(journalMode) <= 0 {
+		journalMode = defaultDBJournalMode
+	}
 
+	return fmt.Sprintf("_busy_timeout=%d&_journal_mode=%s", busyTimeout, journalMode)
+}
 
-> Last %[6]d days from the generated time:
----
-* Total: %[7]d ban action(s)
+// OpenDB opens database from given path.
+//
+// `path` can be a plain filepath or a DSN/URI with options (see `isDSN`), which will be passed to sqlite unchanged.
+// Plain filepaths will be opened with the busy timeout and journal mode of `opts`.
+// In-memory databases (see `isMemoryDB`) are also supported, without touching the filesystem.
+func OpenDB(path string, opts dbOptions) (result *Database, err error) {
+	dsn := path
+	if !isDSN(path) && !isMemoryDB(path) {
+		dsn = filepath.Clean(path)
+
+		if err = prepareDBDir(filepath.Dir(dsn)); err != nil {
+			return nil, err
+		}
 
-* Protocols:
-%[8]s
+		dsn = fmt.Sprintf("%s?%s", dsn, opts.params())
+	}
 
-* Originating Countries:
-%[9]s
-`,
-			report.GeneratedDatetime,
-			numDaysForReport1, report.LastDaysReport1.TotalCount, strings.Join(protocolsForReport1, "\n"), strings.Join(countriesForReport1, "\n"),
-			numDaysForReport2, report.LastDaysReport2.TotalCount, strings.Join(protocolsForReport2, "\n"), strings.Join(countriesForReport2, "\n"),
-		)), nil
+	var db *gorm.DB
+	if db, err = gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		Logger: logger.New(
+			log.New(os.Stderr, "\r\n", log.LstdFlags),
+			logger.Config{
+				SlowThreshold:             slowQueryThresholdSeconds * time.Second,
+				LogLevel:                  logger.Warn,
+				IgnoreRecordNotFoundError: true,
+				ParameterizedQueries:      true,
+				Colorful:                  false,
+			},
+		),
+	}); err == nil {
+		// NOTE: each connection to a private in-memory database has its own database, so use only one
+		if isMemoryDB(path) && !strings.Contains(path, "cache=shared") {
+			if sqlDB, err := db.DB(); err == nil {
+				sqlDB.SetMaxOpenConns(1)
+			}
+		}
+
+		// migrate database
+		if err := db.AutoMigrate(&BanActionLog{}, &Location{}, &Insight{}); err != nil {
+			logError("Failed to migrate database: %s", err)
+		}
+
+		return &Database{db: db}, nil
 	}
 
 	return nil, err
 }
 
-// GetFinalReportAsPlain generates final report as plain text.
-func (d *Database) GetFinalReportAsPlain(report, insight []byte) (result []byte) {
-	if insight != nil {
-		result = []byte(fmt.Sprintf(`%[1]s
-
-===
-* Generated insights (by %[3]s):
+// create the database directory if it is missing, and check if it is writable
+func prepareDBDir(dirpath string) (err error) {
+	if err = os.MkdirAll(dirpath, fs.ModePerm); err != nil {
+		return fmt.Errorf("failed to create database directory '%s': %s", dirpath, err)
+	}
 
-%[2]s`, string(report), string(insight), googleAIModel))
-	} else {
-		result = report
+	// (sqlite also needs to create journal files in the directory)
+	var file *os.File
+	if file, err = os.CreateTemp(dirpath, "."+applicationName+"-*"); err != nil {
+		return fmt.Errorf("database directory '%s' is not writable", dirpath)
 	}
+	file.Close()
+	os.Remove(file.Name())
 
-	return result
+	return nil
 }
 
-// GetReportAsJSON generates report in json format.
-func (d *Database) GetReportAsJSON(offsetDays, numDaysForReport1, numDaysForReport2 int) (result []byte, err error) {
-	var report Report
-	if report, err = d.generateReport(offsetDays, numDaysForReport1, numDaysForReport2); err == nil {
-		var bytes []byte
-		if bytes, err = json.Marshal(report); err == nil {
-			return bytes, nil
-		}
+// check if given database filepath is usable: an existing one should be a readable sqlite database,
+// and a new one should be in an existing directory
+//
+// (DSNs and in-memory databases are passed to sqlite unchanged, so they are not checked here)
+func validateDBFilepath(path string) error {
+	if isDSN(path) || isMemoryDB(path) {
+		return nil
 	}
 
-	return nil, err
-}
+	if info, err := os.Stat(path); err == nil {
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("'%s' is not a regular file", path)
+		}
 
-// GetFinalReportAsJSON generates final report as json.
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("'%s' is not readable: %s", path, err)
+		}
+		defer file.Close()
+
+		// (an empty file will be initialized by sqlite)
+		header := make([]byte, len(sqliteHeader))
+		if n, _ := io.ReadFull(file, header); n > 0 && string(header[:n]) != sqliteHeader {
+			return fmt.Errorf("'%s' is not a sqlite database", path)
+		}
+	} else if errors.Is(err, fs.ErrNotExist) {
+		dirpath := filepath.Dir(filepath.Clean(path))
+		if info, err := os.Stat(dirpath); err != nil || !info.IsDir() {
+			return fmt.Errorf("directory '%s' does not exist", dirpath)
+		}
+	} else {
+		return err
+	}
+
+	return nil
+}
+
+// BackupTo saves a consistent snapshot of the database to given path (with `VACUUM INTO`), then verifies it.
+//
+// It can be run while other processes are writing to the database. `path` must not exist, or must be an empty file.
+func (d *Database) BackupTo(path string) (err error) {
+	if res := d.db.Exec("VACUUM INTO ?", path); res.Error != nil {
+		return fmt.Errorf("failed to create snapshot: %s", res.Error)
+	}
+
+	return verifySnapshot(path)
+}
+
+// Vacuum rebuilds the database file (with `VACUUM`) for reclaiming the space of deleted rows.
+//
+// It cannot be run inside a transaction.
+func (d *Database) Vacuum() (err error) {
+	if _, inTransaction := d.db.Statement.ConnPool.(gorm.TxCommitter); inTransaction {
+		return fmt.Errorf("cannot vacuum inside a transaction")
+	}
+
+	if res := d.db.Exec("VACUUM"); res.Error != nil {
+		return res.Error
+	}
+
+	// truncate the write-ahead log (if any), so that the reclaimed space is returned to the filesystem
+	if res := d.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); res.Error != nil {
+		return fmt.Errorf("failed to checkpoint database: %s", res.Error)
+	}
+
+	return nil
+}
+
+// FileSize returns the size of the database file (with its write-ahead log if any) in bytes
+func (d *Database) FileSize() (size int64, err error) {
+	var databases []struct {
+		Seq  int
+		Name string
+		File string
+	}
+	if res := d.db.Raw("PRAGMA database_list").Scan(&databases); res.Error != nil {
+		return 0, res.Error
+	}
+
+	for _, database := range databases {
+		if database.Name != "main" || len(database.File) <= 0 {
+			continue
+		}
+
+		for _, path := range []string{database.File, database.File + "-wal"} {
+			if info, err := os.Stat(path); err == nil {
+				size += info.Size()
+			} else if !os.IsNotExist(err) {
+				return 0, err
+			}
+		}
+		return size, nil
+	}
+
+	return 0, fmt.Errorf("no database file (in-memory database?)")
+}
+
+// key of a ban action log for detecting already imported ones
+type importKey struct {
+	ip, protocol, host, eventType string
+	createdAt                     int64 // in unix nanoseconds
+}
+
+// import key of given log
+func newImportKey(log BanActionLog) importKey {
+	key := importKey{
+		ip:        log.IP,
+		protocol:  log.Protocol,
+		eventType: log.EventType,
+		createdAt: log.CreatedAt.UnixNano(),
+	}
+	if log.Host != nil {
+		key.host = *log.Host
+	}
+	return key
+}
+
+// ImportFrom merges ban action logs (with their timestamps) and locations from another database at given path.
+//
+// Ips of imported logs and locations are normalized (see `normalizeIP`).
+// Logs which already exist (with the same ip, protocol, timestamp, host, and event type) are not imported again,
+// and counted as `skippedBans` (along with ones with invalid ips), so importing the same database more than once is safe.
+// Locations of ips which are already cached are not imported (local values are preferred), and counted as `skippedLocations`.
+func (d *Database) ImportFrom(path string) (bans, skippedBans, locations, skippedLocations int, err error) {
+	if _, err = os.Stat(path); err != nil {
+		return 0, 0, 0, 0, err
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return 0, 0, 0, 0, err
+	}
+
+	// (escape the path, as it can have characters like '?' or '#')
+	uri := url.URL{Scheme: "file", Path: filepath.ToSlash(path), RawQuery: "mode=ro"}
+
+	var src *gorm.DB
+	if src, err = gorm.Open(sqlite.Open(uri.String()), &gorm.Config{
+		Logger: logger.Discard,
+	}); err != nil {
+		return 0, 0, 0, 0, fmt.Errorf("failed to open source database: %s", err)
+	}
+	if sqlDB, err := src.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+
+	err = d.db.Transaction(func(tx *gorm.DB) error {
+		// ban action logs
+		var logs []BanActionLog
+		if res := src.FindInBatches(&logs, numRowsForBatchInsert, func(_ *gorm.DB, _ int) error {
+			// normalize ips
+			batch := []BanActionLog{}
+			ips := []string{}
+			var since, until time.Time
+			for _, log := range logs {
+				ip, err := normalizeIP(log.IP)
+				if err != nil {
+					logWarn("Skipping ban action log with invalid ip '%s'", log.IP)
+					skippedBans++
+					continue
+				}
+				log.IP = ip
+				batch = append(batch, log)
+				ips = append(ips, ip)
+
+				if since.IsZero() || log.CreatedAt.Before(since) {
+					since = log.CreatedAt
+				}
+				if until.IsZero() || log.CreatedAt.After(until) {
+					until = log.CreatedAt
+				}
+			}
+			if len(batch) <= 0 {
+				return nil
+			}
+
+			// keys of existing logs in the range of this batch
+			var existing []BanActionLog
+			if res := tx.Unscoped().Model(&BanActionLog{}).
+				Select("ip", "protocol", "created_at", "host", "event_type").
+				Where("ip IN ? AND created_at >= ? AND created_at <= ?", ips, since, until).
+				Find(&existing); res.Error != nil {
+				return res.Error
+			}
+			keys := map[importKey]bool{}
+			for _, log := range existing {
+				keys[newImportKey(log)] = true
+			}
+
+			newLogs := []BanActionLog{}
+			for _, log := range batch {
+				key := newImportKey(log)
+				if keys[key] {
+					skippedBans++
+					continue
+				}
+				keys[key] = true
+
+				log.ID = 0 // new id
+				newLogs = append(newLogs, log)
+			}
+			if len(newLogs) > 0 {
+				if res := tx.Create(&newLogs); res.Error != nil {
+					return res.Error
+				}
+				bans += len(newLogs)
+			}
+			return nil
+		}); res.Error != nil {
+			return fmt.Errorf("failed to import ban action logs: %s", res.Error)
+		}
+
+		// locations
+		var locs []Location
+		if res := src.FindInBatches(&locs, numRowsForBatchInsert, func(_ *gorm.DB, _ int) error {
+			ips := []string{}
+			for i := range locs {
+				if ip, err := normalizeIP(locs[i].IP); err == nil {
+					locs[i].IP = ip
+				}
+				ips = append(ips, locs[i].IP)
+			}
+
+			// already cached ips
+			var cached []string
+			if res := tx.Unscoped().Model(&Location{}).Where("ip IN ?", ips).Pluck("ip", &cached); res.Error != nil {
+				return res.Error
+			}
+			exists := map[string]bool{}
+			for _, ip := range cached {
+				exists[ip] = true
+			}
+
+			newLocs := []Location{}
+			for _, loc := range locs {
+				if exists[loc.IP] {
+					skippedLocations++
+					continue
+				}
+				exists[loc.IP] = true
+
+				loc.ID = 0 // new id
+				newLocs = append(newLocs, loc)
+			}
+			if len(newLocs) > 0 {
+				if res := tx.Create(&newLocs); res.Error != nil {
+					return res.Error
+				}
+				locations += len(newLocs)
+			}
+			return nil
+		}); res.Error != nil {
+			return fmt.Errorf("failed to import locations: %s", res.Error)
+		}
+
+		return nil
+	})
+
+	return bans, skippedBans, locations, skippedLocations, err
+}
+
+// check if the database snapshot at given path opens cleanly and passes the integrity check
+func verifySnapshot(path string) (err error) {
+	var db *gorm.DB
+	if db, err = gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=ro", path)), &gorm.Config{
+		Logger: logger.Discard,
+	}); err != nil {
+		return fmt.Errorf("failed to open snapshot: %s", err)
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+
+	var result string
+	if res := db.Raw("PRAGMA quick_check").Scan(&result); res.Error != nil {
+		return fmt.Errorf("failed to check snapshot: %s", res.Error)
+	}
+	if result != "ok" {
+		return fmt.Errorf("snapshot failed integrity check: %s", result)
+	}
+
+	return nil
+}
+
+// CloseDB closes database.
+func (d *Database) CloseDB() {
+	if db, err := d.db.DB(); err == nil {
+		db.Close()
+	}
+}
+
+// Transaction runs given function in a transaction.
+func (d *Database) Transaction(fn func(tx *Database) error) error {
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&Database{db: tx, host: d.host})
+	})
+}
+
+// SaveBanAction to local database (with an optional jail name)
+func (d *Database) SaveBanAction(protocol, ip string, tags map[string]string, jail ...string) (id uint, err error) {
+	return d.saveEvent(protocol, ip, eventTypeBan, tags, optionalJail(jail), time.Now())
+}
+
+// SaveBanActionAt saves a ban action with given timestamp (and an optional jail name) to local database
+func (d *Database) SaveBanActionAt(protocol, ip string, tags map[string]string, timestamp time.Time, jail ...string) (id uint, err error) {
+	return d.saveEvent(protocol, ip, eventTypeBan, tags, optionalJail(jail), timestamp)
+}
+
+// SaveBanEvent saves a ban or unban event (`eventType`, with an optional jail name) to local database
+func (d *Database) SaveBanEvent(protocol, ip, eventType string, tags map[string]string, jail ...string) (id uint, err error) {
+	return d.saveEvent(protocol, ip, eventType, tags, optionalJail(jail), time.Now())
+}
+
+// RecentlySaved checks if a ban action of given ip and protocol was saved within given duration
+func (d *Database) RecentlySaved(ip, protocol string, within time.Duration) (saved bool, err error) {
+	if ip, err = normalizeIP(ip); err != nil {
+		return false, err
+	}
+
+	var count int64
+	res := d.db.Model(&BanActionLog{}).
+		Where("created_at >= ? AND ip = ? AND protocol = ? AND event_type = ?", time.Now().Add(-within), ip, protocol, eventTypeBan).
+		Limit(1).
+		Count(&count)
+
+	return count > 0, res.Error
+}
+
+// returns the first non-empty jail name, or nil if there is none
+func optionalJail(jail []string) *string {
+	for _, j := range jail {
+		if len(j) > 0 {
+			return &j
+		}
+	}
+	return nil
+}
+
+// save an event with given timestamp to local database
+func (d *Database) saveEvent(protocol, ip, eventType string, tags map[string]string, jail *string, timestamp time.Time) (id uint, err error) {
+	var bal BanActionLog
+	if bal, err = newBanActionLog(protocol, ip, eventType, tags, jail, timestamp); err != nil {
+		return 0, err
+	}
+	bal.Host = d.hostName()
+	res := d.db.Create(&bal)
+
+	return bal.ID, res.Error
+}
+
+// build a log of an event with given values
+func newBanActionLog(protocol, ip, eventType string, tags map[string]string, jail *string, timestamp time.Time) (bal BanActionLog, err error) {
+	if ip, err = normalizeIP(ip); err != nil {
+		return bal, err
+	}
+
+	bal = BanActionLog{
+		Protocol:  protocol,
+		CreatedAt: timestamp,
+		IP:        ip,
+		EventType: eventType,
+		Jail:      jail,
+	}
+	if len(tags) > 0 {
+		var bytes []byte
+		if bytes, err = json.Marshal(tags); err != nil {
+			return bal, err
+		}
+		encoded := string(bytes)
+		bal.Tags = &encoded
+	}
+
+	return bal, nil
+}
+
+// SaveBanActionsBatch saves given logs to local database in batches
+func (d *Database) SaveBanActionsBatch(logs []BanActionLog) (inserted int, err error) {
+	if len(logs) <= 0 {
+		return 0, nil
+	}
+
+	for i := range logs {
+		if logs[i].Host == nil {
+			logs[i].Host = d.hostName()
+		}
+	}
+
+	res := d.db.CreateInBatches(&logs, numRowsForBatchInsert)
+
+	return int(res.RowsAffected), res.Error
+}
+
+func (d *Database) UpdateBanActionLocation(id uint, location string) (err error) {
+	res := d.db.Model(&BanActionLog{}).Where(id).Update("location", location)
+
+	return res.Error
+}
+
+// LookupLocation from local database
+func (d *Database) LookupLocation(ip string) (result Location, err error) {
+	if ip, err = normalizeIP(ip); err != nil {
+		return result, err
+	}
+
+	res := d.db.Limit(1).Where("ip = ?", ip).Find(&result)
+
+	return result, res.Error
+}
+
+func (d *Database) UpdateLocation(ip string, location GeoLocation) (err error) {
+	values := map[string]any{
+		"country_name": location.CountryName,
+		"city":         location.City,
+		"region":       location.Region,
+		"asn":          location.ASN,
+		"organization": location.Organization,
+	}
+	if len(location.RawResponse) > 0 { // NOTE: keep the stored one if there is no new one
+		values["raw_response"] = location.RawResponse
+	}
+	res := d.db.Model(&Location{}).Where("ip = ?", ip).Updates(values)
+
+	return res.Error
+}
+
+// SaveLocation to local database
+func (d *Database) SaveLocation(ip string, location GeoLocation) (id uint, err error) {
+	if ip, err = normalizeIP(ip); err != nil {
+		return 0, err
+	}
+
+	loc := Location{
+		IP:          ip,
+		CountryName: location.CountryName,
+		City:        location.City,
+		Region:      location.Region,
+
+		ASN:          location.ASN,
+		Organization: location.Organization,
+
+		RawResponse: location.RawResponse,
+	}
+	res := d.db.Create(&loc)
+
+	return loc.ID, res.Error
+}
+
+// GetCachedInsight returns the cached insight of given hash (nil if not cached, or older than `ttl`)
+func (d *Database) GetCachedInsight(hash string, ttl time.Duration) (result *string, err error) {
+	var insight Insight
+	res := d.db.Limit(1).Where("hash = ? AND updated_at >= ?", hash, time.Now().Add(-ttl)).Find(&insight)
+	if res.Error != nil || res.RowsAffected <= 0 {
+		return nil, res.Error
+	}
+
+	return &insight.Text, nil
+}
+
+// SaveInsight saves (or replaces) the cached insight of given hash
+func (d *Database) SaveInsight(hash, text string) (err error) {
+	res := d.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "hash"}},
+		DoUpdates: clause.AssignmentColumns([]string{"text", "updated_at", "deleted_at"}),
+	}).Create(&Insight{Hash: hash, Text: text})
+
+	return res.Error
+}
+
+// GenerateReport generates structured report data (`offsetDays` in number of days; positive for future, negative for past)
+//
+// `GetReportAs*` functions render the report generated by this function.
+func (d *Database) GenerateReport(offsetDays int, opts reportOptions) (result Report, err error) {
+	timestamp := time.Now().AddDate(0, 0, offsetDays)
+
+	result = Report{
+		GeneratedDatetime: opts.formatTime(timestamp),
+	}
+	if opts.groupByTag() != "" {
+		result.GroupBy = &opts.GroupBy
+	}
+
+	if opts.Since != nil && opts.Until != nil {
+		// sub report of the absolute period
+		var sub SubReport
+		if sub, err = d.generateSubReport(*opts.Since, opts.Until, opts); err != nil {
+			return result, err
+		}
+		since, until := opts.formatTime(*opts.Since), opts.formatTime(*opts.Until)
+		sub.Since, sub.Until = &since, &until
+		sub.NumDays = int(math.Ceil(opts.Until.Sub(*opts.Since).Hours() / 24))
+
+		result.Windows = []SubReport{sub}
+	} else {
+		// sub report of last N days for each window
+		if result.Windows, err = d.generateSubReports(offsetDays, opts.days(), opts); err != nil {
+			return result, err
+		}
+	}
+
+	if opts.ISOCodes {
+		for i := range result.Windows {
+			result.Windows[i].fillCountryCodes()
+		}
+	}
+
+	if opts.Timeseries {
+		// daily counts of the largest window
+		since, until := opts.Since, opts.Until
+		if since == nil || until == nil {
+			since, until = nil, nil
+			for _, numDays := range opts.days() {
+				if s := time.Now().AddDate(0, 0, offsetDays-numDays); since == nil || s.Before(*since) {
+					since = &s
+				}
+			}
+		}
+		if since != nil {
+			if result.DailyCounts, err = d.dailyCounts(*since, until, opts); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	result.Empty = true
+	for _, sub := range result.Windows {
+		if sub.TotalCount > 0 {
+			result.Empty = false
+			break
+		}
+	}
+
+	return result, err
+}
+
+// count ban actions of each day (in UTC) since given time (and before `until` if given)
+//
+// days without any ban action are included with zero counts, so the series is continuous.
+func (d *Database) dailyCounts(since time.Time, until *time.Time, opts reportOptions) (result []DayCount, err error) {
+	tx := d.db.Model(&BanActionLog{}).Where("ban_action_logs.created_at >= ? AND ban_action_logs.event_type = ?", since, eventTypeBan)
+	if until != nil {
+		tx = tx.Where("ban_action_logs.created_at < ?", *until)
+	}
+
+	var rows []DayCount
+	if res := opts.filter(tx).
+		Select("date(ban_action_logs.created_at) AS date, COUNT(*) AS count").
+		Group("date").
+		Scan(&rows); res.Error != nil {
+		return nil, res.Error
+	}
+	counts := map[string]int{}
+	for _, row := range rows {
+		counts[row.Date] = row.Count
+	}
+
+	last := time.Now()
+	if until != nil {
+		last = until.Add(-time.Nanosecond)
+	}
+	first := since.UTC()
+	day := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, time.UTC)
+
+	result = []DayCount{}
+	for ; !day.After(last); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		result = append(result, DayCount{Date: date, Count: counts[date]})
+	}
+
+	return result, nil
+}
+
+// generate sub reports of last N days (`windowDays`) from the offset
+func (d *Database) generateSubReports(offsetDays int, windowDays []int, opts reportOptions) (result []SubReport, err error) {
+	result = []SubReport{}
+
+	for _, numDays := range windowDays {
+		var sub SubReport
+		if sub, err = d.generateSubReport(time.Now().AddDate(0, 0, offsetDays-numDays), nil, opts); err != nil {
+			return result, err
+		}
+		sub.NumDays = numDays
+
+		result = append(result, sub)
+	}
+
+	return result, nil
+}
+
+// generate sub report data from logs created since given time (and before `until` if given)
+//
+// counts are aggregated in the database, so logs are not loaded into memory.
+func (d *Database) generateSubReport(since time.Time, until *time.Time, opts reportOptions) (result SubReport, err error) {
+	result = SubReport{
+		ProtocolCounts: KeyValues{},
+		CountryCounts:  KeyValues{},
+		OrgCounts:      KeyValues{},
+		Filters:        opts.filters(),
+	}
+
+	// ban events in the window (unban events are only used for counting active bans)
+	bans := func() *gorm.DB {
+		tx := d.db.Model(&BanActionLog{}).Where("ban_action_logs.created_at >= ? AND ban_action_logs.event_type = ?", since, eventTypeBan)
+		if until != nil {
+			tx = tx.Where("ban_action_logs.created_at < ?", *until)
+		}
+		return opts.filter(tx)
+	}
+
+	// aggregated rows
+	type row struct {
+		Name         string
+		Region       string
+		CountryName  string
+		ASN          string
+		Organization string
+		Count        int
+	}
+	add := func(kvs *KeyValues, key string, count int) {
+		oldCount, _ := kvs.Get(key)
+		kvs.Set(key, oldCount+count)
+	}
+
+	// total count
+	var total int64
+	if res := bans().Count(&total); res.Error != nil {
+		return result, res.Error
+	}
+	result.TotalCount = int(total)
+
+	// counts for address families (ips with colons are classified with netip, so v4-mapped v6 addresses in any form are counted as v4)
+	var rows []row
+	if res := bans().Select("ban_action_logs.ip AS name, COUNT(*) AS count").Where("ban_action_logs.ip LIKE ?", "%:%").Group("ban_action_logs.ip").Scan(&rows); res.Error != nil {
+		return result, res.Error
+	}
+	for _, r := range rows {
+		if addr, err := netip.ParseAddr(r.Name); err == nil && !addr.Unmap().Is4() {
+			result.TotalV6 += r.Count
+		}
+	}
+	result.TotalV4 = result.TotalCount - result.TotalV6
+
+	// active bans
+	if result.ActiveCount, err = d.countActiveBans(since, until, result.TotalCount, opts); err != nil {
+		return result, err
+	}
+
+	// counts for protocols
+	rows = nil
+	if res := bans().Select("protocol AS name, COUNT(*) AS count").Group("protocol").Scan(&rows); res.Error != nil {
+		return result, res.Error
+	}
+	for _, r := range rows {
+		add(&result.ProtocolCounts, r.Name, r.Count)
+	}
+
+	// counts for jails (only when jail data is present)
+	rows = nil
+	if res := bans().Select("jail AS name, COUNT(*) AS count").Where("jail IS NOT NULL AND jail != ''").Group("jail").Scan(&rows); res.Error != nil {
+		return result, res.Error
+	}
+	for _, r := range rows {
+		if result.JailCounts == nil {
+			result.JailCounts = KeyValues{}
+		}
+		add(&result.JailCounts, r.Name, r.Count)
+	}
+
+	// counts for hosts (only when host data is present)
+	rows = nil
+	if res := bans().Select("COALESCE(NULLIF(host, ''), ?) AS name, COUNT(*) AS count", unknownHost).Group("name").Scan(&rows); res.Error != nil {
+		return result, res.Error
+	}
+	for _, r := range rows {
+		if r.Name != unknownHost {
+			result.HostCounts = KeyValues{}
+			break
+		}
+	}
+	if result.HostCounts != nil {
+		for _, r := range rows {
+			add(&result.HostCounts, r.Name, r.Count)
+		}
+	}
+
+	// counts for countries (and trusted ones)
+	rows = nil
+	if res := bans().Select("location AS name, COUNT(*) AS count").Where("location IS NOT NULL").Group("location").Scan(&rows); res.Error != nil {
+		return result, res.Error
+	}
+	for _, r := range rows {
+		add(&result.CountryCounts, r.Name, r.Count)
+
+		if containsFold(opts.TrustedCountries, r.Name) {
+			if result.TrustedCountryCounts == nil {
+				result.TrustedCountryCounts = KeyValues{}
+			}
+			add(&result.TrustedCountryCounts, r.Name, r.Count)
+		}
+	}
+
+	// counts for cities and networks (from cached locations)
+	rows = nil
+	if res := bans().
+		Select("COALESCE(locations.city, '') AS name, COALESCE(locations.region, '') AS region, COALESCE(locations.country_name, '') AS country_name, COALESCE(locations.asn, '') AS asn, COALESCE(locations.organization, '') AS organization, COUNT(*) AS count").
+		Joins("LEFT JOIN locations ON locations.ip = ban_action_logs.ip AND locations.deleted_at IS NULL").
+		Group("locations.city, locations.region, locations.country_name, locations.asn, locations.organization").
+		Scan(&rows); res.Error != nil {
+		return result, res.Error
+	}
+	for _, r := range rows {
+		location := Location{
+			CountryName:  r.CountryName,
+			City:         r.Name,
+			Region:       r.Region,
+			ASN:          r.ASN,
+			Organization: r.Organization,
+		}
+		if city := location.cityKey(); city != "" {
+			if result.CityCounts == nil {
+				result.CityCounts = KeyValues{}
+			}
+			add(&result.CityCounts, city, r.Count)
+		}
+		add(&result.OrgCounts, location.networkKey(), r.Count)
+	}
+
+	// top offending ips
+	if result.TopIPs, err = d.topIPs(since, until, opts.numTopIPs(), opts); err != nil {
+		return result, err
+	}
+
+	// high-risk ips
+	if result.HighRiskIPs, err = d.highRiskIPs(since, until, opts.numTopIPs(), opts); err != nil {
+		return result, err
+	}
+
+	// first/last seen times of countries
+	if result.CountriesSeen, err = d.countriesSeen(since, until, opts); err != nil {
+		return result, err
+	}
+
+	// bans by hour of day
+	var hours [24]int
+	if hours, err = d.countByHour(since, until, opts); err != nil {
+		return result, err
+	}
+	result.HourCounts = &hours
+
+	// counts for the grouped tag
+	if tag := opts.groupByTag(); tag != "" {
+		result.GroupedCounts = KeyValues{}
+
+		var tagRows []struct {
+			Tags  *string
+			Count int
+		}
+		if res := bans().Select("tags, COUNT(*) AS count").Group("tags").Scan(&tagRows); res.Error != nil {
+			return result, res.Error
+		}
+		for _, r := range tagRows {
+			add(&result.GroupedCounts, BanActionLog{Tags: r.Tags}.tagValue(tag), r.Count)
+		}
+	}
+
+	return result, nil
+}
+
+// TopIPs returns `limit` ips with the most bans since given time.
+func (d *Database) TopIPs(since time.Time, limit int) (result []IPCount, err error) {
+	return d.topIPs(since, nil, limit, reportOptions{})
+}
+
+// get `limit` ips with the most bans since given time (and before `until` if given), restricted with the filters of `opts`
+func (d *Database) topIPs(since time.Time, until *time.Time, limit int, opts reportOptions) (result []IPCount, err error) {
+	result = []IPCount{}
+
+	tx := d.db.Model(&BanActionLog{}).Where("created_at >= ? AND event_type = ?", since, eventTypeBan)
+	if until != nil {
+		tx = tx.Where("created_at < ?", *until)
+	}
+	tx = opts.filter(tx)
+	if res := tx.Select("ip, MAX(location) AS country, COUNT(*) AS count").Group("ip").Order("count DESC, ip ASC").Limit(limit).Scan(&result); res.Error != nil {
+		return result, res.Error
+	}
+
+	return result, nil
+}
+
+// first/last seen times of countries in the window (most recently seen ones first)
+func (d *Database) countriesSeen(since time.Time, until *time.Time, opts reportOptions) (result []CountrySeen, err error) {
+	tx := d.db.Model(&BanActionLog{}).Where("ban_action_logs.created_at >= ? AND ban_action_logs.event_type = ?", since, eventTypeBan)
+	if until != nil {
+		tx = tx.Where("ban_action_logs.created_at < ?", *until)
+	}
+
+	var rows []struct {
+		Country   string
+		FirstSeen string
+		LastSeen  string
+		Count     int
+	}
+	if res := opts.filter(tx).
+		Select("COALESCE(ban_action_logs.location, ?) AS country, MIN(ban_action_logs.created_at) AS first_seen, MAX(ban_action_logs.created_at) AS last_seen, COUNT(*) AS count", unknownLocation).
+		Group("country").
+		Order("last_seen DESC, country ASC").
+		Scan(&rows); res.Error != nil {
+		return nil, res.Error
+	}
+
+	result = []CountrySeen{}
+	for _, row := range rows {
+		seen := CountrySeen{Country: row.Country, Count: row.Count}
+		if seen.FirstSeen, err = parseSQLiteTimestamp(row.FirstSeen); err != nil {
+			return nil, err
+		}
+		if seen.LastSeen, err = parseSQLiteTimestamp(row.LastSeen); err != nil {
+			return nil, err
+		}
+		result = append(result, seen)
+	}
+
+	return result, nil
+}
+
+// CountByHour counts bans since given time by hour of day (in UTC)
+func (d *Database) CountByHour(since time.Time) (result [24]int, err error) {
+	return d.countByHour(since, nil, reportOptions{})
+}
+
+// count bans in the window by hour of day (in UTC)
+func (d *Database) countByHour(since time.Time, until *time.Time, opts reportOptions) (result [24]int, err error) {
+	tx := d.db.Model(&BanActionLog{}).Where("ban_action_logs.created_at >= ? AND ban_action_logs.event_type = ?", since, eventTypeBan)
+	if until != nil {
+		tx = tx.Where("ban_action_logs.created_at < ?", *until)
+	}
+
+	var rows []struct {
+		Hour  int
+		Count int
+	}
+	if res := opts.filter(tx).
+		Select("CAST(strftime('%H', ban_action_logs.created_at) AS INTEGER) AS hour, COUNT(*) AS count").
+		Group("hour").
+		Scan(&rows); res.Error != nil {
+		return result, res.Error
+	}
+	for _, row := range rows {
+		if row.Hour >= 0 && row.Hour < len(result) {
+			result[row.Hour] = row.Count
+		}
+	}
+
+	return result, nil
+}
+
+// ips with abuse confidence scores higher than `highRiskAbuseScore` (and their numbers of bans) in the window
+func (d *Database) highRiskIPs(since time.Time, until *time.Time, limit int, opts reportOptions) (result []IPCount, err error) {
+	result = []IPCount{}
+
+	tx := d.db.Model(&BanActionLog{}).
+		Joins("JOIN locations ON locations.ip = ban_action_logs.ip AND locations.deleted_at IS NULL").
+		Where("ban_action_logs.created_at >= ? AND ban_action_logs.event_type = ? AND locations.abuse_score > ?", since, eventTypeBan, highRiskAbuseScore)
+	if until != nil {
+		tx = tx.Where("ban_action_logs.created_at < ?", *until)
+	}
+	tx = opts.filter(tx)
+	if res := tx.Select("ban_action_logs.ip AS ip, MAX(ban_action_logs.location) AS country, COUNT(*) AS count, MAX(locations.abuse_score) AS abuse_score").
+		Group("ban_action_logs.ip").
+		Order("abuse_score DESC, count DESC, ip ASC").
+		Limit(limit).
+		Scan(&result); res.Error != nil {
+		return result, res.Error
+	}
+
+	return result, nil
+}
+
+// SetAbuseScore sets the abuse confidence score of a cached location
+func (d *Database) SetAbuseScore(ip string, score int) (err error) {
+	res := d.db.Model(&Location{}).Where("ip = ?", ip).Update("abuse_score", score)
+
+	return res.Error
+}
+
+// count bans not lifted yet, by pairing ban/unban events in the window chronologically
+//
+// if there is no unban event in the window, all `numBans` bans are active.
+func (d *Database) countActiveBans(since time.Time, until *time.Time, numBans int, opts reportOptions) (count int, err error) {
+	events := func() *gorm.DB {
+		tx := d.db.Model(&BanActionLog{}).Where("created_at >= ?", since)
+		if until != nil {
+			tx = tx.Where("created_at < ?", *until)
+		}
+		if len(opts.FilterProtocol) > 0 {
+			tx = tx.Where("protocol = ?", opts.FilterProtocol)
+		}
+		if len(opts.FilterCountry) > 0 {
+			// NOTE: unban events have no locations, so match their ips with the ones of ban events
+			tx = tx.Where("ip IN (?)", d.db.Model(&BanActionLog{}).Select("ip").Where("LOWER(location) = LOWER(?)", opts.FilterCountry))
+		}
+		return tx
+	}
+
+	var numUnbans int64
+	if res := events().Where("event_type = ?", eventTypeUnban).Count(&numUnbans); res.Error != nil {
+		return 0, res.Error
+	}
+	if numUnbans <= 0 {
+		return numBans, nil
+	}
+
+	// NOTE: iterate rows without loading them all into memory
+	rows, err := events().Select("protocol, ip, event_type").Order("created_at ASC").Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	active := map[string]int{}
+	for rows.Next() {
+		var protocol, ip, eventType string
+		if err = rows.Scan(&protocol, &ip, &eventType); err != nil {
+			return 0, err
+		}
+
+		key := protocol + "|" + ip
+		if eventType == eventTypeUnban {
+			if active[key] > 0 {
+				active[key]--
+			}
+		} else {
+			active[key]++
+		}
+	}
+	for _, c := range active {
+		count += c
+	}
+
+	return count, rows.Err()
+}
+
+// GetReportAsPlain generates report in plain text format.
+func (d *Database) GetReportAsPlain(offsetDays int, opts reportOptions) (result []byte, err error) {
+	// generate report text
+	var report Report
+	if report, err = d.GenerateReport(offsetDays, opts); err == nil {
+		if report.Empty {
+			return []byte(fmt.Sprintf(`
+>>> Report generated on: %[1]s
+
+%[2]s
+`, report.GeneratedDatetime, emptyReportMessage)), nil
+		}
+
+		windows := []string{}
+		for _, sub := range report.Windows {
+			sections := opts.buildSections(report, sub,
+				func(sub SubReport) string {
+					return fmt.Sprintf("* Total: %d ban action(s) (IPv4: %d, IPv6: %d, active: %d)", sub.TotalCount, sub.TotalV4, sub.TotalV6, sub.ActiveCount)
+				},
+				func(section reportSection, title string, kvs KeyValues) string {
+					// hours in a bar chart, others in lines
+					if section == reportSectionHours {
+						return fmt.Sprintf("* %s:\n%s", title, strings.Join(barChartLines(kvs, "  "), "\n"))
+					}
+					return fmt.Sprintf("* %s:\n%s", title, strings.Join(keyValueLines(kvs, "  "), "\n"))
+				},
+			)
+
+			title := sub.period()
+			if sub.Since == nil {
+				title += " from the generated time"
+			}
+			title += sub.filterNote()
+
+			windows = append(windows, fmt.Sprintf(`> %[1]s:
+---
+%[2]s`, title, strings.Join(sections, "\n\n")))
+		}
+
+		return []byte(fmt.Sprintf(`
+>>> Report generated on: %[1]s
+
+
+%[2]s
+`,
+			report.GeneratedDatetime,
+			strings.Join(windows, "\n\n\n\n"),
+		)), nil
+	}
+
+	return nil, err
+}
+
+// GetReportAsPlainRange generates report of logs created in [since, until) in plain text format.
+func (d *Database) GetReportAsPlainRange(since, until time.Time, opts reportOptions) (result []byte, err error) {
+	opts.Since, opts.Until = &since, &until
+	return d.GetReportAsPlain(0, opts)
+}
+
+// GetFinalReportAsPlain generates final report as plain text.
+//
+// `model` is the name of the model which generated the insight.
+func (d *Database) GetFinalReportAsPlain(report, insight []byte, model string) (result []byte) {
+	if insight != nil {
+		result = []byte(fmt.Sprintf(`%[1]s
+
+===
+* Generated insights (by %[3]s):
+
+%[2]s`, string(report), string(insight), model))
+	} else {
+		result = report
+	}
+
+	return result
+}
+
+// GetReportAsJSON generates report in json format.
+func (d *Database) GetReportAsJSON(offsetDays int, opts reportOptions) (result []byte, err error) {
+	var report Report
+	if report, err = d.GenerateReport(offsetDays, opts); err == nil {
+		for i := range report.Windows {
+			sub := &report.Windows[i]
+			sub.ProtocolCounts = sortKeyValues(sub.ProtocolCounts, opts.Sort)
+			sub.CountryCounts = sortKeyValues(sub.CountryCounts, opts.Sort)
+			if sub.CityCounts != nil {
+				sub.CityCounts = sortKeyValues(sub.CityCounts, opts.Sort)
+			}
+			sub.OrgCounts = sortKeyValues(sub.OrgCounts, opts.Sort)
+			if sub.JailCounts != nil {
+				sub.JailCounts = sortKeyValues(sub.JailCounts, opts.Sort)
+			}
+			if sub.HostCounts != nil {
+				sub.HostCounts = sortKeyValues(sub.HostCounts, opts.Sort)
+			}
+			if opts.Anonymize {
+				for j := range sub.TopIPs {
+					sub.TopIPs[j].IP = maskIP(sub.TopIPs[j].IP)
+				}
+				for j := range sub.HighRiskIPs {
+					sub.HighRiskIPs[j].IP = maskIP(sub.HighRiskIPs[j].IP)
+				}
+			}
+			if sub.GroupedCounts != nil {
+				sub.GroupedCounts = sortKeyValues(sub.GroupedCounts, opts.Sort)
+			}
+			if sub.TrustedCountryCounts != nil {
+				sub.TrustedCountryCounts = sortKeyValues(sub.TrustedCountryCounts, opts.Sort)
+			}
+		}
+
+		var bytes []byte
+		if bytes, err = json.Marshal(report); err == nil {
+			return bytes, nil
+		}
+	}
+
+	return nil, err
+}
+
+// GetReportAsJSONRange generates report of logs created in [since, until) in json format.
+func (d *Database) GetReportAsJSONRange(since, until time.Time, opts reportOptions) (result []byte, err error) {
+	opts.Since, opts.Until = &since, &until
+	return d.GetReportAsJSON(0, opts)
+}
+
+// GetFinalReportAsJSON generates final report as json.
 func (d *Database) GetFinalReportAsJSON(report, insight []byte) (result []byte) {
 	if insight != nil {
 		var tempReport Report
@@ -343,150 +1886,1116 @@ func (d *Database) GetFinalReportAsJSON(report, insight []byte) (result []byte)
 			str := string(insight)
 			tempReport.Insight = &str
 
-			if temp, err := json.Marshal(tempReport); err == nil {
-				result = temp
+			if temp, err := json.Marshal(tempReport); err == nil {
+				result = temp
+			} else {
+				result = report
+			}
+		}
+	} else {
+		result = report
+	}
+
+	return result
+}
+
+// GetFinalReportAsMsgpack generates final report as MessagePack from given json report.
+//
+// The encoded report has the same shape as the json one.
+func (d *Database) GetFinalReportAsMsgpack(report, insight []byte) (result []byte, err error) {
+	var tempReport Report
+	if err = json.Unmarshal(d.GetFinalReportAsJSON(report, insight), &tempReport); err == nil {
+		var buf bytes.Buffer
+		encoder := msgpack.NewEncoder(&buf)
+		encoder.SetCustomStructTag("json")
+		if err = encoder.Encode(tempReport); err == nil {
+			return buf.Bytes(), nil
+		}
+	}
+
+	return nil, err
+}
+
+// GetReportAsMarkdown generates report in markdown format.
+func (d *Database) GetReportAsMarkdown(offsetDays int, opts reportOptions) (result []byte, err error) {
+	var report Report
+	if report, err = d.GenerateReport(offsetDays, opts); err == nil {
+		if report.Empty {
+			return []byte(fmt.Sprintf(`# Report (generated on %[1]s)
+
+%[2]s
+`, report.GeneratedDatetime, emptyReportMessage)), nil
+		}
+
+		windows := []string{}
+		for _, sub := range report.Windows {
+			sections := opts.buildSections(report, sub,
+				func(sub SubReport) string {
+					return fmt.Sprintf("**Total**: %d ban action(s) (IPv4: %d, IPv6: %d, active: %d)", sub.TotalCount, sub.TotalV4, sub.TotalV6, sub.ActiveCount)
+				},
+				func(section reportSection, title string, kvs KeyValues) string {
+					// countries in a table, others in a bullet list
+					lines := []string{}
+					if section == reportSectionCountries {
+						lines = append(lines, "| Country | Count |", "| --- | ---: |")
+						for _, kv := range kvs {
+							lines = append(lines, fmt.Sprintf("| %s | %d |", escapeMarkdownTableCell(kv.Key), kv.Value))
+						}
+					} else {
+						lines = keyValueLines(kvs, "- ")
+					}
+
+					return fmt.Sprintf("### %s\n\n%s", title, strings.Join(lines, "\n"))
+				},
+			)
+
+			windows = append(windows, fmt.Sprintf(`## %[1]s
+
+%[2]s`, sub.period()+sub.filterNote(), strings.Join(sections, "\n\n")))
+		}
+
+		return []byte(fmt.Sprintf(`# Report (generated on %[1]s)
+
+%[2]s
+`,
+			report.GeneratedDatetime,
+			strings.Join(windows, "\n\n"),
+		)), nil
+	}
+
+	return nil, err
+}
+
+// GetReportAsMarkdownRange generates report of logs created in [since, until) in markdown format.
+func (d *Database) GetReportAsMarkdownRange(since, until time.Time, opts reportOptions) (result []byte, err error) {
+	opts.Since, opts.Until = &since, &until
+	return d.GetReportAsMarkdown(0, opts)
+}
+
+// GetFinalReportAsMarkdown generates final report as markdown, with insights in a blockquote.
+//
+// `model` is the name of the model which generated the insight.
+func (d *Database) GetFinalReportAsMarkdown(report, insight []byte, model string) (result []byte) {
+	if insight != nil {
+		lines := []string{}
+		for _, line := range strings.Split(strings.TrimSpace(string(insight)), "\n") {
+			lines = append(lines, strings.TrimSpace("> "+line))
+		}
+
+		result = []byte(fmt.Sprintf(`%[1]s
+## Insights
+
+%[2]s
+
+_insights generated by %[3]s_
+`, string(report), strings.Join(lines, "\n"), model))
+	} else {
+		result = report
+	}
+
+	return result
+}
+
+// escape characters which break markdown tables
+func escapeMarkdownTableCell(str string) string {
+	return strings.NewReplacer("|", "\\|", "\n", " ").Replace(str)
+}
+
+// style of standalone html reports
+const htmlReportStyle = `body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; max-width: 48em; margin: 2em auto; padding: 0 1em; color: #222; }
+h1 { font-size: 1.5em; }
+h2 { font-size: 1.25em; border-bottom: 1px solid #ddd; padding-bottom: .3em; margin-top: 2em; }
+h3 { font-size: 1em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ddd; padding: .3em .8em; text-align: left; }
+td.count { text-align: right; font-variant-numeric: tabular-nums; }
+th { background: #f5f5f5; }
+blockquote { margin: 0; padding: .5em 1em; border-left: 4px solid #ddd; color: #444; white-space: pre-wrap; }
+footer { margin-top: 2em; color: #888; font-size: .9em; }`
+
+// GetReportAsHTML generates report as a standalone html document (with inline css, and without external resources).
+func (d *Database) GetReportAsHTML(offsetDays int, opts reportOptions) (result []byte, err error) {
+	var report Report
+	if report, err = d.GenerateReport(offsetDays, opts); err == nil {
+		windows := []string{}
+		if report.Empty {
+			windows = append(windows, fmt.Sprintf("<p>%s</p>", html.EscapeString(emptyReportMessage)))
+		}
+		for _, sub := range report.Windows {
+			if report.Empty {
+				break
+			}
+
+			sections := opts.buildSections(report, sub,
+				func(sub SubReport) string {
+					return fmt.Sprintf("<p><strong>Total</strong>: %d ban action(s) (IPv4: %d, IPv6: %d, active: %d)</p>", sub.TotalCount, sub.TotalV4, sub.TotalV6, sub.ActiveCount)
+				},
+				func(_ reportSection, title string, kvs KeyValues) string {
+					rows := []string{}
+					for _, kv := range kvs {
+						rows = append(rows, fmt.Sprintf(`<tr><td>%s</td><td class="count">%d</td></tr>`, html.EscapeString(kv.Key), kv.Value))
+					}
+
+					return fmt.Sprintf(`<h3>%[1]s</h3>
+<table>
+<tr><th>Name</th><th>Count</th></tr>
+%[2]s
+</table>`, html.EscapeString(title), strings.Join(rows, "\n"))
+				},
+			)
+
+			windows = append(windows, fmt.Sprintf(`<section>
+<h2>%[1]s</h2>
+
+%[2]s
+</section>`, html.EscapeString(sub.period()+sub.filterNote()), strings.Join(sections, "\n\n")))
+		}
+
+		return []byte(fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>balog report (%[1]s)</title>
+<style>
+%[2]s
+</style>
+</head>
+<body>
+<main>
+<h1>Report (generated on %[1]s)</h1>
+
+%[3]s
+</main>
+<footer>report generated by <a href="%[4]s">balog</a></footer>
+</body>
+</html>
+`,
+			html.EscapeString(report.GeneratedDatetime),
+			htmlReportStyle,
+			strings.Join(windows, "\n\n"),
+			projectURL,
+		)), nil
+	}
+
+	return nil, err
+}
+
+// GetReportAsHTMLRange generates report of logs created in [since, until) as a standalone html document.
+func (d *Database) GetReportAsHTMLRange(since, until time.Time, opts reportOptions) (result []byte, err error) {
+	opts.Since, opts.Until = &since, &until
+	return d.GetReportAsHTML(0, opts)
+}
+
+// GetFinalReportAsHTML generates final report as a standalone html document, with insights at the end of its main content.
+//
+// `model` is the name of the model which generated the insight.
+func (d *Database) GetFinalReportAsHTML(report, insight []byte, model string) (result []byte) {
+	if insight != nil {
+		section := fmt.Sprintf(`
+<section>
+<h2>Insights</h2>
+
+<blockquote>%[1]s</blockquote>
+
+<p><em>insights generated by %[2]s</em></p>
+</section>
+</main>`, html.EscapeString(strings.TrimSpace(string(insight))), html.EscapeString(model))
+
+		// NOTE: `</main>` appears only once, as all other texts are escaped
+		result = []byte(strings.Replace(string(report), "</main>", section, 1))
+	} else {
+		result = report
+	}
+
+	return result
+}
+
+// GetReportAsTelegraph generates html report for posting to telegra.ph.
+func (d *Database) GetReportAsTelegraph(telegraphAccessToken *string, offsetDays int, opts reportOptions) (result []byte, err error) {
+	var report Report
+	if report, err = d.GenerateReport(offsetDays, opts); err == nil {
+		// generate report html
+		section := func(sub SubReport) string {
+			sections := opts.buildSections(report, sub,
+				func(sub SubReport) string {
+					return fmt.Sprintf("<strong>Total</strong> %d ban action(s) (IPv4: %d, IPv6: %d, active: %d)", sub.TotalCount, sub.TotalV4, sub.TotalV6, sub.ActiveCount)
+				},
+				func(_ reportSection, title string, kvs KeyValues) string {
+					// NOTE: keys can have markup characters (eg. "AT&T Services, Inc.", tag values, host names)
+					lines := []string{}
+					for _, kv := range kvs {
+						lines = append(lines, fmt.Sprintf("• %s: %d", html.EscapeString(kv.Key), kv.Value))
+					}
+
+					return fmt.Sprintf("<strong>%s</strong>\n%s", html.EscapeString(title), strings.Join(lines, "\n"))
+				},
+			)
+
+			return fmt.Sprintf(`<p>
+<h4>%[1]s</h4>
+
+%[2]s
+</p>`, html.EscapeString(sub.period()+sub.filterNote()), strings.Join(sections, "\n\n"))
+		}
+
+		// filter windows with `telegraph_windows`
+		sections := []string{}
+		if report.Empty {
+			sections = append(sections, fmt.Sprintf("<p>%s</p>", html.EscapeString(emptyReportMessage)))
+		}
+		for _, sub := range report.Windows {
+			if report.Empty {
+				break
+			}
+			if sub.Since == nil && len(opts.TelegraphWindows) > 0 && !slices.Contains(opts.TelegraphWindows, sub.NumDays) {
+				continue
+			}
+			sections = append(sections, section(sub))
+		}
+
+		page := fmt.Sprintf(
+			`<h3>Report (generated on %[1]s)</h3>
+
+%[2]s
+
+<i>report generated by <a href="%[3]s">balog</a></i>`,
+			html.EscapeString(report.GeneratedDatetime),
+			strings.Join(sections, "\n"),
+			projectURL,
+		)
+
+		logDebug("Telegraph HTML: %s", page)
+
+		return []byte(page), err
+	}
+
+	return nil, err
+}
+
+// GetReportAsTelegraphRange generates html report of logs created in [since, until) for posting to telegra.ph.
+func (d *Database) GetReportAsTelegraphRange(telegraphAccessToken *string, since, until time.Time, opts reportOptions) (result []byte, err error) {
+	opts.Since, opts.Until = &since, &until
+	return d.GetReportAsTelegraph(telegraphAccessToken, 0, opts)
+}
+
+// GetFinalReportAsTelegraph generates final report for telegra.ph.
+//
+// `model` is the name of the model which generated the insight.
+func (d *Database) GetFinalReportAsTelegraph(report, insight []byte, model string) (result []byte) {
+	if insight != nil {
+		result = []byte(fmt.Sprintf(`%[1]s
+
+<p>
+<h4>Insights</h4>
+
+%[2]s
+</p>
+
+<i>insights generated by <strong>%[3]s</strong></i>`, string(report), string(insight), html.EscapeString(model)))
+	} else {
+		result = report
+	}
+
+	return result
+}
+
+// UnknownIP represents an ip whose location is unknown
+type UnknownIP struct {
+	IP        string     `json:"ip"`
+	FirstSeen *time.Time `json:"first_seen,omitempty"` // nil if there is no ban action of the ip
+	BanCount  int        `json:"ban_count"`
+}
+
+// ListUnknownIPs returns list of ips where their locations are unknown, with their first seen times and numbers of bans.
+//
+// Least recently attempted ones come first, and masked ips of anonymized logs are excluded.
+func (d *Database) ListUnknownIPs() (result []UnknownIP, err error) {
+	result, _, err = d.ListUnknownIPsPaged(0, 0)
+
+	return result, err
+}
+
+// ListUnknownIPsPaged returns a page of `ListUnknownIPs` with at most `limit` ips (0 for no limit) after skipping `offset` ips,
+// and the total number of unknown ips.
+func (d *Database) ListUnknownIPsPaged(limit, offset int) (result []UnknownIP, total int64, err error) {
+	if res := d.db.Model(&Location{}).
+		Where("country_name = ? AND ip NOT IN (?)", unknownLocation, d.anonymizedIPs()).
+		Distinct("ip").
+		Count(&total); res.Error != nil {
+		return nil, 0, res.Error
+	}
+
+	if limit <= 0 {
+		limit = -1 // no limit
+	}
+
+	var rows []struct {
+		IP        string
+		FirstSeen *string
+		BanCount  int
+	}
+	if res := d.db.Model(&Location{}).
+		Select("locations.ip AS ip, MIN(ban_action_logs.created_at) AS first_seen, COUNT(ban_action_logs.id) AS ban_count").
+		Joins("LEFT JOIN ban_action_logs ON ban_action_logs.ip = locations.ip AND ban_action_logs.event_type = ? AND ban_action_logs.deleted_at IS NULL", eventTypeBan).
+		Where("locations.country_name = ? AND locations.ip NOT IN (?)", unknownLocation, d.anonymizedIPs()).
+		Group("locations.ip").
+		Order("MIN(locations.updated_at) ASC").
+		Limit(limit).
+		Offset(offset).
+		Scan(&rows); res.Error != nil {
+		return nil, 0, res.Error
+	}
+
+	result = []UnknownIP{}
+	for _, row := range rows {
+		unknown := UnknownIP{
+			IP:       row.IP,
+			BanCount: row.BanCount,
+		}
+		if row.FirstSeen != nil {
+			if firstSeen, err := parseSQLiteTimestamp(*row.FirstSeen); err == nil {
+				unknown.FirstSeen = &firstSeen
+			}
+		}
+		result = append(result, unknown)
+	}
+
+	return result, total, nil
+}
+
+// list locations which are unknown, least recently attempted ones first
+func (d *Database) unknownLocations() (result []Location, err error) {
+	res := d.db.Model(&Location{}).
+		Where("country_name = ? AND ip NOT IN (?)", unknownLocation, d.anonymizedIPs()).
+		Order("updated_at ASC").
+		Find(&result)
+
+	return result, res.Error
+}
+
+// subquery of ips which are referenced only by anonymized logs (masked network addresses, not to be geolocated)
+func (d *Database) anonymizedIPs() *gorm.DB {
+	return d.db.Unscoped().Model(&BanActionLog{}).Select("ip").Group("ip").Having("MIN(anonymized) = ?", true)
+}
+
+// parse a timestamp string returned from aggregate functions of sqlite (eg. `MIN(created_at)`)
+func parseSQLiteTimestamp(str string) (result time.Time, err error) {
+	for _, layout := range []string{
+		"2006-01-02 15:04:05.999999999-07:00",
+		"2006-01-02T15:04:05.999999999-07:00",
+		"2006-01-02 15:04:05.999999999",
+		"2006-01-02T15:04:05.999999999",
+	} {
+		if result, err = time.Parse(layout, str); err == nil {
+			return result, nil
+		}
+	}
+
+	return result, fmt.Errorf("unsupported timestamp format: '%s'", str)
+}
+
+// resolveBackoff represents the backoff for retrying failed lookups of unknown ips
+type resolveBackoff struct {
+	RetryAfter  time.Duration // failed ips won't be retried within this duration
+	MaxFailures int           // failed ips won't be retried after this number of failures (0 for no limit)
+}
+
+// check if given location should be skipped at the moment
+func (b resolveBackoff) skips(loc Location, now time.Time) bool {
+	if loc.LookupFailures <= 0 {
+		return false
+	}
+	if b.MaxFailures > 0 && loc.LookupFailures >= b.MaxFailures {
+		return true
+	}
+	return loc.ResolvedAt != nil && now.Sub(*loc.ResolvedAt) < b.RetryAfter
+}
+
+// ResolveUnknownIPs lists unknown ips, tries resolving them, and then returns them with the number of ips skipped due to backoff.
+//
+// Each resolution is saved immediately, so an interrupted run can be continued by the next one.
+// If `maxIPs` is greater than 0, at most `maxIPs` ips will be tried.
+// Lookups are limited to `rps` requests per second (no limit if not positive).
+// When `ctx` is canceled, the current ip is finished and the ips tried so far are returned with the context's error.
+func (d *Database) ResolveUnknownIPs(ctx context.Context, geolocator Geolocator, maxIPs int, backoff resolveBackoff, rps float64) (result []Location, skipped int, err error) {
+	result = []Location{}
+
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	if rps > 0 {
+		limiter = rate.NewLimiter(rate.Limit(rps), 1)
+	}
+
+	locations, err := d.unknownLocations()
+	if err == nil {
+		now := time.Now()
+
+		// number of ips to be tried (for logging progress)
+		total := 0
+		for _, loc := range locations {
+			if !backoff.skips(loc, now) {
+				total++
+			}
+		}
+		if maxIPs > 0 && total > maxIPs {
+			total = maxIPs
+		}
+
+		for _, loc := range locations {
+			if backoff.skips(loc, now) {
+				skipped++
+				continue
+			}
+			if maxIPs > 0 && len(result) >= maxIPs {
+				break
+			}
+
+			// reserved ips are marked without fetching, so that they won't be tried again
+			if isReservedIP(loc.IP) {
+				if err := d.UpdateLocation(loc.IP, GeoLocation{CountryName: reservedLocation}); err == nil {
+					loc.CountryName = reservedLocation
+				}
+				result = append(result, loc)
+				continue
+			}
+
+			if len(result) > 0 && len(result)%resolveProgressInterval == 0 {
+				logInfo("Resolving unknown IPs: %d/%d", len(result), total)
+			}
+
+			if err = limiter.Wait(ctx); err != nil {
+				return result, skipped, ctx.Err()
+			}
+			location, err := FetchLocation(geolocator, loc.IP) // NOTE: not canceled with `ctx`, so that the current ip is finished
+			// NOTE: no error, but location can still be empty (eg. unallocated ips)
+			if err == nil && location.CountryName != "" && location.CountryName != unknownLocation {
+				if err = d.UpdateLocation(loc.IP, location); err == nil {
+					loc.CountryName = location.CountryName
+					loc.City = location.City
+					loc.Region = location.Region
+					loc.ASN = location.ASN
+					loc.Organization = location.Organization
+				}
+				d.recordLookup(loc.IP, now, 0)
 			} else {
-				result = report
+				// mark as attempted, so that it will be tried after others (or backed off) in the next run
+				d.recordLookup(loc.IP, now, loc.LookupFailures+1)
 			}
+
+			result = append(result, loc)
 		}
-	} else {
-		result = report
 	}
 
-	return result
+	return result, skipped, err
 }
 
-// GetReportAsTelegraph generates html report for posting to telegra.ph.
-func (d *Database) GetReportAsTelegraph(telegraphAccessToken *string, offsetDays, numDaysForReport1, numDaysForReport2 int) (result []byte, err error) {
-	var report Report
-	if report, err = d.generateReport(offsetDays, numDaysForReport1, numDaysForReport2); err == nil {
-		// generate report html
-		sort.Slice(report.LastDaysReport1.ProtocolCounts, func(i, j int) bool {
-			return report.LastDaysReport1.ProtocolCounts[i].Value > report.LastDaysReport1.ProtocolCounts[j].Value
-		})
-		protocolsForReport1 := []string{}
-		for _, kv := range sortKeyValues(report.LastDaysReport1.ProtocolCounts) {
-			protocolsForReport1 = append(protocolsForReport1, fmt.Sprintf("• %s: %d", kv.Key, kv.Value))
+// ResolveIP fetches the location of given ip, then updates (or creates) its cached location and the locations of its ban action logs.
+//
+// If the location couldn't be resolved, nothing will be updated (but a missing cached location will be created as unknown).
+func (d *Database) ResolveIP(geolocator Geolocator, ip string) (result Location, err error) {
+	if ip, err = normalizeIP(ip); err != nil {
+		return result, err
+	}
+
+	location, fetchErr := FetchLocation(geolocator, ip)
+	resolved := fetchErr == nil && location.CountryName != "" && location.CountryName != unknownLocation
+
+	err = d.Transaction(func(tx *Database) (err error) {
+		if result, err = tx.LookupLocation(ip); err != nil {
+			return err
 		}
-		countriesForReport1 := []string{}
-		for _, kv := range sortKeyValues(report.LastDaysReport1.CountryCounts) {
-			countriesForReport1 = append(countriesForReport1, fmt.Sprintf("• %s: %d", kv.Key, kv.Value))
+
+		if !resolved {
+			if result.ID == 0 {
+				_, err = tx.SaveLocation(ip, GeoLocation{CountryName: unknownLocation})
+			}
+			return err
 		}
-		protocolsForReport2 := []string{}
-		for _, kv := range sortKeyValues(report.LastDaysReport2.ProtocolCounts) {
-			protocolsForReport2 = append(protocolsForReport2, fmt.Sprintf("• %s: %d", kv.Key, kv.Value))
+
+		// cached location
+		if result.ID == 0 {
+			_, err = tx.SaveLocation(ip, location)
+		} else {
+			err = tx.UpdateLocation(ip, location)
 		}
-		countriesForReport2 := []string{}
-		for _, kv := range sortKeyValues(report.LastDaysReport2.CountryCounts) {
-			countriesForReport2 = append(countriesForReport2, fmt.Sprintf("• %s: %d", kv.Key, kv.Value))
+		if err != nil {
+			return err
 		}
+		tx.recordLookup(ip, time.Now(), 0)
 
-		html := fmt.Sprintf(
-			`<h3>Report (generated on %[1]s)</h3>
+		// ban action logs of the ip
+		if res := tx.db.Model(&BanActionLog{}).Where("ip = ?", ip).Update("location", location.CountryName); res.Error != nil {
+			return res.Error
+		}
 
-<p>
-<h4>Last %[2]d days</h4>
+		result, err = tx.LookupLocation(ip)
+		return err
+	})
+	if err == nil && !resolved {
+		if fetchErr != nil {
+			err = fmt.Errorf("failed to resolve location of '%s': %s", ip, fetchErr)
+		} else {
+			err = fmt.Errorf("location of '%s' could not be resolved", ip)
+		}
+	}
 
-<strong>Total</strong> %[3]d ban action(s)
+	return result, err
+}
 
-<strong>Protocols</strong>
-%[4]s
+// SyncBanActionLocations refreshes null/unknown locations of ban action logs with their cached (and known) locations
+func (d *Database) SyncBanActionLocations() (updated int64, err error) {
+	const known = "locations.ip = ban_action_logs.ip AND locations.deleted_at IS NULL AND locations.country_name NOT IN ('', ?)"
 
-<strong>Originating Countries</strong>
-%[5]s
-</p>
-<p>
-<h4>Last %[6]d days</h4>
+	res := d.db.Model(&BanActionLog{}).
+		Where("ban_action_logs.location IS NULL OR ban_action_logs.location IN ('', ?)", unknownLocation).
+		Where("EXISTS (SELECT 1 FROM locations WHERE "+known+")", unknownLocation).
+		Update("location", gorm.Expr("(SELECT locations.country_name FROM locations WHERE "+known+" LIMIT 1)", unknownLocation))
 
-<strong>Total</strong> %[7]d ban action(s)
+	return res.RowsAffected, res.Error
+}
 
-<strong>Protocols</strong>
-%[8]s
+// DuplicateLocation represents cached locations of ips which differ only by normalization (eg. "::ffff:1.2.3.4" and "1.2.3.4")
+type DuplicateLocation struct {
+	IP          string   `json:"ip"`           // normalized ip
+	IPs         []string `json:"ips"`          // ips of the duplicate locations
+	Kept        string   `json:"kept"`         // ip of the kept location (most recently resolved one)
+	CountryName string   `json:"country_name"` // country of the kept location
+}
 
-<strong>Originating Countries</strong>
-%[9]s
-</p>
+// DedupeLocations merges cached locations of ips which differ only by normalization,
+// keeping the most recently resolved one, and repoints the ban action logs to the normalized ip.
+//
+// If `dryRun` is true, nothing will be changed. `collapsed` is the number of (to be) removed locations.
+func (d *Database) DedupeLocations(dryRun bool) (result []DuplicateLocation, collapsed int, err error) {
+	var locations []Location
+	if res := d.db.Order("id").Find(&locations); res.Error != nil {
+		return nil, 0, res.Error
+	}
 
-<i>report generated by <a href="%[10]s">balog</a></i>`,
-			report.GeneratedDatetime,
-			numDaysForReport1, report.LastDaysReport1.TotalCount, strings.Join(protocolsForReport1, "\n"), strings.Join(countriesForReport1, "\n"),
-			numDaysForReport2, report.LastDaysReport2.TotalCount, strings.Join(protocolsForReport2, "\n"), strings.Join(countriesForReport2, "\n"),
-			projectURL,
-		)
+	// group locations by their normalized ips
+	groups := map[string][]Location{}
+	normalized := []string{}
+	for _, loc := range locations {
+		ip, err := normalizeIP(loc.IP)
+		if err != nil {
+			logWarn("Skipping location with an invalid ip: %s", err)
+			continue
+		}
+		if _, exists := groups[ip]; !exists {
+			normalized = append(normalized, ip)
+		}
+		groups[ip] = append(groups[ip], loc)
+	}
+
+	// most recently resolved one (known countries first)
+	resolvedAt := func(loc Location) time.Time {
+		if loc.ResolvedAt != nil {
+			return *loc.ResolvedAt
+		}
+		return loc.UpdatedAt
+	}
+	known := func(loc Location) bool {
+		return loc.CountryName != "" && loc.CountryName != unknownLocation
+	}
+
+	result = []DuplicateLocation{}
+	for _, ip := range normalized {
+		group := groups[ip]
+		if len(group) <= 1 && group[0].IP == ip {
+			continue
+		}
+
+		kept := group[0]
+		ips := []string{}
+		for _, loc := range group {
+			ips = append(ips, loc.IP)
+			if known(loc) && !known(kept) || known(loc) == known(kept) && resolvedAt(loc).After(resolvedAt(kept)) {
+				kept = loc
+			}
+		}
+		result = append(result, DuplicateLocation{
+			IP:          ip,
+			IPs:         ips,
+			Kept:        kept.IP,
+			CountryName: kept.CountryName,
+		})
+		collapsed += len(group) - 1
+
+		if dryRun {
+			continue
+		}
+
+		if err = d.db.Transaction(func(tx *gorm.DB) error {
+			// (hard) delete others first, as ips are unique
+			for _, loc := range group {
+				if loc.ID == kept.ID {
+					continue
+				}
+				if res := tx.Unscoped().Delete(&Location{}, loc.ID); res.Error != nil {
+					return res.Error
+				}
+			}
+			if res := tx.Model(&Location{}).Where("id = ?", kept.ID).Update("ip", ip); res.Error != nil {
+				return res.Error
+			}
+			if res := tx.Model(&BanActionLog{}).Where("ip IN ?", ips).Update("ip", ip); res.Error != nil {
+				return res.Error
+			}
+			return nil
+		}); err != nil {
+			return result, collapsed, fmt.Errorf("failed to merge locations of '%s': %s", ip, err)
+		}
+	}
 
-		// debug log
-		//l("Telegraph HTML: %s\n", html)
+	return result, collapsed, nil
+}
 
-		return []byte(html), err
+// record a lookup attempt of a location without changing its value
+func (d *Database) recordLookup(ip string, at time.Time, failures int) {
+	if res := d.db.Model(&Location{}).Where("ip = ?", ip).Updates(map[string]any{
+		"updated_at":      at,
+		"resolved_at":     at,
+		"lookup_failures": failures,
+	}); res.Error != nil {
+		logWarn("Failed to record lookup of location for '%s': %s", ip, res.Error)
 	}
+}
 
-	return nil, err
+// LocationStats represents statistics of the cached locations
+type LocationStats struct {
+	TotalCount     int64      `json:"total_count"`
+	ResolvedCount  int64      `json:"resolved_count"` // excluding reserved ones
+	UnknownCount   int64      `json:"unknown_count"`
+	ReservedCount  int64      `json:"reserved_count"` // reserved ips (eg. private ones), which are not looked up
+	OldestResolved *time.Time `json:"oldest_resolved,omitempty"`
+	NewestResolved *time.Time `json:"newest_resolved,omitempty"`
+	CountryCounts  KeyValues  `json:"country_counts"`
 }
 
-// GetFinalReportAsTelegraph generates final report for telegra.ph.
-func (d *Database) GetFinalReportAsTelegraph(report, insight []byte) (result []byte) {
-	if insight != nil {
-		result = []byte(fmt.Sprintf(`%[1]s
+// GetLocationStats returns statistics of the cached locations.
+func (d *Database) GetLocationStats() (result LocationStats, err error) {
+	result.CountryCounts = KeyValues{}
 
-<p>
-<h4>Insights</h4>
+	if res := d.db.Model(&Location{}).Count(&result.TotalCount); res.Error != nil {
+		return result, res.Error
+	}
+	if res := d.db.Model(&Location{}).Where("country_name = ?", unknownLocation).Count(&result.UnknownCount); res.Error != nil {
+		return result, res.Error
+	}
+	if res := d.db.Model(&Location{}).Where("country_name = ?", reservedLocation).Count(&result.ReservedCount); res.Error != nil {
+		return result, res.Error
+	}
+	result.ResolvedCount = result.TotalCount - result.UnknownCount - result.ReservedCount
+
+	// oldest/newest resolution timestamps
+	//
+	// NOTE: `updated_at` is also bumped by failed lookups and other updates, so `resolved_at` is used
+	// (or `created_at` for ones resolved when they were saved)
+	if result.ResolvedCount > 0 {
+		resolvedAt := func(loc Location) *time.Time {
+			if loc.ResolvedAt != nil {
+				return loc.ResolvedAt
+			}
+			return &loc.CreatedAt
+		}
+		resolved := func() *gorm.DB {
+			return d.db.Where("country_name NOT IN ?", []string{unknownLocation, reservedLocation})
+		}
 
-%[2]s
-</p>
+		var oldest, newest Location
+		if res := resolved().Order("COALESCE(resolved_at, created_at) ASC").Limit(1).Find(&oldest); res.Error != nil {
+			return result, res.Error
+		}
+		if res := resolved().Order("COALESCE(resolved_at, created_at) DESC").Limit(1).Find(&newest); res.Error != nil {
+			return result, res.Error
+		}
+		result.OldestResolved = resolvedAt(oldest)
+		result.NewestResolved = resolvedAt(newest)
+	}
 
-<i>insights generated by <strong>%[3]s</strong></i>`, string(report), string(insight), googleAIModel))
-	} else {
-		result = report
+	// distribution by country
+	var rows []struct {
+		CountryName string
+		Count       int
+	}
+	if res := d.db.Model(&Location{}).Select("country_name, count(*) as count").Group("country_name").Scan(&rows); res.Error != nil {
+		return result, res.Error
+	}
+	for _, row := range rows {
+		result.CountryCounts.Set(row.CountryName, row.Count)
 	}
+	result.CountryCounts = sortKeyValues(result.CountryCounts, sortByCount)
 
-	return result
+	return result, nil
+}
+
+// Stats represents all-time statistics of ban actions
+type Stats struct {
+	TotalCount        int64      `json:"total_count"`
+	DistinctIPs       int64      `json:"distinct_ips"`
+	DistinctCountries int64      `json:"distinct_countries"`
+	FirstBanAt        *time.Time `json:"first_ban_at,omitempty"`
+	LastBanAt         *time.Time `json:"last_ban_at,omitempty"`
+	TopIP             *string    `json:"top_ip,omitempty"`
+	TopIPCount        int64      `json:"top_ip_count"`
 }
 
-// ListUnknownIPs returns list of ips where their locations are unknown.
-func (d *Database) ListUnknownIPs() (result []Location, err error) {
-	res := d.db.Model(&Location{}).Where("country_name = ?", unknownLocation).Find(&result)
+// GetStats returns all-time statistics of ban actions (unban events are not counted).
+//
+// Values are aggregated in the database, not by loading all logs.
+func (d *Database) GetStats() (result Stats, err error) {
+	bans := func() *gorm.DB {
+		return d.db.Model(&BanActionLog{}).Where("event_type = ?", eventTypeBan)
+	}
 
-	return result, res.Error
+	if res := bans().Count(&result.TotalCount); res.Error != nil {
+		return result, res.Error
+	}
+	if result.TotalCount <= 0 {
+		return result, nil
+	}
+	if res := bans().Distinct("ip").Count(&result.DistinctIPs); res.Error != nil {
+		return result, res.Error
+	}
+	if res := bans().Where("location IS NOT NULL AND location <> ?", unknownLocation).Distinct("location").Count(&result.DistinctCountries); res.Error != nil {
+		return result, res.Error
+	}
+
+	// first/last ban timestamps
+	var first, last BanActionLog
+	if res := bans().Order("created_at ASC").Limit(1).Find(&first); res.Error != nil {
+		return result, res.Error
+	}
+	if res := bans().Order("created_at DESC").Limit(1).Find(&last); res.Error != nil {
+		return result, res.Error
+	}
+	result.FirstBanAt = &first.CreatedAt
+	result.LastBanAt = &last.CreatedAt
+
+	// the most-banned ip
+	var top struct {
+		IP    string
+		Count int64
+	}
+	if res := bans().Select("ip, COUNT(*) AS count").Group("ip").Order("count DESC").Limit(1).Scan(&top); res.Error != nil {
+		return result, res.Error
+	}
+	result.TopIP = &top.IP
+	result.TopIPCount = top.Count
+
+	return result, nil
 }
 
-// ResolveUnknownIPs lists unknown ips, tries resolving them, and then returns them.
-func (d *Database) ResolveUnknownIPs(geolocAPIKey *string) (result []Location, err error) {
-	result = []Location{}
+// Gap represents a period without any ban action log
+type Gap struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration string    `json:"duration"`
+}
 
-	locations, err := d.ListUnknownIPs()
-	if err == nil {
-		for _, loc := range locations {
-			location, err := FetchLocation(geolocAPIKey, loc.IP)
-			// FIXME: no error, but location is empty (eg. reserved ips like "127.0.0.1")
-			if err == nil && location != "" {
-				if err = d.UpdateLocation(loc.IP, location); err == nil {
-					loc.CountryName = location
-				}
+// DetectGaps scans ban action logs in order, and returns periods longer than `threshold` without any log.
+//
+// Only ban events are counted as logging (unban events don't close gaps).
+// Hours in `quietHours` (0-23) are not counted when measuring the length of a period.
+func (d *Database) DetectGaps(threshold time.Duration, quietHours []int) (result []Gap, err error) {
+	result = []Gap{}
+
+	rows, err := d.db.Model(&BanActionLog{}).Select("created_at").Where("event_type = ?", eventTypeBan).Order("created_at ASC").Rows()
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	check := func(start, end time.Time) {
+		if activeDuration(start, end, quietHours) > threshold {
+			result = append(result, Gap{
+				Start:    start,
+				End:      end,
+				Duration: end.Sub(start).Round(time.Minute).String(),
+			})
+		}
+	}
+
+	var prev *time.Time
+	for rows.Next() {
+		var createdAt time.Time
+		if err = rows.Scan(&createdAt); err != nil {
+			return result, err
+		}
+		if prev != nil {
+			check(*prev, createdAt)
+		}
+		prev = &createdAt
+	}
+
+	// from the last log until now
+	if prev != nil {
+		check(*prev, time.Now())
+	}
+
+	return result, rows.Err()
+}
+
+// length of the period between `start` and `end`, excluding `quietHours`
+func activeDuration(start, end time.Time, quietHours []int) (duration time.Duration) {
+	if len(quietHours) <= 0 {
+		return end.Sub(start)
+	}
+
+	for t := start; t.Before(end); {
+		next := t.Truncate(time.Hour).Add(time.Hour)
+		if next.After(end) {
+			next = end
+		}
+		if !slices.Contains(quietHours, t.Hour()) {
+			duration += next.Sub(t)
+		}
+		t = next
+	}
+
+	return duration
+}
+
+// QueryByCIDR returns ban action logs with ips in given prefix (CIDR).
+//
+// Unban events are not included.
+func (d *Database) QueryByCIDR(prefix netip.Prefix) (result []BanActionLog, err error) {
+	result = []BanActionLog{}
+	prefix = prefix.Masked()
+
+	// narrow down ipv4 addresses with their fixed octets (as sqlite can't do cidr matching)
+	query := d.db.Model(&BanActionLog{}).Where("event_type = ?", eventTypeBan).Order("created_at ASC")
+	if prefix.Addr().Is4() {
+		if numOctets := prefix.Bits() / 8; numOctets > 0 {
+			octets := prefix.Addr().As4()
+			fixed := []string{}
+			for _, octet := range octets[:numOctets] {
+				fixed = append(fixed, fmt.Sprintf("%d", octet))
+			}
+			pattern := strings.Join(fixed, ".")
+			if numOctets < 4 {
+				pattern += "."
 			}
+			query = query.Where("ip LIKE ?", pattern+"%")
+		}
+	}
 
-			result = append(result, loc)
+	var logs []BanActionLog
+	if res := query.Find(&logs); res.Error != nil {
+		return result, res.Error
+	}
+
+	// then filter with the prefix
+	for _, log := range logs {
+		if addr, err := netip.ParseAddr(log.IP); err == nil && prefix.Contains(addr.Unmap()) {
+			result = append(result, log)
 		}
 	}
 
-	return result, err
+	return result, nil
+}
+
+// LocationAudit represents a result of auditing logs and cached locations
+type LocationAudit struct {
+	OrphanLogsCount      int64    `json:"orphan_logs_count"`      // number of logs without cached locations
+	OrphanLogIPs         []string `json:"orphan_log_ips"`         // sample ips of them
+	OrphanLocationsCount int64    `json:"orphan_locations_count"` // number of cached locations without logs
+	OrphanLocationIPs    []string `json:"orphan_location_ips"`    // sample ips of them
+}
+
+// AuditLocations finds logs without cached locations, and cached locations without logs.
+//
+// Anonymized logs are not counted, as their masked ips are not geolocated.
+// It doesn't modify anything.
+func (d *Database) AuditLocations(numSamples int) (result LocationAudit, err error) {
+	result = LocationAudit{
+		OrphanLogIPs:      []string{},
+		OrphanLocationIPs: []string{},
+	}
+
+	// logs without cached locations
+	orphanLogs := d.db.Model(&BanActionLog{}).Where("anonymized = ? AND ip NOT IN (?)", false, d.db.Model(&Location{}).Select("ip"))
+	if res := orphanLogs.Session(&gorm.Session{}).Count(&result.OrphanLogsCount); res.Error != nil {
+		return result, res.Error
+	}
+	if res := orphanLogs.Session(&gorm.Session{}).Distinct("ip").Limit(numSamples).Pluck("ip", &result.OrphanLogIPs); res.Error != nil {
+		return result, res.Error
+	}
+
+	// cached locations without logs
+	orphanLocations := d.db.Model(&Location{}).Where("ip NOT IN (?)", d.db.Model(&BanActionLog{}).Select("ip"))
+	if res := orphanLocations.Session(&gorm.Session{}).Count(&result.OrphanLocationsCount); res.Error != nil {
+		return result, res.Error
+	}
+	if res := orphanLocations.Session(&gorm.Session{}).Limit(numSamples).Pluck("ip", &result.OrphanLocationIPs); res.Error != nil {
+		return result, res.Error
+	}
+
+	return result, nil
 }
 
 // PurgeLogs deletes all logs.
 func (d *Database) PurgeLogs() (result int64, err error) {
-	res := d.db.Delete(&BanActionLog{})
+	res := d.db.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&BanActionLog{})
+
+	return res.RowsAffected, res.Error
+}
+
+// PurgeLogsOlderThan deletes logs created before given days
+func (d *Database) PurgeLogsOlderThan(days int) (result int64, err error) {
+	res := d.db.Unscoped().Where("created_at < ?", time.Now().AddDate(0, 0, -days)).Delete(&BanActionLog{})
+
+	return res.RowsAffected, res.Error
+}
+
+// stored ips (in the table of `model`) whose normalized forms equal to the one of given ip
+//
+// (eg. "::ffff:1.2.3.4" for "1.2.3.4", or "2001:DB8:0::1" for "2001:db8::1")
+func (d *Database) storedIPVariants(model any, ip string) (variants []string, err error) {
+	if ip, err = normalizeIP(ip); err != nil {
+		return nil, err
+	}
+
+	var ips []string
+	if res := d.db.Unscoped().Model(model).Distinct("ip").Pluck("ip", &ips); res.Error != nil {
+		return nil, res.Error
+	}
+
+	variants = []string{}
+	for _, stored := range ips {
+		if normalized, err := normalizeIP(stored); err == nil && normalized == ip {
+			variants = append(variants, stored)
+		}
+	}
+
+	return variants, nil
+}
+
+// DeleteByIP deletes all logs of given ip (including soft-deleted ones), and returns the number of deleted logs.
+//
+// Logs with any form of the ip (eg. "::ffff:1.2.3.4" for "1.2.3.4") are deleted.
+func (d *Database) DeleteByIP(ip string) (result int64, err error) {
+	var variants []string
+	if variants, err = d.storedIPVariants(&BanActionLog{}, ip); err != nil || len(variants) <= 0 {
+		return 0, err
+	}
+
+	res := d.db.Unscoped().Where("ip IN ?", variants).Delete(&BanActionLog{})
+
+	return res.RowsAffected, res.Error
+}
+
+// DeleteLocationByIP deletes the cached location of given ip, and returns the number of deleted locations.
+//
+// Locations with any form of the ip (eg. "::ffff:1.2.3.4" for "1.2.3.4") are deleted.
+func (d *Database) DeleteLocationByIP(ip string) (result int64, err error) {
+	var variants []string
+	if variants, err = d.storedIPVariants(&Location{}, ip); err != nil || len(variants) <= 0 {
+		return 0, err
+	}
+
+	res := d.db.Unscoped().Where("ip IN ?", variants).Delete(&Location{})
 
 	return res.RowsAffected, res.Error
 }
 
-// FetchLocation fetches location from ipgeolocation.io.
-func FetchLocation(geolocAPIKey *string, ip string) (location string, err error) {
-	if geolocAPIKey != nil {
-		client := ipgeolocation.NewClient(*geolocAPIKey)
-		var result ipgeolocation.ResponseGeolocation
-		if result, err = client.GetGeolocation(ip); err == nil {
-			return result.CountryName, nil
+// PurgeLogsByRetention deletes logs older than the retention days of their protocols.
+//
+// Protocols not in `byProtocol` use `defaultDays` (kept forever if it is not positive).
+// Returns the number of deleted logs per protocol.
+func (d *Database) PurgeLogsByRetention(defaultDays int, byProtocol map[string]int) (result KeyValues, err error) {
+	result = KeyValues{}
+
+	var protocols []string
+	if res := d.db.Model(&BanActionLog{}).Distinct("protocol").Pluck("protocol", &protocols); res.Error != nil {
+		return result, res.Error
+	}
+
+	for _, protocol := range protocols {
+		days, exists := byProtocol[protocol]
+		if !exists {
+			days = defaultDays
+		}
+		if days <= 0 {
+			continue
+		}
+
+		// NOTE: delete permanently (not soft-delete) for reclaiming storage
+		res := d.db.Unscoped().Where("protocol = ? AND created_at < ?", protocol, time.Now().AddDate(0, 0, -days)).Delete(&BanActionLog{})
+		if res.Error != nil {
+			return result, res.Error
+		}
+		result.Set(protocol, int(res.RowsAffected))
+	}
+
+	return result, nil
+}
+
+// AnonymizeLogsOlderThan replaces ips of logs older than given days with their masked forms,
+// marks them as anonymized, and deletes cached locations of ips which are no longer referenced.
+//
+// Locations (countries) of the logs are kept for aggregate reports.
+func (d *Database) AnonymizeLogsOlderThan(days int) (anonymized int64, err error) {
+	cutoff := time.Now().AddDate(0, 0, -days)
+
+	var ips []string
+	if res := d.db.Unscoped().Model(&BanActionLog{}).Where("created_at < ? AND anonymized = ?", cutoff, false).Distinct("ip").Pluck("ip", &ips); res.Error != nil {
+		return 0, res.Error
+	}
+
+	err = d.db.Transaction(func(tx *gorm.DB) error {
+		for _, ip := range ips {
+			masked := maskIP(ip)
+
+			res := tx.Unscoped().Model(&BanActionLog{}).
+				Where("ip = ? AND created_at < ? AND anonymized = ?", ip, cutoff, false).
+				Updates(map[string]any{"ip": masked, "anonymized": true})
+			if res.Error != nil {
+				return res.Error
+			}
+			anonymized += res.RowsAffected
+
+			// delete cached location if no log references it anymore
+			var remaining int64
+			if res := tx.Unscoped().Model(&BanActionLog{}).Where("ip = ?", ip).Count(&remaining); res.Error != nil {
+				return res.Error
+			}
+			if remaining <= 0 {
+				if res := tx.Unscoped().Where("ip = ?", ip).Delete(&Location{}); res.Error != nil {
+					return res.Error
+				}
+			}
 		}
+		return nil
+	})
+
+	return anonymized, err
+}
+
+// TrimLogs deletes the oldest logs so that the number of logs doesn't exceed `maxRows`.
+func (d *Database) TrimLogs(maxRows int64) (trimmed int64, err error) {
+	var count int64
+	if res := d.db.Unscoped().Model(&BanActionLog{}).Count(&count); res.Error != nil {
+		return 0, res.Error
+	}
+	if count <= maxRows {
+		return 0, nil
+	}
+
+	// NOTE: delete permanently (not soft-delete) for bounding storage
+	oldest := d.db.Unscoped().Model(&BanActionLog{}).Select("id").Order("created_at ASC").Limit(int(count - maxRows))
+	res := d.db.Unscoped().Where("id IN (?)", oldest).Delete(&BanActionLog{})
+
+	return res.RowsAffected, res.Error
+}
+
+// FetchLocation fetches location with given geolocator.
+//
+// ips in reserved ranges are returned as `reservedLocation` without lookup.
+func FetchLocation(geolocator Geolocator, ip string) (location GeoLocation, err error) {
+	if isReservedIP(ip) {
+		return GeoLocation{CountryName: reservedLocation}, nil
 	}
 
-	return unknownLocation, err
+	return geolocator.Locate(context.Background(), ip)
 }
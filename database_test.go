@@ -0,0 +1,1535 @@
+// database_test.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// open a new database in a temporary directory for testing
+func openTestDB(t testing.TB) *Database {
+	t.Helper()
+
+	return openTestDBAt(t, filepath.Join(t.TempDir(), "test.db"))
+}
+
+// open a database at given filepath for testing
+func openTestDBAt(t testing.TB, fpath string) *Database {
+	t.Helper()
+
+	db, err := OpenDB(fpath, dbOptions{})
+	if err != nil {
+		t.Fatalf("failed to open test database: %s", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	return db
+}
+
+// save a ban action of given protocol, ip, and location for testing
+func saveTestBan(t testing.TB, db *Database, protocol, ip, location string) uint {
+	t.Helper()
+
+	id, err := db.SaveBanAction(protocol, ip, nil)
+	if err != nil {
+		t.Fatalf("failed to save ban action: %s", err)
+	}
+	if len(location) > 0 {
+		if err := db.UpdateBanActionLocation(id, location); err != nil {
+			t.Fatalf("failed to update location: %s", err)
+		}
+	}
+
+	return id
+}
+
+// count all logs, including soft-deleted ones
+func countAllLogs(t testing.TB, db *Database) (count int64) {
+	t.Helper()
+
+	if res := db.db.Unscoped().Model(&BanActionLog{}).Count(&count); res.Error != nil {
+		t.Fatalf("failed to count logs: %s", res.Error)
+	}
+	return count
+}
+
+func TestPurgeLogs(t *testing.T) {
+	db := openTestDB(t)
+	saveTestBan(t, db, "sshd", "203.0.113.1", "")
+	saveTestBan(t, db, "sshd", "203.0.113.2", "")
+	if _, err := db.SaveBanActionAt("sshd", "203.0.113.3", nil, time.Now().AddDate(0, 0, -10)); err != nil {
+		t.Fatalf("failed to save ban action: %s", err)
+	}
+
+	// older logs only
+	if purged, err := db.PurgeLogsOlderThan(5); err != nil || purged != 1 {
+		t.Errorf("expected 1 purged log, got: %d, %v", purged, err)
+	}
+	if count := countAllLogs(t, db); count != 2 {
+		t.Errorf("expected 2 remaining rows, got: %d", count)
+	}
+
+	// all logs
+	if purged, err := db.PurgeLogs(); err != nil || purged != 2 {
+		t.Errorf("expected 2 purged logs, got: %d, %v", purged, err)
+	}
+	if count := countAllLogs(t, db); count != 0 {
+		t.Errorf("expected no remaining rows, got: %d", count)
+	}
+}
+
+func TestGetReportAsJSONAnonymize(t *testing.T) {
+	db := openTestDB(t)
+	saveTestBan(t, db, "sshd", "203.0.113.77", "China")
+	if _, err := db.SaveLocation("203.0.113.77", GeoLocation{CountryName: "China"}); err != nil {
+		t.Fatalf("failed to save location: %s", err)
+	}
+	if err := db.SetAbuseScore("203.0.113.77", 100); err != nil {
+		t.Fatalf("failed to set abuse score: %s", err)
+	}
+
+	bytes, err := db.GetReportAsJSON(0, reportOptions{Anonymize: true})
+	if err != nil {
+		t.Fatalf("failed to generate report: %s", err)
+	}
+
+	var report Report
+	if err := json.Unmarshal(bytes, &report); err != nil {
+		t.Fatalf("failed to parse report: %s", err)
+	}
+	if len(report.Windows) <= 0 || len(report.Windows[0].HighRiskIPs) <= 0 {
+		t.Fatalf("expected high-risk ips in the report: %s", string(bytes))
+	}
+	if strings.Contains(string(bytes), "203.0.113.77") {
+		t.Errorf("report includes an unmasked ip: %s", string(bytes))
+	}
+	if ip := report.Windows[0].HighRiskIPs[0].IP; ip != "203.0.113.0" {
+		t.Errorf("expected masked high-risk ip '203.0.113.0', got: '%s'", ip)
+	}
+}
+
+func TestSaveAndLookupNormalizedIPs(t *testing.T) {
+	db := openTestDB(t)
+
+	// ban actions are saved with normalized ips
+	for _, ip := range []string{"2001:0DB8:0000::1", "2001:db8::1", "::ffff:192.0.2.1", "192.0.2.1"} {
+		saveTestBan(t, db, "sshd", ip, "")
+	}
+	var ips []string
+	if res := db.db.Model(&BanActionLog{}).Distinct("ip").Order("ip").Pluck("ip", &ips); res.Error != nil {
+		t.Fatalf("failed to load ips: %s", res.Error)
+	}
+	if strings.Join(ips, ",") != "192.0.2.1,2001:db8::1" {
+		t.Errorf("expected normalized ips, got: %v", ips)
+	}
+
+	// locations are saved and looked up with normalized ips
+	if _, err := db.SaveLocation("2001:DB8:0:0::ABCD", GeoLocation{CountryName: "Japan"}); err != nil {
+		t.Fatalf("failed to save location: %s", err)
+	}
+	if _, err := db.SaveLocation("::ffff:198.51.100.1", GeoLocation{CountryName: "Brazil"}); err != nil {
+		t.Fatalf("failed to save location: %s", err)
+	}
+	for ip, expected := range map[string]string{
+		"2001:db8::abcd":      "Japan",
+		"2001:0db8::ABCD":     "Japan",
+		"198.51.100.1":        "Brazil",
+		"::FFFF:198.51.100.1": "Brazil",
+	} {
+		if location, err := db.LookupLocation(ip); err != nil {
+			t.Errorf("failed to lookup location of '%s': %s", ip, err)
+		} else if location.CountryName != expected {
+			t.Errorf("expected location of '%s' to be '%s', got: '%s'", ip, expected, location.CountryName)
+		}
+	}
+}
+
+// save cached locations of given ips as unknown ones for testing
+func saveTestUnknownLocations(t testing.TB, db *Database, ips ...string) {
+	t.Helper()
+
+	for _, ip := range ips {
+		if _, err := db.SaveLocation(ip, GeoLocation{CountryName: unknownLocation}); err != nil {
+			t.Fatalf("failed to save location: %s", err)
+		}
+	}
+}
+
+// geolocator which locates all ips in a country, and runs `onLocate` after each lookup
+type stubGeolocator struct {
+	country  string
+	located  *[]string
+	onLocate func()
+}
+
+func (g stubGeolocator) Locate(_ context.Context, ip string) (GeoLocation, error) {
+	*g.located = append(*g.located, ip)
+	if g.onLocate != nil {
+		g.onLocate()
+	}
+	if len(g.country) <= 0 {
+		return GeoLocation{}, errors.New("lookup failed")
+	}
+	return GeoLocation{CountryName: g.country}, nil
+}
+
+func TestResolveUnknownIPsCanceled(t *testing.T) {
+	db := openTestDB(t)
+	saveTestUnknownLocations(t, db, "203.0.113.1", "203.0.113.2", "203.0.113.3", "203.0.113.4", "203.0.113.5")
+
+	// canceled after the second lookup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	located := []string{}
+	geolocator := stubGeolocator{country: "Japan", located: &located}
+	geolocator.onLocate = func() {
+		if len(located) >= 2 {
+			cancel()
+		}
+	}
+
+	result, _, err := db.ResolveUnknownIPs(ctx, geolocator, 0, resolveBackoff{}, 0)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancellation error, got: %v", err)
+	}
+	if len(located) != 2 {
+		t.Errorf("expected the loop to stop after 2 lookups, got: %d", len(located))
+	}
+
+	// partial results are returned and kept
+	if len(result) != 2 {
+		t.Fatalf("expected 2 partial results, got: %d", len(result))
+	}
+	for _, loc := range result {
+		if saved, err := db.LookupLocation(loc.IP); err != nil || saved.CountryName != "Japan" {
+			t.Errorf("expected resolved location of '%s' to be saved, got: %v, %v", loc.IP, saved.CountryName, err)
+		}
+	}
+	if unknowns, err := db.ListUnknownIPs(); err != nil || len(unknowns) != 3 {
+		t.Errorf("expected 3 remaining unknown ips, got: %d, %v", len(unknowns), err)
+	}
+}
+
+func TestResolveUnknownIPsResume(t *testing.T) {
+	db := openTestDB(t)
+	ips := []string{"203.0.113.1", "203.0.113.2", "203.0.113.3", "203.0.113.4", "203.0.113.5"}
+	saveTestUnknownLocations(t, db, ips...)
+
+	// all lookups fail, so the ips stay unknown
+	located := []string{}
+	geolocator := stubGeolocator{located: &located}
+
+	// each run continues with ips not tried yet, then the least recently tried ones
+	for i, expected := range [][]string{
+		ips[0:2],
+		ips[2:4],
+		ips[4:5],
+	} {
+		located = []string{}
+		result, _, err := db.ResolveUnknownIPs(context.Background(), geolocator, 2, resolveBackoff{}, 0)
+		if err != nil {
+			t.Fatalf("failed to resolve unknown ips: %s", err)
+		}
+		if len(result) != 2 || len(located) != 2 {
+			t.Fatalf("expected 2 tried ips in run #%d, got: %d (%v)", i+1, len(result), located)
+		}
+		for j, ip := range expected {
+			if located[j] != ip {
+				t.Errorf("expected '%s' to be tried in run #%d, got: %v", ip, i+1, located)
+			}
+		}
+		time.Sleep(10 * time.Millisecond) // for distinguishable times of lookups
+	}
+
+	// the last run continued with one of the ips tried in the first run
+	if located[1] != ips[0] && located[1] != ips[1] {
+		t.Errorf("expected an ip from the first run to be retried, got: %s", located[1])
+	}
+}
+
+// number of logs seeded for benchmarking report generation
+const benchmarkNumLogs = 1_000_000
+
+// seed given number of ban actions (of various protocols, countries, and ips) in the last 7 days
+func seedBenchmarkLogs(b *testing.B, db *Database, numLogs int) {
+	b.Helper()
+
+	protocols := []string{"sshd", "nginx", "postfix", "dovecot"}
+	countries := []string{"China", "United States", "Russia", "Brazil", "India", "Germany", unknownLocation}
+	now := time.Now()
+
+	const chunkSize = 10000
+	for start := 0; start < numLogs; start += chunkSize {
+		logs := []BanActionLog{}
+		for i := start; i < min(start+chunkSize, numLogs); i++ {
+			ip := fmt.Sprintf("10.%d.%d.%d", (i/65536)%256, (i/256)%256, i%256)
+			if i%5 == 0 {
+				ip = fmt.Sprintf("2001:db8::%x:%x", i/65536, i%65536)
+			}
+			log, err := newBanActionLog(protocols[i%len(protocols)], ip, eventTypeBan, nil, nil, now.Add(-time.Duration(i%(7*24*60))*time.Minute))
+			if err != nil {
+				b.Fatalf("failed to create log: %s", err)
+			}
+			location := countries[i%len(countries)]
+			log.Location = &location
+			logs = append(logs, log)
+		}
+		if err := db.Transaction(func(tx *Database) error {
+			_, err := tx.SaveBanActionsBatch(logs)
+			return err
+		}); err != nil {
+			b.Fatalf("failed to seed logs: %s", err)
+		}
+	}
+}
+
+// generate a sub report by loading all logs into memory and counting them in a loop
+// (the implementation before counts were aggregated in the database, only for benchmarking)
+func generateSubReportInMemory(d *Database, since time.Time) (result SubReport, err error) {
+	result = SubReport{
+		ProtocolCounts: KeyValues{},
+		CountryCounts:  KeyValues{},
+	}
+
+	var logs []BanActionLog
+	if res := d.db.Model(&BanActionLog{}).Where("created_at >= ? AND event_type = ?", since, eventTypeBan).Order("created_at ASC").Find(&logs); res.Error != nil {
+		return result, res.Error
+	}
+
+	result.TotalCount = len(logs)
+	for _, log := range logs {
+		if addr, err := netip.ParseAddr(log.IP); err == nil {
+			if addr.Unmap().Is4() {
+				result.TotalV4++
+			} else {
+				result.TotalV6++
+			}
+		}
+
+		count, _ := result.ProtocolCounts.Get(log.Protocol)
+		result.ProtocolCounts.Set(log.Protocol, count+1)
+
+		if log.Location != nil {
+			count, _ = result.CountryCounts.Get(*log.Location)
+			result.CountryCounts.Set(*log.Location, count+1)
+		}
+	}
+
+	return result, nil
+}
+
+// compare generating sub reports with aggregated queries (new) and with all logs loaded into memory (old)
+//
+//	$ go test -run=^$ -bench=GenerateSubReport -benchmem
+func BenchmarkGenerateSubReport(b *testing.B) {
+	db := openTestDB(b)
+	seedBenchmarkLogs(b, db, benchmarkNumLogs)
+	since := time.Now().AddDate(0, 0, -7)
+
+	b.Run("aggregated", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.generateSubReport(since, nil, reportOptions{}); err != nil {
+				b.Fatalf("failed to generate sub report: %s", err)
+			}
+		}
+	})
+
+	b.Run("in-memory", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := generateSubReportInMemory(db, since); err != nil {
+				b.Fatalf("failed to generate sub report: %s", err)
+			}
+		}
+	})
+}
+
+// keys of the list under given title in each window of a plain report
+func plainReportListKeys(report, title string) (result [][]string) {
+	lines := strings.Split(report, "\n")
+	for i, line := range lines {
+		if line != "* "+title+":" {
+			continue
+		}
+		keys := []string{}
+		for _, item := range lines[i+1:] {
+			if !strings.HasPrefix(item, "  ") {
+				break
+			}
+			key, _, _ := strings.Cut(strings.TrimSpace(item), ":")
+			keys = append(keys, key)
+		}
+		result = append(result, keys)
+	}
+	return result
+}
+
+func TestReportListsSortedInAllWindows(t *testing.T) {
+	db := openTestDB(t)
+
+	// saved in a non-sorted order (a: 1, b: 3, c: 2 / Japan: 1, Brazil: 3, China: 2)
+	for _, ban := range [][2]string{
+		{"a", "Japan"}, {"c", "China"}, {"b", "Brazil"}, {"c", "China"}, {"b", "Brazil"}, {"b", "Brazil"},
+	} {
+		saveTestBan(t, db, ban[0], "203.0.113.1", ban[1])
+	}
+
+	bytes, err := db.GetReportAsPlain(0, reportOptions{Sort: sortByCount})
+	if err != nil {
+		t.Fatalf("failed to generate report: %s", err)
+	}
+	report := string(bytes)
+
+	for title, expected := range map[string]string{
+		"Protocols":             "b,c,a",
+		"Originating Countries": "Brazil,China,Japan",
+	} {
+		lists := plainReportListKeys(report, title)
+		if len(lists) != 2 {
+			t.Fatalf("expected '%s' in 2 windows, got %d: %s", title, len(lists), report)
+		}
+		for i, keys := range lists {
+			if strings.Join(keys, ",") != expected {
+				t.Errorf("expected '%s' of window %d to be sorted as %s, got: %v", title, i, expected, keys)
+			}
+		}
+	}
+
+	// json reports are sorted in all windows too
+	if bytes, err = db.GetReportAsJSON(0, reportOptions{Sort: sortByCount}); err != nil {
+		t.Fatalf("failed to generate report: %s", err)
+	}
+	var parsed Report
+	if err := json.Unmarshal(bytes, &parsed); err != nil {
+		t.Fatalf("failed to parse report: %s", err)
+	}
+	for i, sub := range parsed.Windows {
+		keys := []string{}
+		for _, kv := range sub.ProtocolCounts {
+			keys = append(keys, kv.Key)
+		}
+		if strings.Join(keys, ",") != "b,c,a" {
+			t.Errorf("expected protocols of window %d to be sorted, got: %v", i, keys)
+		}
+	}
+}
+
+func TestReportFooterLinksToProject(t *testing.T) {
+	db := openTestDB(t)
+
+	// (eg. `<i>report generated by <a href="...">balog</a></i>`, `<footer>report generated by <a href="...">balog</a></footer>`)
+	footerLinkRegex := regexp.MustCompile(`(?m)^<(i|footer)>report generated by <a href="([^"]*)">balog</a></(i|footer)>$`)
+	footerLink := func(report []byte) string {
+		if matches := footerLinkRegex.FindAllStringSubmatch(string(report), -1); len(matches) == 1 {
+			return matches[0][2]
+		}
+		return ""
+	}
+
+	for _, empty := range []bool{true, false} {
+		if !empty {
+			saveTestBan(t, db, "sshd", "203.0.113.1", "China")
+		}
+
+		if report, err := db.GetReportAsTelegraph(nil, 0, reportOptions{}); err != nil {
+			t.Errorf("failed to generate telegraph report: %s", err)
+		} else if href := footerLink(report); href != projectURL {
+			t.Errorf("expected footer link of telegraph report (empty = %v) to be '%s', got: '%s'", empty, projectURL, href)
+		}
+
+		if report, err := db.GetReportAsHTML(0, reportOptions{}); err != nil {
+			t.Errorf("failed to generate html report: %s", err)
+		} else if href := footerLink(db.GetFinalReportAsHTML(report, []byte("insight"), "model")); href != projectURL {
+			t.Errorf("expected footer link of html report (empty = %v) to be '%s', got: '%s'", empty, projectURL, href)
+		}
+	}
+}
+
+func TestTagValue(t *testing.T) {
+	tags := func(str string) *string { return &str }
+
+	for _, test := range []struct {
+		tags     *string
+		name     string
+		expected string
+	}{
+		{tags(`{"region":"eu","env":"prod"}`), "region", "eu"},
+		{tags(`{"region":"eu","env":"prod"}`), "env", "prod"},
+		{tags(`{"region":"eu"}`), "env", noTagValue},
+		{tags(`{"region":""}`), "region", noTagValue},
+		{tags(`not json`), "region", noTagValue},
+		{nil, "region", noTagValue},
+	} {
+		if value := (BanActionLog{Tags: test.tags}).tagValue(test.name); value != test.expected {
+			t.Errorf("tagValue(%q) of %v: expected %q, got %q", test.name, test.tags, test.expected, value)
+		}
+	}
+}
+
+func TestGroupByTag(t *testing.T) {
+	for groupBy, expected := range map[string]string{
+		"tag:region": "region",
+		"tag:":       "",
+		"region":     "",
+		"":           "",
+	} {
+		if tag := (reportOptions{GroupBy: groupBy}).groupByTag(); tag != expected {
+			t.Errorf("groupByTag of %q: expected %q, got %q", groupBy, expected, tag)
+		}
+	}
+
+	db := openTestDB(t)
+	for _, tags := range []map[string]string{
+		{"region": "eu"},
+		{"region": "us"},
+		{"region": "us", "env": "prod"},
+		nil,
+	} {
+		if _, err := db.SaveBanAction("sshd", "203.0.113.1", tags); err != nil {
+			t.Fatalf("failed to save ban action: %s", err)
+		}
+	}
+
+	report, err := db.GenerateReport(0, reportOptions{GroupBy: "tag:region"})
+	if err != nil {
+		t.Fatalf("failed to generate report: %s", err)
+	}
+	if report.GroupBy == nil || *report.GroupBy != "tag:region" {
+		t.Errorf("expected report to be grouped by 'tag:region', got: %v", report.GroupBy)
+	}
+	grouped := sortKeyValues(report.Windows[0].GroupedCounts, sortByName)
+	if fmt.Sprintf("%v", grouped) != fmt.Sprintf("%v", KeyValues{{noTagValue, 1}, {"eu", 1}, {"us", 2}}) {
+		t.Errorf("unexpected grouped counts: %v", grouped)
+	}
+}
+
+func TestGetLocationStats(t *testing.T) {
+	db := openTestDB(t)
+
+	// no cached locations
+	stats, err := db.GetLocationStats()
+	if err != nil {
+		t.Fatalf("failed to get location stats: %s", err)
+	}
+	if stats.TotalCount != 0 || stats.OldestResolved != nil || stats.NewestResolved != nil || len(stats.CountryCounts) != 0 {
+		t.Errorf("unexpected stats of an empty cache: %+v", stats)
+	}
+
+	for ip, country := range map[string]string{
+		"203.0.113.1": "China",
+		"203.0.113.2": "China",
+		"203.0.113.3": "Japan",
+		"203.0.113.4": unknownLocation,
+		"203.0.113.5": unknownLocation,
+	} {
+		if _, err := db.SaveLocation(ip, GeoLocation{CountryName: country}); err != nil {
+			t.Fatalf("failed to save location: %s", err)
+		}
+	}
+
+	if stats, err = db.GetLocationStats(); err != nil {
+		t.Fatalf("failed to get location stats: %s", err)
+	}
+	if stats.TotalCount != 5 || stats.ResolvedCount != 3 || stats.UnknownCount != 2 {
+		t.Errorf("unexpected counts: total = %d, resolved = %d, unknown = %d", stats.TotalCount, stats.ResolvedCount, stats.UnknownCount)
+	}
+	if stats.OldestResolved == nil || stats.NewestResolved == nil || stats.OldestResolved.After(*stats.NewestResolved) {
+		t.Errorf("unexpected resolution times: %v ~ %v", stats.OldestResolved, stats.NewestResolved)
+	}
+	if fmt.Sprintf("%v", stats.CountryCounts) != fmt.Sprintf("%v", KeyValues{{"China", 2}, {unknownLocation, 2}, {"Japan", 1}}) {
+		t.Errorf("unexpected country counts: %v", stats.CountryCounts)
+	}
+}
+
+func TestGetLocationStatsResolutionTimes(t *testing.T) {
+	db := openTestDB(t)
+
+	// resolved when saved
+	if _, err := db.SaveLocation("203.0.113.1", GeoLocation{CountryName: "China"}); err != nil {
+		t.Fatalf("failed to save location: %s", err)
+	}
+	saved, _ := db.LookupLocation("203.0.113.1")
+
+	// resolved later (by `resolve_unknown_ips`)
+	resolvedAt := time.Now().AddDate(0, 0, -2)
+	if res := db.db.Create(&Location{IP: "203.0.113.2", CountryName: "Japan", ResolvedAt: &resolvedAt}); res.Error != nil {
+		t.Fatalf("failed to create location: %s", res.Error)
+	}
+
+	// reserved, and failed (retried) ones
+	if _, err := db.SaveLocation("10.0.0.1", GeoLocation{CountryName: reservedLocation}); err != nil {
+		t.Fatalf("failed to save location: %s", err)
+	}
+	if _, err := db.SaveLocation("203.0.113.3", GeoLocation{CountryName: unknownLocation}); err != nil {
+		t.Fatalf("failed to save location: %s", err)
+	}
+	db.recordLookup("203.0.113.3", time.Now().Add(time.Hour), 1)
+
+	stats, err := db.GetLocationStats()
+	if err != nil {
+		t.Fatalf("failed to get location stats: %s", err)
+	}
+	if stats.TotalCount != 4 || stats.ResolvedCount != 2 || stats.UnknownCount != 1 || stats.ReservedCount != 1 {
+		t.Errorf("unexpected counts: %+v", stats)
+	}
+	if stats.OldestResolved == nil || !stats.OldestResolved.Equal(resolvedAt) {
+		t.Errorf("expected oldest resolution at %s, got: %v", resolvedAt, stats.OldestResolved)
+	}
+	if stats.NewestResolved == nil || !stats.NewestResolved.Equal(saved.CreatedAt) {
+		t.Errorf("expected newest resolution at %s, got: %v", saved.CreatedAt, stats.NewestResolved)
+	}
+}
+
+func TestSortKeyValues(t *testing.T) {
+	// (with ties in counts, inserted in a non-alphabetical order)
+	kvs := KeyValues{{"sshd", 3}, {"nginx", 1}, {"postfix", 3}, {"dovecot", 2}, {"apache", 1}}
+
+	for _, test := range []struct {
+		order    sortOrder
+		expected string
+	}{
+		{sortByCount, "[{postfix 3} {sshd 3} {dovecot 2} {apache 1} {nginx 1}]"},
+		{"", "[{postfix 3} {sshd 3} {dovecot 2} {apache 1} {nginx 1}]"}, // default
+		{sortByCountAsc, "[{apache 1} {nginx 1} {dovecot 2} {postfix 3} {sshd 3}]"},
+		{sortByName, "[{apache 1} {dovecot 2} {nginx 1} {postfix 3} {sshd 3}]"},
+	} {
+		if sorted := fmt.Sprintf("%v", sortKeyValues(kvs, test.order)); sorted != test.expected {
+			t.Errorf("sortKeyValues with order %q: expected %s, got %s", test.order, test.expected, sorted)
+		}
+	}
+
+	// given key-values are not modified
+	if fmt.Sprintf("%v", kvs) != "[{sshd 3} {nginx 1} {postfix 3} {dovecot 2} {apache 1}]" {
+		t.Errorf("given key-values were modified: %v", kvs)
+	}
+}
+
+func TestTelegraphWindows(t *testing.T) {
+	db := openTestDB(t)
+	saveTestBan(t, db, "sshd", "203.0.113.1", "China")
+
+	for _, test := range []struct {
+		windows  []int
+		rendered []string
+		omitted  []string
+	}{
+		{nil, []string{"Last 7 days", "Last 30 days"}, nil},
+		{[]int{7}, []string{"Last 7 days"}, []string{"Last 30 days"}},
+		{[]int{30}, []string{"Last 30 days"}, []string{"Last 7 days"}},
+	} {
+		report, err := db.GetReportAsTelegraph(nil, 0, reportOptions{Days: []int{7, 30}, TelegraphWindows: test.windows})
+		if err != nil {
+			t.Fatalf("failed to generate telegraph report: %s", err)
+		}
+		for _, window := range test.rendered {
+			if !strings.Contains(string(report), window) {
+				t.Errorf("expected '%s' to be rendered with telegraph windows %v", window, test.windows)
+			}
+		}
+		for _, window := range test.omitted {
+			if strings.Contains(string(report), window) {
+				t.Errorf("expected '%s' not to be rendered with telegraph windows %v", window, test.windows)
+			}
+		}
+	}
+}
+
+func TestActiveDuration(t *testing.T) {
+	start := time.Date(2024, 3, 1, 22, 30, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		end        time.Time
+		quietHours []int
+		expected   time.Duration
+	}{
+		{start.Add(3 * time.Hour), nil, 3 * time.Hour},
+		{start.Add(3 * time.Hour), []int{}, 3 * time.Hour},
+		{start.Add(3 * time.Hour), []int{23, 0}, time.Hour},                  // 22:30~23:00, 01:00~01:30
+		{start.Add(3 * time.Hour), []int{22}, 150 * time.Minute},             // partial hour at the start
+		{start.Add(3 * time.Hour), []int{1}, 150 * time.Minute},              // partial hour at the end
+		{start.Add(3 * time.Hour), []int{12, 13}, 3 * time.Hour},             // no overlap
+		{start.Add(20 * time.Minute), []int{22}, 0},                          // all quiet
+		{start.Add(48 * time.Hour), []int{0, 1, 2, 3, 4, 5}, 36 * time.Hour}, // over days
+		{start, []int{0}, 0},
+	} {
+		if duration := activeDuration(start, test.end, test.quietHours); duration != test.expected {
+			t.Errorf("expected %s until %s with quiet hours %v, got: %s", test.expected, test.end, test.quietHours, duration)
+		}
+	}
+}
+
+func TestDetectGaps(t *testing.T) {
+	db := openTestDB(t)
+
+	now := time.Now()
+	for _, hours := range []int{10, 9, 2} {
+		if _, err := db.SaveBanActionAt("sshd", "203.0.113.1", nil, now.Add(-time.Duration(hours)*time.Hour)); err != nil {
+			t.Fatalf("failed to save ban action: %s", err)
+		}
+	}
+
+	// unban events don't close gaps
+	if res := db.db.Create(&BanActionLog{Protocol: "sshd", IP: "203.0.113.1", EventType: eventTypeUnban, CreatedAt: now.Add(-5 * time.Hour)}); res.Error != nil {
+		t.Fatalf("failed to create unban event: %s", res.Error)
+	}
+
+	// only the period between 9 and 2 hours ago is longer than 3 hours
+	gaps, err := db.DetectGaps(3*time.Hour, nil)
+	if err != nil {
+		t.Fatalf("failed to detect gaps: %s", err)
+	}
+	if len(gaps) != 1 {
+		t.Fatalf("expected 1 gap, got: %+v", gaps)
+	}
+	if gaps[0].Duration != "7h0m0s" {
+		t.Errorf("expected a gap of 7 hours, got: %s", gaps[0].Duration)
+	}
+	if !gaps[0].Start.Equal(now.Add(-9*time.Hour)) || !gaps[0].End.Equal(now.Add(-2*time.Hour)) {
+		t.Errorf("unexpected period of gap: %s ~ %s", gaps[0].Start, gaps[0].End)
+	}
+
+	// the gap from the last log until now
+	if gaps, err = db.DetectGaps(time.Hour, nil); err != nil {
+		t.Fatalf("failed to detect gaps: %s", err)
+	}
+	if len(gaps) != 2 {
+		t.Errorf("expected 2 gaps, got: %+v", gaps)
+	}
+
+	// no gap when all hours are quiet
+	allHours := []int{}
+	for hour := range 24 {
+		allHours = append(allHours, hour)
+	}
+	if gaps, err = db.DetectGaps(time.Hour, allHours); err != nil {
+		t.Fatalf("failed to detect gaps: %s", err)
+	}
+	if len(gaps) != 0 {
+		t.Errorf("expected no gap in quiet hours, got: %+v", gaps)
+	}
+}
+
+func TestGenerateSubReportTrustedCountries(t *testing.T) {
+	db := openTestDB(t)
+	saveTestBan(t, db, "sshd", "203.0.113.1", "South Korea")
+	saveTestBan(t, db, "sshd", "203.0.113.2", "South Korea")
+	saveTestBan(t, db, "sshd", "203.0.113.3", "China")
+	saveTestBan(t, db, "sshd", "203.0.113.4", "")
+
+	since := time.Now().AddDate(0, 0, -1)
+
+	// not counted without trusted countries
+	sub, err := db.generateSubReport(since, nil, reportOptions{})
+	if err != nil {
+		t.Fatalf("failed to generate sub report: %s", err)
+	}
+	if sub.TrustedCountryCounts != nil {
+		t.Errorf("expected no trusted country counts, got: %v", sub.TrustedCountryCounts)
+	}
+
+	// counted case-insensitively, only for trusted countries with bans
+	if sub, err = db.generateSubReport(since, nil, reportOptions{TrustedCountries: []string{"south korea", "Japan"}}); err != nil {
+		t.Fatalf("failed to generate sub report: %s", err)
+	}
+	if len(sub.TrustedCountryCounts) != 1 {
+		t.Fatalf("expected 1 trusted country, got: %v", sub.TrustedCountryCounts)
+	}
+	if count, exists := sub.TrustedCountryCounts.Get("South Korea"); !exists || count != 2 {
+		t.Errorf("expected 2 bans from South Korea, got: %d", count)
+	}
+	if count, _ := sub.CountryCounts.Get("China"); count != 1 {
+		t.Errorf("expected 1 ban from China in country counts, got: %d", count)
+	}
+}
+
+func TestGetFinalReportAsMsgpack(t *testing.T) {
+	db := openTestDB(t)
+	saveTestBan(t, db, "sshd", "203.0.113.1", "China")
+	saveTestBan(t, db, "postfix", "2001:db8::1", "Japan")
+
+	report, err := db.GetReportAsJSON(0, reportOptions{Timeseries: true})
+	if err != nil {
+		t.Fatalf("failed to generate json report: %s", err)
+	}
+	insight := []byte("generated insight")
+
+	encoded, err := db.GetFinalReportAsMsgpack(report, insight)
+	if err != nil {
+		t.Fatalf("failed to generate msgpack report: %s", err)
+	}
+
+	// decoded msgpack should have the same keys and values as the final json report
+	var decoded any
+	if err := msgpack.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("failed to decode msgpack report: %s", err)
+	}
+	var fromMsgpack, fromJSON any
+	if bytes, err := json.Marshal(decoded); err != nil {
+		t.Fatalf("failed to convert msgpack report to json: %s", err)
+	} else if err := json.Unmarshal(bytes, &fromMsgpack); err != nil {
+		t.Fatalf("failed to parse converted msgpack report: %s", err)
+	}
+	if err := json.Unmarshal(db.GetFinalReportAsJSON(report, insight), &fromJSON); err != nil {
+		t.Fatalf("failed to parse final json report: %s", err)
+	}
+	if !reflect.DeepEqual(fromMsgpack, fromJSON) {
+		t.Errorf("expected msgpack report to have the same shape as json report:\n%v\n%v", fromMsgpack, fromJSON)
+	}
+
+	// decoded into a report (with json tags)
+	var decodedReport Report
+	decoder := msgpack.NewDecoder(strings.NewReader(string(encoded)))
+	decoder.SetCustomStructTag("json")
+	if err := decoder.Decode(&decodedReport); err != nil {
+		t.Fatalf("failed to decode msgpack report: %s", err)
+	}
+	if decodedReport.Insight == nil || *decodedReport.Insight != string(insight) {
+		t.Errorf("expected insight to be included in msgpack report, got: %v", decodedReport.Insight)
+	}
+}
+
+func TestPurgeLogsByRetention(t *testing.T) {
+	for _, test := range []struct {
+		defaultDays int
+		purged      map[string]int
+		remaining   int64
+	}{
+		{15, map[string]int{"sshd": 1, "postfix": 0, "nginx": 1}, 3},
+		{0, map[string]int{"sshd": 1, "postfix": 0}, 4}, // logs of protocols without retention days are kept
+	} {
+		db := openTestDB(t)
+		for _, log := range []struct {
+			protocol string
+			daysAgo  int
+		}{
+			{"sshd", 5}, {"sshd", 20},
+			{"postfix", 5}, {"postfix", 20},
+			{"nginx", 20},
+		} {
+			if _, err := db.SaveBanActionAt(log.protocol, "203.0.113.1", nil, time.Now().AddDate(0, 0, -log.daysAgo)); err != nil {
+				t.Fatalf("failed to save ban action: %s", err)
+			}
+		}
+
+		purged, err := db.PurgeLogsByRetention(test.defaultDays, map[string]int{"sshd": 10, "postfix": 30})
+		if err != nil {
+			t.Fatalf("failed to purge logs: %s", err)
+		}
+		if len(purged) != len(test.purged) {
+			t.Errorf("expected purged counts of %d protocols with default days %d, got: %v", len(test.purged), test.defaultDays, purged)
+		}
+		for protocol, expected := range test.purged {
+			if count, exists := purged.Get(protocol); !exists || count != expected {
+				t.Errorf("expected %d purged logs of '%s' with default days %d, got: %d", expected, protocol, test.defaultDays, count)
+			}
+		}
+		if count := countAllLogs(t, db); count != test.remaining {
+			t.Errorf("expected %d remaining rows with default days %d, got: %d", test.remaining, test.defaultDays, count)
+		}
+	}
+}
+
+func TestQueryByCIDR(t *testing.T) {
+	db := openTestDB(t)
+	for _, ip := range []string{
+		"10.1.2.3", "10.1.2.200", "10.1.3.4", "10.2.0.1", "110.1.2.3", "100.1.2.3",
+		"2001:db8::1", "2001:db8::ffff", "2001:db8:1::1", "2001:db9::1",
+	} {
+		saveTestBan(t, db, "sshd", ip, "")
+	}
+
+	// unban events are not included
+	if _, err := db.SaveBanEvent("sshd", "10.1.2.3", eventTypeUnban, nil); err != nil {
+		t.Fatalf("failed to save unban event: %s", err)
+	}
+
+	for _, test := range []struct {
+		cidr     string
+		expected []string
+	}{
+		{"10.1.2.0/24", []string{"10.1.2.3", "10.1.2.200"}},
+		{"10.1.2.128/25", []string{"10.1.2.200"}},
+		{"10.1.0.0/16", []string{"10.1.2.3", "10.1.2.200", "10.1.3.4"}},
+		{"10.0.0.0/8", []string{"10.1.2.3", "10.1.2.200", "10.1.3.4", "10.2.0.1"}},
+		{"10.1.2.0/22", []string{"10.1.2.3", "10.1.2.200", "10.1.3.4"}}, // not on octet boundaries
+		{"10.1.2.3/32", []string{"10.1.2.3"}},
+		{"10.1.2.9/24", []string{"10.1.2.3", "10.1.2.200"}}, // masked
+		{"192.0.2.0/24", []string{}},
+		{"2001:db8::/64", []string{"2001:db8::1", "2001:db8::ffff"}},
+		{"2001:db8::/32", []string{"2001:db8::1", "2001:db8::ffff", "2001:db8:1::1"}},
+		{"2001:db8::1/128", []string{"2001:db8::1"}},
+		{"::ffff:10.1.2.0/120", []string{}}, // ipv4-mapped prefixes don't match ipv4 addresses
+	} {
+		logs, err := db.QueryByCIDR(netip.MustParsePrefix(test.cidr))
+		if err != nil {
+			t.Fatalf("failed to query by '%s': %s", test.cidr, err)
+		}
+		ips := []string{}
+		for _, log := range logs {
+			ips = append(ips, log.IP)
+		}
+		if strings.Join(ips, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("expected %v for '%s', got: %v", test.expected, test.cidr, ips)
+		}
+	}
+}
+
+func TestBuildSections(t *testing.T) {
+	sub := SubReport{
+		NumDays:        7,
+		TotalCount:     2,
+		ProtocolCounts: KeyValues{{"sshd", 2}},
+		CountryCounts:  KeyValues{{"China", 2}},
+		OrgCounts:      KeyValues{},
+	}
+	withJails := sub
+	withJails.JailCounts = KeyValues{{"sshd", 2}}
+
+	// formatters which return names of sections
+	total := func(sub SubReport) string {
+		return string(reportSectionTotal)
+	}
+	list := func(section reportSection, title string, kvs KeyValues) string {
+		return string(section)
+	}
+
+	for _, test := range []struct {
+		sections []reportSection
+		sub      SubReport
+		expected []string
+	}{
+		// all sections in the default order, without ones which have no data
+		{nil, sub, []string{"total", "protocols", "countries", "networks", "top_ips"}},
+		{nil, withJails, []string{"total", "protocols", "jails", "countries", "networks", "top_ips"}},
+
+		// only enabled sections in the given order
+		{[]reportSection{reportSectionCountries, reportSectionTotal}, sub, []string{"countries", "total"}},
+		{[]reportSection{reportSectionTopIPs, reportSectionJails, reportSectionProtocols}, withJails, []string{"top_ips", "jails", "protocols"}},
+		{[]reportSection{reportSectionJails, reportSectionGroups, reportSectionHours}, sub, []string{}},
+		{[]reportSection{reportSectionInsight}, sub, []string{}}, // not built as a section
+	} {
+		opts := reportOptions{Sections: test.sections}
+		if built := opts.buildSections(Report{}, test.sub, total, list); strings.Join(built, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("expected sections %v with %v, got: %v", test.expected, test.sections, built)
+		}
+	}
+
+	// toggled sections
+	opts := reportOptions{Sections: []reportSection{reportSectionTotal, reportSectionInsight}}
+	if !opts.hasSection(reportSectionInsight) || opts.hasSection(reportSectionProtocols) {
+		t.Errorf("expected only enabled sections, got: %v", opts.sections())
+	}
+	if !(reportOptions{}).hasSection(reportSectionProtocols) {
+		t.Errorf("expected all sections to be enabled by default")
+	}
+}
+
+func TestIsDSN(t *testing.T) {
+	for _, test := range []struct {
+		path     string
+		dsn      bool
+		inMemory bool
+	}{
+		{"/var/lib/balog/database.sqlite", false, false},
+		{"database.sqlite", false, false},
+		{"file:/var/lib/balog/database.sqlite", true, false},               // uri
+		{"file:/var/lib/balog/database.sqlite?cache=shared", true, false},  // uri with options
+		{"/var/lib/balog/database.sqlite?_busy_timeout=1000", true, false}, // filepath with options
+		{"/var/lib/file:balog/database.sqlite", false, false},
+		{":memory:", false, true},
+		{"file::memory:?cache=shared", true, true},
+		{"file:test?mode=memory", true, true},
+	} {
+		if dsn := isDSN(test.path); dsn != test.dsn {
+			t.Errorf("expected '%s' to be a dsn: %v, got: %v", test.path, test.dsn, dsn)
+		}
+		if inMemory := isMemoryDB(test.path); inMemory != test.inMemory {
+			t.Errorf("expected '%s' to be an in-memory database: %v, got: %v", test.path, test.inMemory, inMemory)
+		}
+	}
+}
+
+func TestOpenDBWithDSN(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "dsn.db")
+
+	// opened with both forms of dsn
+	for _, dsn := range []string{
+		"file:" + fpath + "?_busy_timeout=1000",
+		fpath + "?_journal_mode=WAL",
+	} {
+		db, err := OpenDB(dsn, dbOptions{})
+		if err != nil {
+			t.Fatalf("failed to open database with dsn '%s': %s", dsn, err)
+		}
+		saveTestBan(t, db, "sshd", "203.0.113.1", "")
+		if sqlDB, err := db.db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	}
+
+	// both are the same database file
+	db, err := OpenDB(fpath, dbOptions{})
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer func() {
+		if sqlDB, err := db.db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	}()
+	if count := countAllLogs(t, db); count != 2 {
+		t.Errorf("expected 2 logs saved with dsns, got: %d", count)
+	}
+}
+
+func TestAnonymizeLogsOlderThan(t *testing.T) {
+	db := openTestDB(t)
+	for _, log := range []struct {
+		ip      string
+		daysAgo int
+	}{
+		{"203.0.113.1", 20},          // only old logs
+		{"203.0.113.2", 20},          // both old and recent logs
+		{"203.0.113.2", 1},           // (recent)
+		{"203.0.113.3", 1},           // only recent logs
+		{"2001:db8:1:2:3:4:5:6", 20}, // ipv6
+	} {
+		id, err := db.SaveBanActionAt("sshd", log.ip, nil, time.Now().AddDate(0, 0, -log.daysAgo))
+		if err != nil {
+			t.Fatalf("failed to save ban action: %s", err)
+		}
+		if err := db.UpdateBanActionLocation(id, "China"); err != nil {
+			t.Fatalf("failed to update location: %s", err)
+		}
+		if cached, _ := db.LookupLocation(log.ip); cached.ID == 0 {
+			if _, err := db.SaveLocation(log.ip, GeoLocation{CountryName: "China"}); err != nil {
+				t.Fatalf("failed to save location: %s", err)
+			}
+		}
+	}
+
+	anonymized, err := db.AnonymizeLogsOlderThan(10)
+	if err != nil {
+		t.Fatalf("failed to anonymize logs: %s", err)
+	}
+	if anonymized != 3 {
+		t.Errorf("expected 3 anonymized logs, got: %d", anonymized)
+	}
+
+	// only old logs are masked, and their countries are kept
+	var logs []BanActionLog
+	if res := db.db.Order("id ASC").Find(&logs); res.Error != nil {
+		t.Fatalf("failed to load logs: %s", res.Error)
+	}
+	for i, expected := range []string{"203.0.113.0", "203.0.113.0", "203.0.113.2", "203.0.113.3", "2001:db8:1::"} {
+		if logs[i].IP != expected {
+			t.Errorf("expected ip '%s' of log #%d, got: '%s'", expected, i, logs[i].IP)
+		}
+		if logs[i].Location == nil || *logs[i].Location != "China" {
+			t.Errorf("expected location of log #%d to be kept, got: %v", i, logs[i].Location)
+		}
+	}
+
+	// cached locations of ips which are no longer referenced are deleted
+	for ip, expected := range map[string]bool{
+		"203.0.113.1":          false,
+		"203.0.113.2":          true,
+		"203.0.113.3":          true,
+		"2001:db8:1:2:3:4:5:6": false,
+	} {
+		if location, err := db.LookupLocation(ip); err != nil {
+			t.Errorf("failed to lookup location of '%s': %s", ip, err)
+		} else if (location.ID != 0) != expected {
+			t.Errorf("expected cached location of '%s' to exist: %v", ip, expected)
+		}
+	}
+
+	// already masked logs are not anonymized again
+	if anonymized, err = db.AnonymizeLogsOlderThan(10); err != nil || anonymized != 0 {
+		t.Errorf("expected no more anonymized logs, got: %d, %v", anonymized, err)
+	}
+
+	// anonymized logs are not orphans
+	if audit, err := db.AuditLocations(10); err != nil {
+		t.Errorf("failed to audit locations: %s", err)
+	} else if audit.OrphanLogsCount != 0 {
+		t.Errorf("expected no orphan logs, got: %d (%v)", audit.OrphanLogsCount, audit.OrphanLogIPs)
+	}
+
+	// masked ips are neither listed nor resolved as unknown ones
+	saveTestUnknownLocations(t, db, "203.0.113.0", "2001:db8:1::", "203.0.113.9")
+	if unknowns, err := db.ListUnknownIPs(); err != nil || len(unknowns) != 1 || unknowns[0].IP != "203.0.113.9" {
+		t.Errorf("expected only the unmasked unknown ip, got: %+v, %v", unknowns, err)
+	}
+	located := []string{}
+	if _, _, err := db.ResolveUnknownIPs(context.Background(), stubGeolocator{country: "Japan", located: &located}, 0, resolveBackoff{}, 0); err != nil {
+		t.Errorf("failed to resolve unknown ips: %s", err)
+	}
+	if fmt.Sprintf("%v", located) != "[203.0.113.9]" {
+		t.Errorf("expected only the unmasked ip to be located, got: %v", located)
+	}
+}
+
+func TestGenerateSubReportAddressFamilies(t *testing.T) {
+	db := openTestDB(t)
+	saveTestBan(t, db, "sshd", "203.0.113.1", "")
+	saveTestBan(t, db, "sshd", "203.0.113.1", "")
+	saveTestBan(t, db, "sshd", "2001:db8::1", "")
+	saveTestBan(t, db, "sshd", "::ffff:203.0.113.2", "") // normalized to ipv4 when saved
+
+	// rows saved without normalization (eg. by older versions)
+	for _, ip := range []string{
+		"::ffff:203.0.113.3", // v4-mapped
+		"::FFFF:203.0.113.4", // v4-mapped (uppercased)
+		"::ffff:cb00:7105",   // v4-mapped (in hex)
+		"2001:DB8::2",        // v6 (uppercased)
+		"::1",                // v6
+	} {
+		if res := db.db.Create(&BanActionLog{Protocol: "sshd", IP: ip, EventType: eventTypeBan}); res.Error != nil {
+			t.Fatalf("failed to create log: %s", res.Error)
+		}
+	}
+
+	sub, err := db.generateSubReport(time.Now().AddDate(0, 0, -1), nil, reportOptions{})
+	if err != nil {
+		t.Fatalf("failed to generate sub report: %s", err)
+	}
+	if sub.TotalCount != 9 || sub.TotalV4 != 6 || sub.TotalV6 != 3 {
+		t.Errorf("expected 9 total (6 ipv4, 3 ipv6), got: %d (%d ipv4, %d ipv6)", sub.TotalCount, sub.TotalV4, sub.TotalV6)
+	}
+}
+
+func TestTrimLogs(t *testing.T) {
+	db := openTestDB(t)
+
+	// saved out of chronological order
+	ids := map[int]uint{}
+	for _, daysAgo := range []int{1, 5, 3, 10, 2} {
+		id, err := db.SaveBanActionAt("sshd", "203.0.113.1", nil, time.Now().AddDate(0, 0, -daysAgo))
+		if err != nil {
+			t.Fatalf("failed to save ban action: %s", err)
+		}
+		ids[daysAgo] = id
+	}
+
+	// not trimmed when under the limit
+	if trimmed, err := db.TrimLogs(5); err != nil || trimmed != 0 {
+		t.Errorf("expected no trimmed log, got: %d, %v", trimmed, err)
+	}
+
+	// the oldest ones are evicted first, regardless of their ids
+	if trimmed, err := db.TrimLogs(3); err != nil || trimmed != 2 {
+		t.Errorf("expected 2 trimmed logs, got: %d, %v", trimmed, err)
+	}
+	var remaining []uint
+	if res := db.db.Unscoped().Model(&BanActionLog{}).Order("id ASC").Pluck("id", &remaining); res.Error != nil {
+		t.Fatalf("failed to load ids of logs: %s", res.Error)
+	}
+	if fmt.Sprintf("%v", remaining) != fmt.Sprintf("%v", []uint{ids[1], ids[3], ids[2]}) {
+		t.Errorf("expected logs of 1, 3, and 2 days ago to remain, got ids: %v (of %v)", remaining, ids)
+	}
+
+	// soft-deleted logs are also counted and trimmed
+	if res := db.db.Delete(&BanActionLog{}, ids[3]); res.Error != nil {
+		t.Fatalf("failed to soft-delete log: %s", res.Error)
+	}
+	if trimmed, err := db.TrimLogs(1); err != nil || trimmed != 2 {
+		t.Errorf("expected 2 trimmed logs, got: %d, %v", trimmed, err)
+	}
+	if count := countAllLogs(t, db); count != 1 {
+		t.Errorf("expected 1 remaining row, got: %d", count)
+	}
+}
+
+func TestAuditLocations(t *testing.T) {
+	db := openTestDB(t)
+
+	// logs with and without cached locations
+	saveTestBan(t, db, "sshd", "203.0.113.1", "China")
+	saveTestBan(t, db, "sshd", "203.0.113.2", "")
+	saveTestBan(t, db, "sshd", "203.0.113.2", "")
+	saveTestBan(t, db, "sshd", "203.0.113.3", "")
+
+	// cached locations with and without logs
+	for _, ip := range []string{"203.0.113.1", "203.0.113.4"} {
+		if _, err := db.SaveLocation(ip, GeoLocation{CountryName: "China"}); err != nil {
+			t.Fatalf("failed to save location: %s", err)
+		}
+	}
+
+	audit, err := db.AuditLocations(10)
+	if err != nil {
+		t.Fatalf("failed to audit locations: %s", err)
+	}
+	if audit.OrphanLogsCount != 3 {
+		t.Errorf("expected 3 orphan logs, got: %d", audit.OrphanLogsCount)
+	}
+	slices.Sort(audit.OrphanLogIPs)
+	if fmt.Sprintf("%v", audit.OrphanLogIPs) != "[203.0.113.2 203.0.113.3]" {
+		t.Errorf("expected distinct ips of orphan logs, got: %v", audit.OrphanLogIPs)
+	}
+	if audit.OrphanLocationsCount != 1 || fmt.Sprintf("%v", audit.OrphanLocationIPs) != "[203.0.113.4]" {
+		t.Errorf("expected 1 orphan location, got: %d (%v)", audit.OrphanLocationsCount, audit.OrphanLocationIPs)
+	}
+
+	// samples are limited, but counts are not
+	if audit, err = db.AuditLocations(1); err != nil {
+		t.Fatalf("failed to audit locations: %s", err)
+	}
+	if audit.OrphanLogsCount != 3 || len(audit.OrphanLogIPs) != 1 {
+		t.Errorf("expected 3 orphan logs with 1 sample, got: %d (%v)", audit.OrphanLogsCount, audit.OrphanLogIPs)
+	}
+
+	// nothing is orphaned when all logs and locations match
+	if _, err := db.SaveLocation("203.0.113.2", GeoLocation{CountryName: "China"}); err != nil {
+		t.Fatalf("failed to save location: %s", err)
+	}
+	if _, err := db.SaveLocation("203.0.113.3", GeoLocation{CountryName: "China"}); err != nil {
+		t.Fatalf("failed to save location: %s", err)
+	}
+	saveTestBan(t, db, "sshd", "203.0.113.4", "China")
+	if audit, err = db.AuditLocations(10); err != nil {
+		t.Fatalf("failed to audit locations: %s", err)
+	}
+	if audit.OrphanLogsCount != 0 || audit.OrphanLocationsCount != 0 || len(audit.OrphanLogIPs) != 0 || len(audit.OrphanLocationIPs) != 0 {
+		t.Errorf("expected nothing orphaned, got: %+v", audit)
+	}
+}
+
+func TestReportsOfEmptyDatabase(t *testing.T) {
+	db := openTestDB(t)
+	opts := reportOptions{}
+
+	for format, generate := range map[string]func() ([]byte, error){
+		"plain":     func() ([]byte, error) { return db.GetReportAsPlain(0, opts) },
+		"markdown":  func() ([]byte, error) { return db.GetReportAsMarkdown(0, opts) },
+		"html":      func() ([]byte, error) { return db.GetReportAsHTML(0, opts) },
+		"telegraph": func() ([]byte, error) { return db.GetReportAsTelegraph(nil, 0, opts) },
+	} {
+		report, err := generate()
+		if err != nil {
+			t.Errorf("failed to generate %s report of empty database: %s", format, err)
+			continue
+		}
+		if !strings.Contains(string(report), emptyReportMessage) {
+			t.Errorf("expected %s report of empty database to have the empty message, got: %s", format, report)
+		}
+		if strings.Contains(string(report), "Total") {
+			t.Errorf("expected %s report of empty database not to have windows, got: %s", format, report)
+		}
+	}
+
+	// json (and msgpack) reports are marked as empty, but still have windows with zero counts
+	report, err := db.GetReportAsJSON(0, opts)
+	if err != nil {
+		t.Fatalf("failed to generate json report of empty database: %s", err)
+	}
+	var parsed Report
+	if err := json.Unmarshal(report, &parsed); err != nil {
+		t.Fatalf("failed to parse json report of empty database: %s", err)
+	}
+	if !parsed.Empty || len(parsed.Windows) != len(defaultReportDays) {
+		t.Errorf("expected an empty json report with %d windows, got: %s", len(defaultReportDays), report)
+	}
+	for _, sub := range parsed.Windows {
+		if sub.TotalCount != 0 || sub.ProtocolCounts == nil || sub.CountryCounts == nil {
+			t.Errorf("expected a window with zero counts, got: %+v", sub)
+		}
+	}
+	if _, err := db.GetFinalReportAsMsgpack(report, nil); err != nil {
+		t.Errorf("failed to generate msgpack report of empty database: %s", err)
+	}
+
+	// comparisons
+	if comparison, err := db.CompareReports(0, 7, opts); err != nil {
+		t.Errorf("failed to compare reports of empty database: %s", err)
+	} else if comparison.Total.Count != 0 || len(comparison.Protocols) != 0 || len(comparison.Countries) != 0 {
+		t.Errorf("expected an empty comparison, got: %+v", comparison)
+	}
+}
+
+func TestPrepareDBDir(t *testing.T) {
+	dir := t.TempDir()
+
+	// missing directories are created
+	missing := filepath.Join(dir, "missing", "nested")
+	if err := prepareDBDir(missing); err != nil {
+		t.Errorf("failed to prepare missing directory: %s", err)
+	} else if info, err := os.Stat(missing); err != nil || !info.IsDir() {
+		t.Errorf("expected missing directory to be created, got: %v", err)
+	}
+
+	// no temporary file is left
+	if entries, err := os.ReadDir(missing); err != nil || len(entries) != 0 {
+		t.Errorf("expected no file left in the directory, got: %v, %v", entries, err)
+	}
+
+	// directories can't be created under a file
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatalf("failed to create file: %s", err)
+	}
+	if err := prepareDBDir(filepath.Join(file, "db")); err == nil || !strings.Contains(err.Error(), "failed to create database directory") {
+		t.Errorf("expected an error for a directory under a file, got: %v", err)
+	}
+	if _, err := OpenDB(filepath.Join(file, "db", "test.db"), dbOptions{}); err == nil {
+		t.Errorf("expected an error when opening a database under a file")
+	}
+
+	t.Run("read-only", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("root can write to read-only directories")
+		}
+
+		readOnly := filepath.Join(dir, "read-only")
+		if err := os.Mkdir(readOnly, 0o500); err != nil {
+			t.Fatalf("failed to create read-only directory: %s", err)
+		}
+		defer os.Chmod(readOnly, 0o700)
+
+		if err := prepareDBDir(readOnly); err == nil || !strings.Contains(err.Error(), "is not writable") {
+			t.Errorf("expected an error for a read-only directory, got: %v", err)
+		}
+	})
+}
+
+func TestOpenDBPragmas(t *testing.T) {
+	for _, test := range []struct {
+		opts        dbOptions
+		journalMode string
+		busyTimeout int
+	}{
+		{dbOptions{}, "wal", defaultDBBusyTimeoutMillis},
+		{dbOptions{BusyTimeoutMillis: 1234, JournalMode: "DELETE"}, "delete", 1234},
+	} {
+		db, err := OpenDB(filepath.Join(t.TempDir(), "test.db"), test.opts)
+		if err != nil {
+			t.Fatalf("failed to open database: %s", err)
+		}
+
+		var journalMode string
+		var busyTimeout int
+		if res := db.db.Raw("PRAGMA journal_mode").Scan(&journalMode); res.Error != nil {
+			t.Fatalf("failed to query journal mode: %s", res.Error)
+		}
+		if res := db.db.Raw("PRAGMA busy_timeout").Scan(&busyTimeout); res.Error != nil {
+			t.Fatalf("failed to query busy timeout: %s", res.Error)
+		}
+		if journalMode != test.journalMode || busyTimeout != test.busyTimeout {
+			t.Errorf("expected journal mode '%s' and busy timeout %d with %+v, got: '%s', %d", test.journalMode, test.busyTimeout, test.opts, journalMode, busyTimeout)
+		}
+
+		if sqlDB, err := db.db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	}
+}
+
+func TestConcurrentSavesAndReports(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+
+	// separate connections, like concurrent processes
+	writer, reader := openTestDBAt(t, fpath), openTestDBAt(t, fpath)
+
+	done := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			for j := 0; j < 50; j++ {
+				if _, err := writer.SaveBanAction("sshd", fmt.Sprintf("203.0.113.%d", i*50+j), nil); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}(i)
+	}
+	go func() {
+		for j := 0; j < 10; j++ {
+			if _, err := reader.GetReportAsJSON(0, reportOptions{}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for i := 0; i < 5; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("expected no lock error, got: %s", err)
+		}
+	}
+	if count := countAllLogs(t, reader); count != 200 {
+		t.Errorf("expected 200 saved logs, got: %d", count)
+	}
+}
+
+func TestGetReportAsJSONSortsJailsAndHosts(t *testing.T) {
+	db := openTestDB(t)
+	for _, log := range []struct {
+		host, jail string
+		count      int
+	}{
+		{"host-b", "jail-b", 1},
+		{"host-a", "jail-a", 3},
+		{"host-c", "jail-c", 2},
+	} {
+		db.SetHost(log.host)
+		for i := 0; i < log.count; i++ {
+			if _, err := db.SaveBanAction("sshd", "203.0.113.1", nil, log.jail); err != nil {
+				t.Fatalf("failed to save ban action: %s", err)
+			}
+		}
+	}
+
+	keys := func(kvs KeyValues) (result []string) {
+		for _, kv := range kvs {
+			result = append(result, kv.Key)
+		}
+		return result
+	}
+
+	for _, test := range []struct {
+		sort     sortOrder
+		expected string
+	}{
+		{sortByCount, "[%[1]s-a %[1]s-c %[1]s-b]"},
+		{sortByCountAsc, "[%[1]s-b %[1]s-c %[1]s-a]"},
+		{sortByName, "[%[1]s-a %[1]s-b %[1]s-c]"},
+	} {
+		bytes, err := db.GetReportAsJSON(0, reportOptions{Sort: test.sort})
+		if err != nil {
+			t.Fatalf("failed to generate json report: %s", err)
+		}
+		var report Report
+		if err := json.Unmarshal(bytes, &report); err != nil {
+			t.Fatalf("failed to parse json report: %s", err)
+		}
+		for _, sub := range report.Windows {
+			if jails := fmt.Sprintf("%v", keys(sub.JailCounts)); jails != fmt.Sprintf(test.expected, "jail") {
+				t.Errorf("expected jails sorted in order '%s', got: %s", test.sort, jails)
+			}
+			if hosts := fmt.Sprintf("%v", keys(sub.HostCounts)); hosts != fmt.Sprintf(test.expected, "host") {
+				t.Errorf("expected hosts sorted in order '%s', got: %s", test.sort, hosts)
+			}
+		}
+	}
+}
+
+func TestImportFromTwice(t *testing.T) {
+	dir := t.TempDir()
+	src := openTestDBAt(t, filepath.Join(dir, "src.db"))
+	saveTestBan(t, src, "sshd", "203.0.113.1", "China")
+	saveTestBan(t, src, "sshd", "203.0.113.2", "Japan")
+	if _, err := src.SaveBanActionAt("postfix", "203.0.113.1", nil, time.Now().AddDate(0, 0, -3)); err != nil {
+		t.Fatalf("failed to save ban action: %s", err)
+	}
+	if _, err := src.SaveLocation("203.0.113.1", GeoLocation{CountryName: "China"}); err != nil {
+		t.Fatalf("failed to save location: %s", err)
+	}
+
+	// rows saved without normalization (eg. by older versions)
+	timestamp := time.Now().Add(-time.Hour)
+	if res := src.db.Create(&BanActionLog{Protocol: "sshd", IP: "::ffff:203.0.113.3", EventType: eventTypeBan, CreatedAt: timestamp}); res.Error != nil {
+		t.Fatalf("failed to create log: %s", res.Error)
+	}
+	if res := src.db.Create(&Location{IP: "::ffff:203.0.113.3", CountryName: "Japan"}); res.Error != nil {
+		t.Fatalf("failed to create location: %s", res.Error)
+	}
+
+	// events with the same ip, protocol, and timestamp, but of another host or event type
+	for _, log := range []BanActionLog{
+		{Protocol: "sshd", IP: "203.0.113.3", EventType: eventTypeBan, CreatedAt: timestamp, Host: ptrTo("other-host")},
+		{Protocol: "sshd", IP: "203.0.113.3", EventType: eventTypeUnban, CreatedAt: timestamp},
+	} {
+		if res := src.db.Create(&log); res.Error != nil {
+			t.Fatalf("failed to create log: %s", res.Error)
+		}
+	}
+
+	// (moved to a path with characters which should be escaped in uris)
+	if sqlDB, err := src.db.DB(); err == nil {
+		sqlDB.Close()
+	}
+	srcPath := filepath.Join(dir, "src?#1.db")
+	if err := os.Rename(filepath.Join(dir, "src.db"), srcPath); err != nil {
+		t.Fatalf("failed to move source database: %s", err)
+	}
+
+	db := openTestDB(t)
+	saveTestBan(t, db, "sshd", "203.0.113.1", "China") // same ip and protocol, but a different timestamp
+	if _, err := db.SaveLocation("203.0.113.3", GeoLocation{CountryName: "Japan"}); err != nil {
+		t.Fatalf("failed to save location: %s", err)
+	}
+
+	// first import
+	bans, skippedBans, locations, skippedLocations, err := db.ImportFrom(srcPath)
+	if err != nil {
+		t.Fatalf("failed to import: %s", err)
+	}
+	if bans != 6 || skippedBans != 0 || locations != 1 || skippedLocations != 1 {
+		t.Errorf("expected 6 imported logs and 1 location (1 skipped), got: %d (skipped %d), %d (skipped %d)", bans, skippedBans, locations, skippedLocations)
+	}
+
+	// importing again doesn't duplicate logs
+	if bans, skippedBans, locations, skippedLocations, err = db.ImportFrom(srcPath); err != nil {
+		t.Fatalf("failed to import again: %s", err)
+	}
+	if bans != 0 || skippedBans != 6 || locations != 0 || skippedLocations != 2 {
+		t.Errorf("expected everything to be skipped, got: %d (skipped %d), %d (skipped %d)", bans, skippedBans, locations, skippedLocations)
+	}
+	if count := countAllLogs(t, db); count != 7 {
+		t.Errorf("expected 7 logs after importing twice, got: %d", count)
+	}
+
+	// imported ips are normalized
+	var mapped int64
+	if res := db.db.Unscoped().Model(&BanActionLog{}).Where("ip LIKE ?", "::ffff:%").Count(&mapped); res.Error != nil || mapped != 0 {
+		t.Errorf("expected no un-normalized ip, got: %d, %v", mapped, res.Error)
+	}
+}
+
+// pointer to given string for testing
+func ptrTo(s string) *string {
+	return &s
+}
+
+func TestGetReportAsTelegraphEscapes(t *testing.T) {
+	db := openTestDB(t)
+	db.SetHost("<b>host</b>")
+	saveTestBan(t, db, "sshd;region=<script>", "203.0.113.1", "Trinidad & Tobago")
+	if _, err := db.SaveLocation("203.0.113.1", GeoLocation{CountryName: "Trinidad & Tobago", Organization: "AT&T Services, Inc."}); err != nil {
+		t.Fatalf("failed to save location: %s", err)
+	}
+
+	report, err := db.GetReportAsTelegraph(nil, 0, reportOptions{FilterCountry: "trinidad & tobago"})
+	if err != nil {
+		t.Fatalf("failed to generate telegraph report: %s", err)
+	}
+	for _, escaped := range []string{"Trinidad &amp; Tobago", "AT&amp;T Services, Inc.", "&lt;b&gt;host&lt;/b&gt;", "sshd;region=&lt;script&gt;"} {
+		if !strings.Contains(string(report), escaped) {
+			t.Errorf("expected '%s' in telegraph report, got: %s", escaped, report)
+		}
+	}
+	for _, raw := range []string{"Trinidad & Tobago", "AT&T", "<b>host</b>", "<script>"} {
+		if strings.Contains(string(report), raw) {
+			t.Errorf("expected '%s' to be escaped in telegraph report, got: %s", raw, report)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// deliver.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// report deliverers
+const (
+	delivererTelegram = "telegram"
+
+	deliveryTimeoutSeconds = 30
+
+	telegramAPIBaseURL       = "https://api.telegram.org"
+	telegramMaxMessageLength = 4096 // in characters
+)
+
+// Deliverer delivers rendered reports (eg. to messengers)
+type Deliverer interface {
+	Deliver(ctx context.Context, report []byte) error
+}
+
+// telegramDeliverer sends reports as telegram messages
+type telegramDeliverer struct {
+	botToken string
+	chatID   string // eg. "123456789", "@channel_name"
+}
+
+// Deliver sends the report to the chat, split into messages of `telegramMaxMessageLength`
+func (d telegramDeliverer) Deliver(ctx context.Context, report []byte) (err error) {
+	url := fmt.Sprintf("%s/bot%s/sendMessage", telegramAPIBaseURL, d.botToken)
+
+	for _, message := range splitMessage(strings.TrimSpace(string(report)), telegramMaxMessageLength) {
+		var body []byte
+		if body, err = json.Marshal(map[string]string{
+			"chat_id": d.chatID,
+			"text":    message,
+		}); err != nil {
+			return err
+		}
+
+		var req *http.Request
+		if req, err = http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body)); err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		var res *http.Response
+		if res, err = http.DefaultClient.Do(req); err != nil {
+			// NOTE: don't leak the bot token in the url
+			return fmt.Errorf("failed to send message: %s", strings.ReplaceAll(err.Error(), d.botToken, redactedSecret))
+		}
+		resBody, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			return fmt.Errorf("telegram responded with status: %s (%s)", res.Status, strings.TrimSpace(string(resBody)))
+		}
+	}
+
+	return nil
+}
+
+// split given text into chunks of at most `maxLength` characters, preferably at newlines
+func splitMessage(text string, maxLength int) (chunks []string) {
+	chunks = []string{}
+
+	runes := []rune(text)
+	for len(runes) > maxLength {
+		end := maxLength
+		for i := maxLength - 1; i > 0; i-- {
+			if runes[i] == '\n' {
+				end = i
+				break
+			}
+		}
+
+		chunks = append(chunks, string(runes[:end]))
+		runes = runes[end:]
+		for len(runes) > 0 && runes[0] == '\n' {
+			runes = runes[1:]
+		}
+	}
+	if len(runes) > 0 {
+		chunks = append(chunks, string(runes))
+	}
+
+	return chunks
+}
+
+// deliver given report with the deliverer in `deliveryTimeoutSeconds`
+func deliverReport(deliverer Deliverer, report []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeoutSeconds*time.Second)
+	defer cancel()
+
+	return deliverer.Deliver(ctx, report)
+}
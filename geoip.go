@@ -0,0 +1,51 @@
+// geoip.go
+
+package main
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// lookup the location of given ip from a local MaxMind GeoLite2/GeoIP2 database (eg. `GeoLite2-Country.mmdb`)
+//
+// returns `found` = false if the ip was not in the database.
+// ips which are not global unicast addresses (eg. multicast) are returned as `unknownLocation` without lookup.
+func lookupGeoIPDatabase(dbPath, ip string) (location GeoLocation, found bool, err error) {
+	var addr netip.Addr
+	if addr, err = netip.ParseAddr(ip); err != nil {
+		return location, false, err
+	}
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() {
+		return GeoLocation{CountryName: unknownLocation}, true, nil
+	}
+
+	var reader *geoip2.Reader
+	if reader, err = geoip2.Open(dbPath); err != nil {
+		return location, false, err
+	}
+	defer reader.Close()
+
+	// NOTE: city lookups also work with country databases (city/region will be empty)
+	var record *geoip2.City
+	if record, err = reader.City(net.IP(addr.AsSlice())); err != nil {
+		return location, false, err
+	}
+
+	location.CountryName = record.Country.Names["en"]
+	if location.CountryName == "" {
+		location.CountryName = record.RegisteredCountry.Names["en"]
+	}
+	if location.CountryName == "" {
+		return location, false, nil
+	}
+	location.City = record.City.Names["en"]
+	if len(record.Subdivisions) > 0 {
+		location.Region = record.Subdivisions[0].Names["en"]
+	}
+
+	return location, true, nil
+}
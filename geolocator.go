@@ -0,0 +1,259 @@
+// geolocator.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/meinside/ipgeolocation.io-go"
+)
+
+// geolocation providers
+const (
+	geoProviderMaxMind       = "maxmind"       // local MaxMind database (with `geoip_database_path`)
+	geoProviderIPGeolocation = "ipgeolocation" // ipgeolocation.io (with `ipgeolocation_api_key`)
+	geoProviderIPAPI         = "ip-api"        // ip-api.com (free, no key)
+	geoProviderIPInfo        = "ipinfo"        // ipinfo.io (with `ipinfo_token`)
+
+	defaultGeoRequestTimeoutSeconds = 10
+
+	maxGeoResponseBytes    = 1024 * 1024 // responses larger than this will fail to be decoded
+	maxRawGeoResponseBytes = 64 * 1024   // raw responses larger than this won't be stored
+)
+
+// Geolocator looks up the location of an ip
+type Geolocator interface {
+	Locate(ctx context.Context, ip string) (GeoLocation, error)
+}
+
+// chainGeolocator tries its geolocators in order until one returns a country
+type chainGeolocator struct {
+	names       []string
+	geolocators []Geolocator
+
+	timeout time.Duration // timeout of each geolocator's lookup
+
+	storeRaw bool // keep raw responses of geolocators (for storing them in the database)
+}
+
+// Locate tries each geolocator in order; failing (or timed out) ones are logged and skipped
+func (c chainGeolocator) Locate(ctx context.Context, ip string) (location GeoLocation, err error) {
+	for i, geolocator := range c.geolocators {
+		var located GeoLocation
+		if located, err = c.locateWithTimeout(ctx, geolocator, ip); err != nil {
+			logWarn("Failed to lookup location with %s: %s", c.names[i], err)
+			continue
+		}
+		if located.CountryName != "" && located.CountryName != unknownLocation {
+			logDebug("Located '%s' with %s: %s", ip, c.names[i], located.CountryName)
+
+			if !c.storeRaw {
+				located.RawResponse = ""
+			} else if len(located.RawResponse) > maxRawGeoResponseBytes {
+				logWarn("Raw response of %s for '%s' is too large (%d bytes), so it won't be stored", c.names[i], ip, len(located.RawResponse))
+				located.RawResponse = ""
+			}
+			return located, nil
+		}
+	}
+
+	return GeoLocation{CountryName: unknownLocation}, err
+}
+
+// lookup with given geolocator in `timeout`
+func (c chainGeolocator) locateWithTimeout(ctx context.Context, geolocator Geolocator, ip string) (GeoLocation, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return geolocator.Locate(ctx, ip)
+}
+
+// new geolocator with given provider names in order, and the timeout of each lookup
+//
+// raw responses of geolocators are kept in located results only if `storeRaw` is true.
+func newChainGeolocator(providers []string, geolocAPIKey, geoIPDBPath, ipInfoToken *string, timeout time.Duration, storeRaw bool) (result chainGeolocator, err error) {
+	result.timeout = timeout
+	result.storeRaw = storeRaw
+
+	for _, provider := range providers {
+		var geolocator Geolocator
+		switch provider {
+		case geoProviderMaxMind:
+			if geoIPDBPath == nil || len(*geoIPDBPath) <= 0 {
+				return result, fmt.Errorf("`geoip_database_path` is required for geolocation provider '%s'", provider)
+			}
+			geolocator = maxMindGeolocator{dbPath: *geoIPDBPath}
+		case geoProviderIPGeolocation:
+			geolocator = ipGeolocationGeolocator{apiKey: geolocAPIKey}
+		case geoProviderIPAPI:
+			geolocator = ipAPIGeolocator{}
+		case geoProviderIPInfo:
+			if ipInfoToken == nil || len(*ipInfoToken) <= 0 {
+				return result, fmt.Errorf("`ipinfo_token` is required for geolocation provider '%s'", provider)
+			}
+			geolocator = ipInfoGeolocator{token: *ipInfoToken}
+		default:
+			return result, fmt.Errorf("unknown geolocation provider: '%s'", provider)
+		}
+
+		result.names = append(result.names, provider)
+		result.geolocators = append(result.geolocators, geolocator)
+	}
+
+	return result, nil
+}
+
+// maxMindGeolocator looks up locations from a local MaxMind database
+type maxMindGeolocator struct {
+	dbPath string
+}
+
+// Locate looks up the location from the local database
+func (g maxMindGeolocator) Locate(_ context.Context, ip string) (location GeoLocation, err error) {
+	var found bool
+	if location, found, err = lookupGeoIPDatabase(g.dbPath, ip); err == nil && !found {
+		location = GeoLocation{CountryName: unknownLocation}
+	}
+	return location, err
+}
+
+// ipGeolocationGeolocator looks up locations from ipgeolocation.io
+type ipGeolocationGeolocator struct {
+	apiKey *string
+}
+
+// Locate fetches the location from ipgeolocation.io
+func (g ipGeolocationGeolocator) Locate(ctx context.Context, ip string) (location GeoLocation, err error) {
+	if g.apiKey == nil {
+		return GeoLocation{CountryName: unknownLocation}, nil
+	}
+
+	// NOTE: the client doesn't support contexts, so give up waiting for it when `ctx` is done
+	type response struct {
+		result ipgeolocation.ResponseGeolocation
+		err    error
+	}
+	ch := make(chan response, 1)
+	go func() {
+		result, err := ipgeolocation.NewClient(*g.apiKey).GetGeolocation(ip)
+		ch <- response{result, err}
+	}()
+
+	var result ipgeolocation.ResponseGeolocation
+	select {
+	case <-ctx.Done():
+		return GeoLocation{CountryName: unknownLocation}, ctx.Err()
+	case res := <-ch:
+		if res.err != nil {
+			return GeoLocation{CountryName: unknownLocation}, res.err
+		}
+		result = res.result
+	}
+
+	// NOTE: the client doesn't expose the response body, so re-encode the decoded one
+	raw, _ := json.Marshal(result)
+
+	return GeoLocation{
+		CountryName: result.CountryName,
+		City:        result.City,
+		Region:      result.StateProvince,
+
+		ASN:          result.ASN, // NOTE: empty on free plans
+		Organization: result.Organization,
+
+		RawResponse: string(raw),
+	}, nil
+}
+
+// ipAPIGeolocator looks up locations from ip-api.com
+type ipAPIGeolocator struct{}
+
+// Locate fetches the location from ip-api.com
+func (g ipAPIGeolocator) Locate(ctx context.Context, ip string) (location GeoLocation, err error) {
+	var result struct {
+		Status     string `json:"status"`
+		Message    string `json:"message"`
+		Country    string `json:"country"`
+		RegionName string `json:"regionName"`
+		City       string `json:"city"`
+		AS         string `json:"as"` // eg. "AS15169 Google LLC"
+		Org        string `json:"org"`
+	}
+	raw, err := getJSON(ctx, fmt.Sprintf("http://ip-api.com/json/%s?fields=status,message,country,regionName,city,as,org", url.PathEscape(ip)), &result)
+	if err != nil {
+		return GeoLocation{CountryName: unknownLocation}, err
+	}
+	if result.Status != "success" {
+		return GeoLocation{CountryName: unknownLocation}, fmt.Errorf("lookup failed: %s", result.Message)
+	}
+
+	asn, _, _ := strings.Cut(result.AS, " ")
+	return GeoLocation{
+		CountryName: result.Country,
+		City:        result.City,
+		Region:      result.RegionName,
+
+		ASN:          asn,
+		Organization: result.Org,
+
+		RawResponse: string(raw),
+	}, nil
+}
+
+// ipInfoGeolocator looks up locations from ipinfo.io (lite api)
+type ipInfoGeolocator struct {
+	token string
+}
+
+// Locate fetches the location from ipinfo.io
+func (g ipInfoGeolocator) Locate(ctx context.Context, ip string) (location GeoLocation, err error) {
+	var result struct {
+		Country string `json:"country"`
+		ASN     string `json:"asn"`
+		ASName  string `json:"as_name"`
+	}
+	raw, err := getJSON(ctx, fmt.Sprintf("https://api.ipinfo.io/lite/%s?token=%s", url.PathEscape(ip), url.QueryEscape(g.token)), &result)
+	if err != nil {
+		return GeoLocation{CountryName: unknownLocation}, err
+	}
+
+	return GeoLocation{
+		CountryName: result.Country,
+
+		ASN:          result.ASN,
+		Organization: result.ASName,
+
+		RawResponse: string(raw),
+	}, nil
+}
+
+// get given url and decode its json response into `result`, returning the raw response
+func getJSON(ctx context.Context, url string, result any) (raw []byte, err error) {
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil); err != nil {
+		return nil, err
+	}
+
+	var res *http.Response
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("responded with status: %s", res.Status)
+	}
+
+	if raw, err = io.ReadAll(io.LimitReader(res.Body, maxGeoResponseBytes)); err != nil {
+		return nil, err
+	}
+
+	return raw, json.Unmarshal(raw, result)
+}
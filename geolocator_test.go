@@ -0,0 +1,73 @@
+// geolocator_test.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// geolocator which doesn't respond until its context is done
+type slowGeolocator struct{}
+
+func (g slowGeolocator) Locate(ctx context.Context, _ string) (GeoLocation, error) {
+	select {
+	case <-ctx.Done():
+		return GeoLocation{}, ctx.Err()
+	case <-time.After(10 * time.Second):
+		return GeoLocation{CountryName: "Japan"}, nil
+	}
+}
+
+func TestLocateWithTimeout(t *testing.T) {
+	chain := chainGeolocator{timeout: 100 * time.Millisecond}
+
+	start := time.Now()
+	_, err := chain.locateWithTimeout(context.Background(), slowGeolocator{}, "203.0.113.1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a timeout error, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("expected lookup to time out, took: %s", elapsed)
+	}
+}
+
+func TestChainGeolocatorTimeout(t *testing.T) {
+	located := []string{}
+
+	// timed-out geolocators are skipped
+	chain := chainGeolocator{
+		names:       []string{"slow", "stub"},
+		geolocators: []Geolocator{slowGeolocator{}, stubGeolocator{country: "Japan", located: &located}},
+		timeout:     100 * time.Millisecond,
+	}
+	if location, err := chain.Locate(context.Background(), "203.0.113.1"); err != nil || location.CountryName != "Japan" {
+		t.Errorf("expected location from the next geolocator, got: %+v, %v", location, err)
+	}
+
+	// and the location stays unknown if all of them time out
+	chain = chainGeolocator{
+		names:       []string{"slow"},
+		geolocators: []Geolocator{slowGeolocator{}},
+		timeout:     100 * time.Millisecond,
+	}
+	start := time.Now()
+	location, err := chain.Locate(context.Background(), "203.0.113.1")
+	if !errors.Is(err, context.DeadlineExceeded) || location.CountryName != unknownLocation {
+		t.Errorf("expected unknown location with a timeout error, got: %+v, %v", location, err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("expected lookup to time out, took: %s", elapsed)
+	}
+
+	// (to be resolved later)
+	db := openTestDB(t)
+	if location, err := resolveLocation(db, "203.0.113.1", saveOptions{Geolocator: chain}); err != nil || location != unknownLocation {
+		t.Errorf("expected unknown location after timeout, got: '%s', %v", location, err)
+	}
+	if unknowns, err := db.ListUnknownIPs(); err != nil || len(unknowns) != 1 {
+		t.Errorf("expected the ip to be cached as unknown, got: %v, %v", unknowns, err)
+	}
+}
@@ -0,0 +1,107 @@
+// hook.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const (
+	defaultPostSaveHookTimeoutSeconds = 10
+	postSaveHookWaitDelaySeconds      = 1
+
+	webhookTimeoutSeconds = 5
+)
+
+// run post-save hook command with the saved ban action's values as environment variables
+//
+// if `async` is true, it doesn't wait for the command to finish (and `timeoutSeconds` is not applied)
+func runPostSaveHook(command string, timeoutSeconds int, async bool, ip, protocol, country string) (err error) {
+	env := append(os.Environ(),
+		fmt.Sprintf("BALOG_IP=%s", ip),
+		fmt.Sprintf("BALOG_PROTOCOL=%s", protocol),
+		fmt.Sprintf("BALOG_COUNTRY=%s", country),
+	)
+
+	if async {
+		cmd := exec.Command("/bin/sh", "-c", command)
+		cmd.Env = env
+		if err = cmd.Start(); err == nil {
+			err = cmd.Process.Release()
+		}
+		return err
+	}
+
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = defaultPostSaveHookTimeoutSeconds
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = env
+	cmd.WaitDelay = postSaveHookWaitDelaySeconds * time.Second // NOTE: don't wait for the output of child processes after the timeout
+
+	var output []byte
+	if output, err = cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s (output: '%s')", err, string(output))
+	}
+
+	return nil
+}
+
+// webhookPayload is the json body posted to the webhook
+type webhookPayload struct {
+	IP        string    `json:"ip"`
+	Protocol  string    `json:"protocol"`
+	Country   string    `json:"country"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// post the saved ban action to the webhook url
+//
+// if `authHeader` is given, it is sent as the `Authorization` header (eg. "Bearer abcdefg")
+func postWebhook(url string, authHeader *string, ip, protocol, country string, timestamp time.Time) (err error) {
+	var body []byte
+	if body, err = json.Marshal(webhookPayload{
+		IP:        ip,
+		Protocol:  protocol,
+		Country:   country,
+		Timestamp: timestamp,
+	}); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeoutSeconds*time.Second)
+	defer cancel()
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body)); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if authHeader != nil && len(*authHeader) > 0 {
+		req.Header.Set("Authorization", *authHeader)
+	}
+
+	var res *http.Response
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status: %s", res.Status)
+	}
+
+	return nil
+}
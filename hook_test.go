@@ -0,0 +1,65 @@
+// hook_test.go
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunPostSaveHookEnv(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env")
+
+	if err := runPostSaveHook(`echo "$BALOG_IP $BALOG_PROTOCOL $BALOG_COUNTRY" > `+out, 0, false, "203.0.113.1", "sshd", "China"); err != nil {
+		t.Fatalf("failed to run hook: %s", err)
+	}
+	if bytes, err := os.ReadFile(out); err != nil {
+		t.Fatalf("failed to read output of hook: %s", err)
+	} else if str := strings.TrimSpace(string(bytes)); str != "203.0.113.1 sshd China" {
+		t.Errorf("unexpected environment variables of hook: '%s'", str)
+	}
+}
+
+func TestRunPostSaveHookFailure(t *testing.T) {
+	err := runPostSaveHook("echo failed; exit 1", 0, false, "203.0.113.1", "sshd", "China")
+	if err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Errorf("expected an error with the output of hook, got: %v", err)
+	}
+}
+
+func TestRunPostSaveHookTimeout(t *testing.T) {
+	start := time.Now()
+	if err := runPostSaveHook("sleep 10; true", 1, false, "203.0.113.1", "sshd", "China"); err == nil {
+		t.Errorf("expected an error from timed-out hook")
+	}
+	if elapsed := time.Since(start); elapsed >= 5*time.Second {
+		t.Errorf("expected hook to be killed after its timeout, took: %s", elapsed)
+	}
+}
+
+func TestRunPostSaveHookAsync(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env")
+
+	// returns without waiting for the command
+	start := time.Now()
+	if err := runPostSaveHook(`sleep 1; echo "$BALOG_IP" > `+out, 0, true, "203.0.113.1", "sshd", "China"); err != nil {
+		t.Fatalf("failed to run hook asynchronously: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("expected async hook not to be waited for, took: %s", elapsed)
+	}
+	if _, err := os.Stat(out); err == nil {
+		t.Errorf("expected async hook to be still running")
+	}
+
+	// but still run in the background
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if bytes, err := os.ReadFile(out); err == nil && strings.TrimSpace(string(bytes)) == "203.0.113.1" {
+			return
+		}
+	}
+	t.Errorf("expected async hook to be run in the background")
+}
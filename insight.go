@@ -0,0 +1,269 @@
+// insight.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	// google ai
+	"github.com/google/generative-ai-go/genai"
+	"github.com/googleapis/gax-go/v2/apierror"
+	"google.golang.org/grpc/codes"
+
+	// my libraries
+	gt "github.com/meinside/gemini-things-go"
+)
+
+// insight providers
+const (
+	insightProviderGemini = "gemini"
+	insightProviderOpenAI = "openai"
+
+	defaultOpenAIBaseURL = "https://api.openai.com/v1"
+
+	insightMaxAttempts          = 3
+	insightInitialBackoffMillis = 2000 // doubled on each retry
+)
+
+// generation datetimes of reports (eg. "generated on: 2024-03-01 12:34:56", `"generated_datetime":"..."`), ignored when hashing for the insight cache
+//
+// (matched regardless of their time formats, which can be changed with `-time-format`)
+var generatedDatetimeRegex = regexp.MustCompile(`(generated(?: on:? |_datetime":"))[^\n)"<]*`)
+
+// hash of the model, system instruction, and prompt (without the generation datetimes of reports) for caching insights
+func insightHash(model, system, prompt string) string {
+	hash := sha256.New()
+	for _, str := range []string{model, system, generatedDatetimeRegex.ReplaceAllString(prompt, "$1")} {
+		hash.Write([]byte(str))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// InsightProvider generates texts for insights with an AI model
+type InsightProvider interface {
+	Generate(ctx context.Context, system, prompt string) (string, error)
+}
+
+// InsightError is returned when an insight couldn't be generated
+type InsightError struct {
+	Attempts  int   // number of attempts made
+	Retryable bool  // true if the last failure was transient (eg. rate limited), false if permanent (eg. auth failure)
+	Err       error // the last error
+}
+
+// Error returns the message of the error
+func (e *InsightError) Error() string {
+	if e.Retryable {
+		return fmt.Sprintf("gave up after %d attempt(s): %s", e.Attempts, e.Err)
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the last error
+func (e *InsightError) Unwrap() error {
+	return e.Err
+}
+
+// httpStatusError is an error with the http status of a response
+type httpStatusError struct {
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+// Error returns the message of the error
+func (e httpStatusError) Error() string {
+	if len(e.Message) > 0 {
+		return fmt.Sprintf("responded with status: %s (%s)", e.Status, e.Message)
+	}
+	return fmt.Sprintf("responded with status: %s", e.Status)
+}
+
+// check if given error from an insight provider is transient (rate limited, or temporarily unavailable)
+func isRetryableInsightError(err error) bool {
+	isRetryableStatus := func(code int) bool {
+		return code == http.StatusTooManyRequests ||
+			code == http.StatusInternalServerError ||
+			code == http.StatusBadGateway ||
+			code == http.StatusServiceUnavailable ||
+			code == http.StatusGatewayTimeout
+	}
+
+	// from gemini
+	var apiErr *apierror.APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.HTTPCode() > 0 {
+			return isRetryableStatus(apiErr.HTTPCode())
+		}
+		if status := apiErr.GRPCStatus(); status != nil {
+			switch status.Code() {
+			case codes.ResourceExhausted, codes.Unavailable, codes.Internal:
+				return true
+			}
+		}
+		return false
+	}
+
+	// from openai-compatible apis
+	var statusErr httpStatusError
+	if errors.As(err, &statusErr) {
+		return isRetryableStatus(statusErr.StatusCode)
+	}
+
+	return false
+}
+
+// generate a text with given provider, retrying with exponential backoff on transient failures
+//
+// returns an `*InsightError` on failure.
+func generateWithRetry(ctx context.Context, provider InsightProvider, system, prompt string) (generated string, err error) {
+	backoff := insightInitialBackoffMillis * time.Millisecond
+
+	for attempt := 1; ; attempt++ {
+		if generated, err = provider.Generate(ctx, system, prompt); err == nil {
+			return generated, nil
+		}
+
+		retryable := isRetryableInsightError(err)
+		if !retryable || attempt >= insightMaxAttempts {
+			return "", &InsightError{Attempts: attempt, Retryable: retryable, Err: err}
+		}
+
+		logWarn("Failed to generate insights (attempt %d/%d), retrying in %s: %s", attempt, insightMaxAttempts, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return "", &InsightError{Attempts: attempt, Retryable: retryable, Err: err}
+		case <-time.After(backoff):
+			backoff *= 2
+		}
+	}
+}
+
+// geminiProvider generates insights with google ai (gemini) models
+type geminiProvider struct {
+	apiKey string
+	model  string
+}
+
+// Generate generates a text with gemini
+func (p geminiProvider) Generate(ctx context.Context, system, prompt string) (generated string, err error) {
+	// gemini-things client
+	var gtc *gt.Client
+	if gtc, err = gt.NewClient(p.apiKey, p.model); err != nil {
+		return "", fmt.Errorf("error initializing gemini-things client: %s", err)
+	}
+	defer gtc.Close()
+	gtc.SetTimeout(insightGenerationTimeoutSeconds)
+	gtc.SetSystemInstructionFunc(func() string {
+		return system
+	})
+
+	var res *genai.GenerateContentResponse
+	if res, err = gtc.Generate(ctx, prompt, nil); err != nil {
+		return "", err
+	}
+
+	return geminiResponseText(res), nil
+}
+
+// texts of the first candidate in given gemini response
+//
+// only text parts are used, other types of parts (eg. blobs, function calls) are ignored.
+func geminiResponseText(res *genai.GenerateContentResponse) (text string) {
+	if res != nil && len(res.Candidates) > 0 && res.Candidates[0].Content != nil {
+		for _, part := range res.Candidates[0].Content.Parts {
+			if t, ok := part.(genai.Text); ok {
+				text += string(t) + "\n"
+			}
+		}
+	}
+
+	return text
+}
+
+// openAIProvider generates insights with an OpenAI-compatible chat completions api (eg. OpenAI, Ollama)
+type openAIProvider struct {
+	baseURL string // eg. "https://api.openai.com/v1", "http://localhost:11434/v1"
+	apiKey  string // can be empty (eg. for Ollama)
+	model   string
+}
+
+// Generate generates a text with the chat completions api
+func (p openAIProvider) Generate(ctx context.Context, system, prompt string) (generated string, err error) {
+	type message struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	}
+
+	var body []byte
+	if body, err = json.Marshal(struct {
+		Model    string    `json:"model"`
+		Messages []message `json:"messages"`
+	}{
+		Model: p.model,
+		Messages: []message{
+			{Role: "system", Content: system},
+			{Role: "user", Content: prompt},
+		},
+	}); err != nil {
+		return "", err
+	}
+
+	url := strings.TrimSuffix(p.baseURL, "/") + "/chat/completions"
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body)); err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(p.apiKey) > 0 {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	var res *http.Response
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var result struct {
+		Choices []struct {
+			Message message `json:"message"`
+		} `json:"choices"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error,omitempty"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		statusErr := httpStatusError{StatusCode: res.StatusCode, Status: res.Status}
+		if err == nil && result.Error != nil {
+			statusErr.Message = result.Error.Message
+		}
+		return "", fmt.Errorf("chat completions api %w", statusErr)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to parse response (status: %s): %s", res.Status, err)
+	}
+	if result.Error != nil {
+		return "", fmt.Errorf("error from chat completions api: %s", result.Error.Message)
+	}
+
+	for _, choice := range result.Choices {
+		generated += choice.Message.Content + "\n"
+	}
+
+	return generated, nil
+}
@@ -0,0 +1,182 @@
+// insight_test.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// insight provider which returns given errors in order, and then succeeds
+type fakeInsightProvider struct {
+	errs     []error
+	attempts int
+}
+
+func (p *fakeInsightProvider) Generate(_ context.Context, _, _ string) (string, error) {
+	p.attempts++
+	if p.attempts <= len(p.errs) {
+		return "", p.errs[p.attempts-1]
+	}
+	return "generated insight", nil
+}
+
+func TestIsRetryableInsightError(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		retryable bool
+	}{
+		{httpStatusError{StatusCode: http.StatusTooManyRequests, Status: "429 Too Many Requests"}, true},
+		{fmt.Errorf("chat completions api %w", httpStatusError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}), true},
+		{httpStatusError{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized"}, false},
+		{httpStatusError{StatusCode: http.StatusBadRequest, Status: "400 Bad Request"}, false},
+		{errors.New("unknown error"), false},
+		{context.Canceled, false},
+	} {
+		if retryable := isRetryableInsightError(test.err); retryable != test.retryable {
+			t.Errorf("isRetryableInsightError(%v): expected %v, got %v", test.err, test.retryable, retryable)
+		}
+	}
+}
+
+func TestGenerateWithRetry(t *testing.T) {
+	// retried after being rate limited
+	provider := &fakeInsightProvider{errs: []error{
+		httpStatusError{StatusCode: http.StatusTooManyRequests, Status: "429 Too Many Requests"},
+	}}
+	if generated, err := generateWithRetry(context.Background(), provider, "system", "prompt"); err != nil {
+		t.Errorf("expected success after a retry, got error: %s", err)
+	} else if generated != "generated insight" {
+		t.Errorf("unexpected generated text: %q", generated)
+	}
+	if provider.attempts != 2 {
+		t.Errorf("expected 2 attempts, got: %d", provider.attempts)
+	}
+
+	// not retried on permanent failures
+	provider = &fakeInsightProvider{errs: []error{
+		httpStatusError{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized"},
+	}}
+	_, err := generateWithRetry(context.Background(), provider, "system", "prompt")
+	var insightErr *InsightError
+	if !errors.As(err, &insightErr) {
+		t.Fatalf("expected an *InsightError, got: %v", err)
+	}
+	if insightErr.Attempts != 1 || insightErr.Retryable {
+		t.Errorf("expected a permanent failure after 1 attempt, got: attempts = %d, retryable = %v", insightErr.Attempts, insightErr.Retryable)
+	}
+	var statusErr httpStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the status error to be unwrapped, got: %v", err)
+	}
+	if provider.attempts != 1 {
+		t.Errorf("expected 1 attempt, got: %d", provider.attempts)
+	}
+}
+
+// insight provider which blocks until the context is done
+type blockingInsightProvider struct {
+	started chan struct{}
+}
+
+func (p blockingInsightProvider) Generate(ctx context.Context, _, _ string) (string, error) {
+	close(p.started)
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestGenerateWithRetryCanceled(t *testing.T) {
+	// canceled in the middle of a generation
+	ctx, cancel := context.WithCancel(context.Background())
+	provider := blockingInsightProvider{started: make(chan struct{})}
+	go func() {
+		<-provider.started
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := generateWithRetry(ctx, provider, "system", "prompt")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancellation error, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to return promptly after cancellation, took: %s", elapsed)
+	}
+
+	// canceled while waiting for a retry
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start = time.Now()
+	_, err = generateWithRetry(ctx, &fakeInsightProvider{errs: []error{
+		httpStatusError{StatusCode: http.StatusTooManyRequests, Status: "429 Too Many Requests"},
+	}}, "system", "prompt")
+	var insightErr *InsightError
+	if !errors.As(err, &insightErr) || insightErr.Attempts != 1 {
+		t.Errorf("expected an *InsightError after 1 attempt, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to return promptly after cancellation, took: %s", elapsed)
+	}
+}
+
+func TestGeminiResponseText(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		res      *genai.GenerateContentResponse
+		expected string
+	}{
+		{
+			name:     "nil response",
+			res:      nil,
+			expected: "",
+		},
+		{
+			name:     "no candidates",
+			res:      &genai.GenerateContentResponse{},
+			expected: "",
+		},
+		{
+			name: "no content",
+			res: &genai.GenerateContentResponse{
+				Candidates: []*genai.Candidate{{}},
+			},
+			expected: "",
+		},
+		{
+			name: "mixed parts",
+			res: &genai.GenerateContentResponse{
+				Candidates: []*genai.Candidate{{
+					Content: &genai.Content{Parts: []genai.Part{
+						genai.Text("first"),
+						genai.Blob{MIMEType: "image/png", Data: []byte{0x89, 0x50}},
+						genai.FunctionCall{Name: "lookup"},
+						genai.Text("second"),
+					}},
+				}},
+			},
+			expected: "first\nsecond\n",
+		},
+		{
+			name: "non-text parts only",
+			res: &genai.GenerateContentResponse{
+				Candidates: []*genai.Candidate{{
+					Content: &genai.Content{Parts: []genai.Part{
+						genai.Blob{MIMEType: "image/png", Data: []byte{0x89, 0x50}},
+					}},
+				}},
+			},
+			expected: "",
+		},
+	} {
+		if text := geminiResponseText(test.res); text != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, text)
+		}
+	}
+}
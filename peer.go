@@ -0,0 +1,197 @@
+// peer.go
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// ratio to peer average for being flagged as an outlier (or its inverse)
+	peerOutlierRatio = 2.0
+
+	// minimum count (of this host or peer average) for being flagged as an outlier
+	peerOutlierMinCount = 5
+
+	// number of top countries to be compared with peers
+	peerNumTopCountries = 5
+)
+
+// PeerComparison represents a comparison of this host's report against peer hosts' reports
+type PeerComparison struct {
+	GeneratedDatetime string             `json:"generated_datetime"`
+	Peers             []string           `json:"peers"`
+	Windows           []WindowComparison `json:"windows"`
+}
+
+// WindowComparison represents a comparison of a window (sub report)
+type WindowComparison struct {
+	NumDays   int                   `json:"num_days"`
+	Total     DimensionComparison   `json:"total"`
+	Countries []DimensionComparison `json:"countries"`
+}
+
+// DimensionComparison represents a comparison of a dimension (eg. total count, count of a country)
+type DimensionComparison struct {
+	Key         string   `json:"key"`
+	Count       int      `json:"count"`
+	PeerAverage float64  `json:"peer_average"`
+	Ratio       *float64 `json:"ratio,omitempty"` // nil if peer average is 0
+	Outlier     bool     `json:"outlier"`
+}
+
+// load peers' json reports from given filepaths
+func loadPeerReports(filepaths []string) (reports []Report, err error) {
+	reports = []Report{}
+
+	for _, fpath := range filepaths {
+		var bytes []byte
+		if bytes, err = os.ReadFile(fpath); err != nil {
+			return nil, fmt.Errorf("failed to read peer report '%s': %s", fpath, err)
+		}
+
+		var report Report
+		if err = json.Unmarshal(bytes, &report); err != nil {
+			return nil, fmt.Errorf("failed to parse peer report '%s': %s", fpath, err)
+		}
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+// find the peer's window which matches given one
+//
+// windows are matched by their number of days, or by their positions if the peer report has no number of days
+func (r Report) matchingWindow(index int, window SubReport) (matched SubReport, exists bool) {
+	for i, peerWindow := range r.Windows {
+		if peerWindow.NumDays == 0 {
+			if i == index {
+				return peerWindow, true
+			}
+		} else if peerWindow.NumDays == window.NumDays {
+			return peerWindow, true
+		}
+	}
+
+	return matched, false
+}
+
+// compare this host's count with peers' average
+func compareDimension(key string, count int, peerCounts []int) DimensionComparison {
+	result := DimensionComparison{
+		Key:   key,
+		Count: count,
+	}
+
+	sum := 0
+	for _, c := range peerCounts {
+		sum += c
+	}
+	if len(peerCounts) > 0 {
+		result.PeerAverage = float64(sum) / float64(len(peerCounts))
+	}
+
+	if result.PeerAverage > 0 {
+		ratio := float64(count) / result.PeerAverage
+		result.Ratio = &ratio
+
+		if float64(count) >= peerOutlierMinCount || result.PeerAverage >= peerOutlierMinCount {
+			result.Outlier = ratio >= peerOutlierRatio || ratio <= 1/peerOutlierRatio
+		}
+	} else {
+		result.Outlier = count >= peerOutlierMinCount
+	}
+
+	return result
+}
+
+// compareWithPeers compares given report with peers' reports, aligning on common windows
+func compareWithPeers(report Report, peerNames []string, peers []Report) (result PeerComparison) {
+	result = PeerComparison{
+		GeneratedDatetime: report.GeneratedDatetime,
+		Peers:             peerNames,
+		Windows:           []WindowComparison{},
+	}
+
+	for i, window := range report.Windows {
+		// collect peers' windows which match this one
+		peerWindows := []SubReport{}
+		for _, peer := range peers {
+			if matched, exists := peer.matchingWindow(i, window); exists {
+				peerWindows = append(peerWindows, matched)
+			}
+		}
+		if len(peerWindows) <= 0 {
+			continue
+		}
+
+		// totals
+		peerTotals := []int{}
+		for _, peerWindow := range peerWindows {
+			peerTotals = append(peerTotals, peerWindow.TotalCount)
+		}
+		comparison := WindowComparison{
+			NumDays:   window.NumDays,
+			Total:     compareDimension("Total", window.TotalCount, peerTotals),
+			Countries: []DimensionComparison{},
+		}
+
+		// top countries
+		for j, kv := range sortKeyValues(window.CountryCounts, sortByCount) {
+			if j >= peerNumTopCountries {
+				break
+			}
+
+			peerCounts := []int{}
+			for _, peerWindow := range peerWindows {
+				count, _ := peerWindow.CountryCounts.Get(kv.Key)
+				peerCounts = append(peerCounts, count)
+			}
+			comparison.Countries = append(comparison.Countries, compareDimension(kv.Key, kv.Value, peerCounts))
+		}
+
+		result.Windows = append(result.Windows, comparison)
+	}
+
+	return result
+}
+
+// format peer comparison as plain text
+func (c PeerComparison) plain() string {
+	line := func(prefix string, dc DimensionComparison) string {
+		ratio := "-"
+		if dc.Ratio != nil {
+			ratio = fmt.Sprintf("x%.2f", *dc.Ratio)
+		}
+		flag := ""
+		if dc.Outlier {
+			flag = " (!) outlier"
+		}
+		return fmt.Sprintf("%s%s: %d (peer average: %.1f, %s)%s", prefix, dc.Key, dc.Count, dc.PeerAverage, ratio, flag)
+	}
+
+	sections := []string{}
+	for _, window := range c.Windows {
+		countries := []string{}
+		for _, country := range window.Countries {
+			countries = append(countries, line("  ", country))
+		}
+
+		sections = append(sections, fmt.Sprintf(`> Last %[1]d days:
+---
+%[2]s
+
+* Top Originating Countries:
+%[3]s`, window.NumDays, line("* ", window.Total), strings.Join(countries, "\n")))
+	}
+
+	return fmt.Sprintf(`
+>>> Comparison with %[2]d peer(s) generated on: %[1]s
+
+%[3]s
+`, c.GeneratedDatetime, len(c.Peers), strings.Join(sections, "\n\n\n"))
+}
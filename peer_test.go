@@ -0,0 +1,120 @@
+// peer_test.go
+
+package main
+
+import (
+	"testing"
+)
+
+func TestMatchingWindow(t *testing.T) {
+	window := SubReport{NumDays: 30}
+
+	// matched by number of days, regardless of positions
+	peer := Report{Windows: []SubReport{{NumDays: 7, TotalCount: 1}, {NumDays: 30, TotalCount: 2}}}
+	if matched, exists := peer.matchingWindow(0, window); !exists || matched.TotalCount != 2 {
+		t.Errorf("expected the window of 30 days to be matched, got: %+v, %v", matched, exists)
+	}
+
+	// not matched when there is no window of the same number of days
+	peer = Report{Windows: []SubReport{{NumDays: 7}}}
+	if matched, exists := peer.matchingWindow(0, window); exists {
+		t.Errorf("expected no matching window, got: %+v", matched)
+	}
+
+	// matched by positions when number of days are missing
+	peer = Report{Windows: []SubReport{{TotalCount: 1}, {TotalCount: 2}}}
+	if matched, exists := peer.matchingWindow(1, window); !exists || matched.TotalCount != 2 {
+		t.Errorf("expected the second window to be matched, got: %+v, %v", matched, exists)
+	}
+	if matched, exists := peer.matchingWindow(2, window); exists {
+		t.Errorf("expected no matching window out of range, got: %+v", matched)
+	}
+}
+
+// pointer to given float for testing
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func TestCompareDimension(t *testing.T) {
+	for _, test := range []struct {
+		count      int
+		peerCounts []int
+		average    float64
+		ratio      *float64
+		outlier    bool
+	}{
+		{20, []int{4, 6}, 5, floatPtr(4.0), true},   // much more than peers
+		{1, []int{10, 10}, 10, floatPtr(0.1), true}, // much less than peers
+		{6, []int{4, 6}, 5, floatPtr(1.2), false},   // similar to peers
+		{2, []int{0, 1}, 0.5, floatPtr(4.0), false}, // too few to be flagged
+		{5, []int{0, 0}, 0, nil, true},              // not seen by peers
+		{4, []int{0, 0}, 0, nil, false},             // not seen by peers, but too few
+		{3, []int{}, 0, nil, false},                 // no peer
+	} {
+		result := compareDimension("key", test.count, test.peerCounts)
+		if result.PeerAverage != test.average {
+			t.Errorf("expected peer average %.1f for %d vs %v, got: %.1f", test.average, test.count, test.peerCounts, result.PeerAverage)
+		}
+		if (result.Ratio == nil) != (test.ratio == nil) || (result.Ratio != nil && *result.Ratio != *test.ratio) {
+			t.Errorf("expected ratio %v for %d vs %v, got: %v", test.ratio, test.count, test.peerCounts, result.Ratio)
+		}
+		if result.Outlier != test.outlier {
+			t.Errorf("expected outlier to be %v for %d vs %v", test.outlier, test.count, test.peerCounts)
+		}
+	}
+}
+
+func TestCompareWithPeers(t *testing.T) {
+	report := Report{
+		GeneratedDatetime: "2024-03-01 00:00:00",
+		Windows: []SubReport{
+			{NumDays: 7, TotalCount: 10, CountryCounts: KeyValues{{"China", 9}, {"Japan", 1}}},
+			{NumDays: 30, TotalCount: 40, CountryCounts: KeyValues{{"China", 30}, {"Japan", 10}}},
+			{NumDays: 90, TotalCount: 100, CountryCounts: KeyValues{{"China", 100}}},
+		},
+	}
+	peers := []Report{
+		// only with a window of 30 days
+		{Windows: []SubReport{{NumDays: 30, TotalCount: 20, CountryCounts: KeyValues{{"Japan", 20}}}}},
+		// without number of days (matched by positions)
+		{Windows: []SubReport{
+			{TotalCount: 10, CountryCounts: KeyValues{{"China", 1}, {"Japan", 9}}},
+			{TotalCount: 40, CountryCounts: KeyValues{{"China", 10}, {"Japan", 30}}},
+		}},
+	}
+
+	result := compareWithPeers(report, []string{"peer1", "peer2"}, peers)
+
+	// window of 90 days is skipped, as no peer has it
+	if len(result.Windows) != 2 {
+		t.Fatalf("expected 2 compared windows, got: %d", len(result.Windows))
+	}
+
+	// window of 7 days: compared with the second peer only
+	week := result.Windows[0]
+	if week.NumDays != 7 || week.Total.PeerAverage != 10 || week.Total.Outlier {
+		t.Errorf("unexpected comparison of total in 7 days: %+v", week.Total)
+	}
+	if len(week.Countries) != 2 || week.Countries[0].Key != "China" || !week.Countries[0].Outlier {
+		t.Errorf("expected China to be an outlier in 7 days, got: %+v", week.Countries)
+	}
+
+	// window of 30 days: compared with both peers
+	month := result.Windows[1]
+	if month.NumDays != 30 || month.Total.PeerAverage != 30 {
+		t.Errorf("unexpected comparison of total in 30 days: %+v", month.Total)
+	}
+	for _, country := range month.Countries {
+		switch country.Key {
+		case "China":
+			if country.PeerAverage != 5 || !country.Outlier {
+				t.Errorf("expected China to be an outlier in 30 days, got: %+v", country)
+			}
+		case "Japan":
+			if country.PeerAverage != 25 || !country.Outlier {
+				t.Errorf("expected Japan to be an outlier in 30 days, got: %+v", country)
+			}
+		}
+	}
+}
@@ -3,20 +3,26 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/fs"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	// google ai
-	"github.com/google/generative-ai-go/genai"
-
 	// hujson
 	"github.com/tailscale/hujson"
 
@@ -25,7 +31,6 @@ import (
 	"github.com/infisical/go-sdk/packages/models"
 
 	// my libraries
-	gt "github.com/meinside/gemini-things-go"
 	"github.com/meinside/telegraph-go"
 	"github.com/meinside/version-go"
 )
@@ -38,26 +43,104 @@ const (
 	defaultConfigFilename = "config.json"
 	defaultDBFilename     = "database.db"
 
+	redactedSecret = "***redacted***"
+
 	// number of days for reporting
-	numDaysForReport1           = 7  // last 7 days
-	numDaysForReport2           = 30 // last 30 days
-	numDaysBeforeForOlderReport = 7  // older report = 7 days before
+	numDaysBeforeForOlderReport = 7 // older report = 7 days before
+
+	// default threshold for detecting gaps in logging
+	defaultGapThresholdHours = 24
+
+	// number of saves between checks of `max_log_rows`
+	logRowsCheckInterval = 100
+
+	// number of sample ips in audit results
+	numSampleIPsForAudit = 10
+
+	// exit code of save action with `-strict` when the location is unknown
+	exitCodeUnknownLocation = 2
+)
+
+// environment variables which take precedence over config values
+const (
+	envDBFilepath          = "BALOG_DB_FILEPATH"
+	envTelegraphToken      = "BALOG_TELEGRAPH_TOKEN"
+	envIPGeolocationAPIKey = "BALOG_IPGEOLOCATION_KEY"
+	envGoogleAIAPIKey      = "BALOG_GOOGLE_AI_KEY"
+	envHost                = "BALOG_HOST"
+	envLogLevel            = "BALOG_LOG_LEVEL"
 )
 
 const (
 	insightGenerationTimeoutSeconds = 60 * 3 // 3 minutes
 
 	systemInstructionForInsightGeneration = `You are a chatbot which analyzes fail2ban ban action logs and IP-based geolocation data to generate insights for the user. Offer system or security insights based on the analysis. Highlight and explain any unusual patterns or noteworthy findings. Your response must be in plain text, so do not try to emphasize words with markdown characters.`
+
+	// %[1]s: older report, %[2]s: recent report
+	promptTemplateForInsightGeneration = `Following are summarized reports of ban action logs and the geolocations of the logs.
+Analyze these reports and offer system or security insights based on the analysis.
+Highlight and explain any unusual patterns or noteworthy findings.
+
+<older_report>
+%[1]s
+</older_report>
+
+<recent_report>
+%[2]s
+</recent_report>`
 )
 
 // param names
 const (
-	paramConfig   = "config"
-	paramAction   = "action"
-	paramIP       = "ip"
-	paramProtocol = "protocol"
-	paramFormat   = "format"
-	paramJob      = "job"
+	paramConfig     = "config"
+	paramDB         = "db"
+	paramAction     = "action"
+	paramIP         = "ip"
+	paramProtocol   = "protocol"
+	paramJail       = "jail"
+	paramHost       = "host"
+	paramFormat     = "format"
+	paramJob        = "job"
+	paramGroupBy    = "group-by"
+	paramSort       = "sort"
+	paramMax        = "max"
+	paramLimit      = "limit"
+	paramOffset     = "offset"
+	paramRPS        = "rps"
+	paramPeer       = "peer"
+	paramCompare    = "compare"
+	paramCIDR       = "cidr"
+	paramFile       = "file"
+	paramShowPrompt = "show-prompt"
+	paramDays       = "days"
+	paramReportDays = "report-days"
+	paramSince      = "since"
+	paramUntil      = "until"
+	paramDryRun     = "dry-run"
+	paramStrict     = "strict"
+	paramDedupe     = "dedupe-window"
+	paramTop        = "top"
+	paramAnonymize  = "anonymize"
+	paramTimeseries = "timeseries"
+	paramISOCodes   = "iso-codes"
+	paramTZ         = "tz"
+	paramTimeFormat = "time-format"
+	paramMinCount   = "min-count"
+	paramInsight    = "insight"
+	paramNoInsight  = "no-insight"
+
+	paramVersion = "version"
+	paramOut     = "out"
+	paramAppend  = "append"
+	paramDeliver = "deliver"
+	paramFrom    = "from"
+
+	paramWithLocation = "with-location"
+
+	paramLogLevel = "log-level"
+
+	paramFilterProtocol = "filter-protocol"
+	paramFilterCountry  = "filter-country"
 )
 
 type action string
@@ -67,6 +150,12 @@ const (
 	actionSave        action = "save"
 	actionReport      action = "report"
 	actionMaintenance action = "maintenance"
+	actionConfig      action = "config"
+	actionValidate    action = "validate"
+	actionVersion     action = "version"
+	actionQuery       action = "query"
+	actionUnban       action = "unban"
+	actionStats       action = "stats"
 )
 
 type reportFormat string
@@ -76,6 +165,9 @@ const (
 	reportFormatPlain     reportFormat = "plain"
 	reportFormatJSON      reportFormat = "json"
 	reportFormatTelegraph reportFormat = "telegraph"
+	reportFormatMsgpack   reportFormat = "msgpack"
+	reportFormatMarkdown  reportFormat = "markdown"
+	reportFormatHTML      reportFormat = "html"
 )
 
 type maintenanceJob string
@@ -85,16 +177,128 @@ const (
 	maintenanceJobListUnknownIPs    maintenanceJob = "list_unknown_ips"
 	maintenanceJobResolveUnknownIPs maintenanceJob = "resolve_unknown_ips"
 	maintenanceJobPurgeLogs         maintenanceJob = "purge_logs"
+	maintenanceJobStatsLocations    maintenanceJob = "stats_locations"
+	maintenanceJobDetectGaps        maintenanceJob = "detect_gaps"
+	maintenanceJobApplyRetention    maintenanceJob = "apply_retention"
+	maintenanceJobAnonymizeOld      maintenanceJob = "anonymize_old"
+	maintenanceJobAuditLocations    maintenanceJob = "audit_locations"
+	maintenanceJobExport            maintenanceJob = "export"
+	maintenanceJobImport            maintenanceJob = "import"
+	maintenanceJobResolveSingle     maintenanceJob = "resolve_single"
+	maintenanceJobSyncLocations     maintenanceJob = "sync_locations"
+	maintenanceJobVacuum            maintenanceJob = "vacuum"
+	maintenanceJobDedupeLocations   maintenanceJob = "dedupe_locations"
+	maintenanceJobDeleteIP          maintenanceJob = "delete_ip"
 )
 
 // config struct
 type config struct {
 	DBFilepath *string `json:"db_filepath,omitempty"`
 
+	// sqlite options for plain `db_filepath`s (default: 5000 and "WAL")
+	DBBusyTimeoutMillis int    `json:"db_busy_timeout_ms,omitempty"`
+	DBJournalMode       string `json:"db_journal_mode,omitempty"`
+
 	// API tokens and keys
 	TelegraphAccessToken *string `json:"telegraph_access_token,omitempty"`
 	IPGeolocationAPIKey  *string `json:"ipgeolocation_api_key,omitempty"`
+	AbuseIPDBKey         *string `json:"abuseipdb_key,omitempty"` // for fetching abuse confidence scores of ips when saving
 	GoogleAIAPIKey       *string `json:"google_ai_api_key,omitempty"`
+	GoogleAIModel        *string `json:"google_ai_model,omitempty"` // default: `defaultGoogleAIModel`
+
+	// provider for insight generation: "gemini" (default; with `google_ai_api_key`),
+	// or "openai" (with any OpenAI-compatible api, eg. Ollama)
+	InsightProvider string  `json:"insight_provider,omitempty"`
+	OpenAIBaseURL   *string `json:"openai_base_url,omitempty"` // default: "https://api.openai.com/v1" (eg. "http://localhost:11434/v1" for Ollama)
+	OpenAIModel     *string `json:"openai_model,omitempty"`
+	OpenAIAPIKey    *string `json:"openai_api_key,omitempty"` // not needed for Ollama
+
+	// custom system instruction and prompt template for insight generation (default: security-focused ones)
+	// (prompt template should contain `%[1]s` and `%[2]s` for older and recent reports)
+	InsightSystemInstruction *string `json:"insight_system_instruction,omitempty"`
+	InsightPromptTemplate    *string `json:"insight_prompt_template,omitempty"`
+
+	// filepath of a local MaxMind GeoLite2/GeoIP2 database (eg. `GeoLite2-Country.mmdb`),
+	// preferred over ipgeolocation.io if set
+	GeoIPDatabasePath *string `json:"geoip_database_path,omitempty"`
+
+	// token for ipinfo.io
+	IPInfoToken *string `json:"ipinfo_token,omitempty"`
+
+	// for delivering reports to a telegram chat (with `-deliver telegram`)
+	TelegramBotToken *string `json:"telegram_bot_token,omitempty"`
+	TelegramChatID   *string `json:"telegram_chat_id,omitempty"` // eg. "123456789", "@channel_name"
+
+	// geolocation providers to be tried in order (maxmind, ipgeolocation, ip-api, ipinfo)
+	// (default: maxmind if `geoip_database_path` is set, then ipgeolocation)
+	GeoProviders []string `json:"geo_providers,omitempty"`
+
+	// timeout of each geolocation request (default: 10)
+	GeoRequestTimeoutSeconds int `json:"geo_request_timeout_seconds,omitempty"`
+
+	// store raw responses of geolocation providers with cached locations (for re-deriving values later without new requests)
+	StoreRawGeolocation bool `json:"store_raw_geolocation,omitempty"`
+
+	// regular expression with named capture groups for parsing protocol strings
+	// (eg. `^(?P<protocol>[^|]+)\|(?P<region>.+)$`)
+	ProtocolParseRegex *string `json:"protocol_parse_regex,omitempty"`
+
+	// if true, locations of newly-seen ips won't be fetched on save (resolve them later with `resolve_unknown_ips`)
+	SaveDeferGeolocation bool `json:"save_defer_geolocation,omitempty"`
+
+	// command to run after each successful save (with env vars: BALOG_IP, BALOG_PROTOCOL, and BALOG_COUNTRY)
+	PostSaveHook               *string `json:"post_save_hook,omitempty"`
+	PostSaveHookTimeoutSeconds int     `json:"post_save_hook_timeout_seconds,omitempty"` // default: 10
+	PostSaveHookAsync          bool    `json:"post_save_hook_async,omitempty"`           // if true, don't wait for the command
+
+	// url to post each saved ban action to (as json: ip, protocol, country, and timestamp)
+	WebhookURL        *string `json:"webhook_url,omitempty"`
+	WebhookAuthHeader *string `json:"webhook_auth_header,omitempty"` // value of `Authorization` header (eg. "Bearer abcdefg")
+
+	// default sort order of reports (count, count-asc, name)
+	ReportSort *string `json:"report_sort,omitempty"`
+
+	// number of days of windows to be included in telegraph reports (eg. [7])
+	TelegraphWindows []int `json:"telegraph_windows,omitempty"`
+
+	// if true, empty reports won't be posted to telegra.ph
+	TelegraphSkipEmpty bool `json:"telegraph_skip_empty,omitempty"`
+
+	// settings for detecting gaps in logging
+	GapThresholdHours *int  `json:"gap_threshold_hours,omitempty"` // default: 24
+	GapQuietHours     []int `json:"gap_quiet_hours,omitempty"`     // hours of day (0-23) with no ban actions expected
+
+	// names of countries where legitimate accesses come from (bans from them will be flagged in reports)
+	TrustedCountries []string `json:"trusted_countries,omitempty"`
+
+	// ips and cidrs whose ban actions won't be logged at all (eg. ["192.0.2.1", "198.51.100.0/24"])
+	Whitelist []string `json:"whitelist,omitempty"`
+
+	// protocols of fail2ban jails, for saving ban actions with `-jail` but without `-protocol` (eg. {"sshd": "ssh"})
+	// (jail names will be used as protocols if not listed)
+	JailProtocolMap map[string]string `json:"jail_protocol_map,omitempty"`
+
+	// enabled sections of reports in order (total, protocols, countries, cities, networks, top_ips, groups, trusted, insight)
+	ReportSections []string `json:"report_sections,omitempty"`
+
+	// retention policies (in number of days) for `apply_retention` job
+	RetentionDays       *int           `json:"retention_days,omitempty"`        // default for all protocols (kept forever if not set)
+	RetentionByProtocol map[string]int `json:"retention_by_protocol,omitempty"` // per-protocol overrides
+
+	// ips of logs older than this number of days will be masked by `anonymize_old` job
+	AnonymizeAfterDays *int `json:"anonymize_after_days,omitempty"`
+
+	// maximum number of logs to keep (oldest ones will be deleted when exceeded, checked every 100 saves)
+	MaxLogRows int64 `json:"max_log_rows,omitempty"`
+
+	// hours to wait before retrying an ip which failed to be resolved by `resolve_unknown_ips` (default: 24)
+	ResolveRetryHours *int `json:"resolve_retry_hours,omitempty"`
+
+	// number of failures after which an ip won't be retried by `resolve_unknown_ips` (default: 5, 0 for no limit)
+	ResolveMaxFailures *int `json:"resolve_max_failures,omitempty"`
+
+	// hours to reuse a generated insight for identical reports (default: 24, 0 for no caching)
+	InsightCacheTTLHours *int `json:"insight_cache_ttl_hours,omitempty"`
 
 	// or Infisical settings
 	Infisical *struct {
@@ -112,6 +316,58 @@ type config struct {
 	} `json:"infisical,omitempty"`
 }
 
+// returns a copy of the config with its secrets redacted
+func (c config) redacted() config {
+	c.TelegraphAccessToken = redact(c.TelegraphAccessToken)
+	c.IPGeolocationAPIKey = redact(c.IPGeolocationAPIKey)
+	c.GoogleAIAPIKey = redact(c.GoogleAIAPIKey)
+	c.IPInfoToken = redact(c.IPInfoToken)
+	c.AbuseIPDBKey = redact(c.AbuseIPDBKey)
+	c.TelegramBotToken = redact(c.TelegramBotToken)
+	c.OpenAIAPIKey = redact(c.OpenAIAPIKey)
+	c.WebhookAuthHeader = redact(c.WebhookAuthHeader)
+	c.WebhookURL = redactURL(c.WebhookURL) // (eg. slack or discord webhook urls have secrets in their paths)
+
+	if c.Infisical != nil {
+		infisical := *c.Infisical
+		infisical.ClientSecret = *redact(&infisical.ClientSecret)
+		c.Infisical = &infisical
+	}
+
+	return c
+}
+
+// redact given secret, leaving only its last 4 characters (if it is long enough)
+func redact(secret *string) *string {
+	if secret == nil || len(*secret) <= 0 {
+		return secret
+	}
+
+	redacted := redactedSecret
+	if len(*secret) >= 16 {
+		redacted += (*secret)[len(*secret)-4:]
+	}
+	return &redacted
+}
+
+// redact the path, query, and user info of given url, leaving only its scheme and host
+func redactURL(secret *string) *string {
+	if secret == nil || len(*secret) <= 0 {
+		return secret
+	}
+
+	u, err := url.Parse(*secret)
+	if err != nil || len(u.Host) <= 0 {
+		return redact(secret)
+	}
+	if len(u.Path) <= 0 && len(u.RawQuery) <= 0 && len(u.Fragment) <= 0 && u.User == nil {
+		return secret
+	}
+
+	redacted := fmt.Sprintf("%s://%s/%s", u.Scheme, u.Host, redactedSecret)
+	return &redacted
+}
+
 // standardize given JSON (JWCC) bytes
 func standardizeJSON(b []byte) ([]byte, error) {
 	ast, err := hujson.Parse(b)
@@ -134,7 +390,7 @@ func (c *config) GetTelegraphAccessToken() (accessToken *string, err error) {
 
 		_, err = client.Auth().UniversalAuthLogin(c.Infisical.ClientID, c.Infisical.ClientSecret)
 		if err != nil {
-			fmt.Printf("* failed to authenticate with Infisical: %s", err)
+			logError("Failed to authenticate with Infisical: %s", err)
 			return nil, err
 		}
 
@@ -149,7 +405,7 @@ func (c *config) GetTelegraphAccessToken() (accessToken *string, err error) {
 			Environment: c.Infisical.Environment,
 		})
 		if err != nil {
-			fmt.Printf("* failed to retrieve telegraph access token from infisical: %s\n", err)
+			logError("Failed to retrieve telegraph access token from infisical: %s", err)
 			return nil, err
 		}
 
@@ -171,7 +427,7 @@ func (c *config) GetIPGeolocationAPIKey() (apiKey *string, err error) {
 
 		_, err = client.Auth().UniversalAuthLogin(c.Infisical.ClientID, c.Infisical.ClientSecret)
 		if err != nil {
-			fmt.Printf("* failed to authenticate with Infisical: %s", err)
+			logError("Failed to authenticate with Infisical: %s", err)
 			return nil, err
 		}
 
@@ -186,7 +442,7 @@ func (c *config) GetIPGeolocationAPIKey() (apiKey *string, err error) {
 			Environment: c.Infisical.Environment,
 		})
 		if err != nil {
-			fmt.Printf("* failed to retrieve ip geolocation api key from infisical: %s\n", err)
+			logError("Failed to retrieve ip geolocation api key from infisical: %s", err)
 			return nil, err
 		}
 
@@ -196,6 +452,67 @@ func (c *config) GetIPGeolocationAPIKey() (apiKey *string, err error) {
 	return c.IPGeolocationAPIKey, nil
 }
 
+// get the protocol of given fail2ban jail (the jail name itself if not mapped in `jail_protocol_map`)
+func (c *config) protocolOfJail(jail string) string {
+	if protocol, exists := c.JailProtocolMap[jail]; exists && len(protocol) > 0 {
+		return protocol
+	}
+	return jail
+}
+
+// get backoff for retrying failed lookups of unknown ips
+func (c *config) resolveBackoff() resolveBackoff {
+	backoff := resolveBackoff{
+		RetryAfter:  defaultResolveRetryHours * time.Hour,
+		MaxFailures: defaultResolveMaxFailures,
+	}
+	if c.ResolveRetryHours != nil {
+		backoff.RetryAfter = time.Duration(*c.ResolveRetryHours) * time.Hour
+	}
+	if c.ResolveMaxFailures != nil {
+		backoff.MaxFailures = *c.ResolveMaxFailures
+	}
+
+	return backoff
+}
+
+// get geolocator with configured providers
+func (c *config) GetGeolocator() (geolocator Geolocator, err error) {
+	providers := c.GeoProviders
+	if len(providers) <= 0 {
+		if c.GeoIPDatabasePath != nil && len(*c.GeoIPDatabasePath) > 0 {
+			providers = append(providers, geoProviderMaxMind)
+		}
+		providers = append(providers, geoProviderIPGeolocation)
+	}
+
+	apiKey, _ := c.GetIPGeolocationAPIKey()
+
+	timeout := defaultGeoRequestTimeoutSeconds * time.Second
+	if c.GeoRequestTimeoutSeconds > 0 {
+		timeout = time.Duration(c.GeoRequestTimeoutSeconds) * time.Second
+	}
+
+	return newChainGeolocator(providers, apiKey, c.GeoIPDatabasePath, c.IPInfoToken, timeout, c.StoreRawGeolocation)
+}
+
+// get the report deliverer of given name
+func (c *config) GetDeliverer(name string) (deliverer Deliverer, err error) {
+	switch name {
+	case delivererTelegram:
+		if c.TelegramBotToken == nil || len(*c.TelegramBotToken) <= 0 ||
+			c.TelegramChatID == nil || len(*c.TelegramChatID) <= 0 {
+			return nil, fmt.Errorf("`telegram_bot_token` and `telegram_chat_id` are required for deliverer '%s'", name)
+		}
+		return telegramDeliverer{
+			botToken: *c.TelegramBotToken,
+			chatID:   *c.TelegramChatID,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown deliverer: '%s'", name)
+	}
+}
+
 // get google ai api key, retrieve it from infisical if needed
 func (c *config) GetGoogleAIAPIKey() (apiKey *string, err error) {
 	// read api key from infisical
@@ -208,7 +525,7 @@ func (c *config) GetGoogleAIAPIKey() (apiKey *string, err error) {
 
 		_, err = client.Auth().UniversalAuthLogin(c.Infisical.ClientID, c.Infisical.ClientSecret)
 		if err != nil {
-			fmt.Printf("* failed to authenticate with Infisical: %s", err)
+			logError("Failed to authenticate with Infisical: %s", err)
 			return nil, err
 		}
 
@@ -223,7 +540,7 @@ func (c *config) GetGoogleAIAPIKey() (apiKey *string, err error) {
 			Environment: c.Infisical.Environment,
 		})
 		if err != nil {
-			fmt.Printf("* failed to retrieve google ai api key from infisical: %s\n", err)
+			logError("Failed to retrieve google ai api key from infisical: %s", err)
 			return nil, err
 		}
 
@@ -233,6 +550,105 @@ func (c *config) GetGoogleAIAPIKey() (apiKey *string, err error) {
 	return c.GoogleAIAPIKey, err
 }
 
+// get the system instruction and prompt template for insight generation (default ones if not configured)
+func (c *config) GetInsightPrompts() (systemInstruction, promptTemplate string, err error) {
+	systemInstruction, promptTemplate = systemInstructionForInsightGeneration, promptTemplateForInsightGeneration
+
+	if c.InsightSystemInstruction != nil && len(*c.InsightSystemInstruction) > 0 {
+		systemInstruction = *c.InsightSystemInstruction
+	}
+	if c.InsightPromptTemplate != nil && len(*c.InsightPromptTemplate) > 0 {
+		for _, placeholder := range []string{"%[1]s", "%[2]s"} {
+			if !strings.Contains(*c.InsightPromptTemplate, placeholder) {
+				return "", "", fmt.Errorf("`insight_prompt_template` should contain '%s'", placeholder)
+			}
+		}
+		promptTemplate = *c.InsightPromptTemplate
+	}
+
+	return systemInstruction, promptTemplate, nil
+}
+
+// get the configured insight provider and its model name (provider will be nil if not configured)
+func (c *config) GetInsightProvider() (provider InsightProvider, model string, err error) {
+	switch c.InsightProvider {
+	case "", insightProviderGemini:
+		var apiKey *string
+		if apiKey, err = c.GetGoogleAIAPIKey(); err != nil || apiKey == nil || len(*apiKey) <= 0 {
+			return nil, "", err
+		}
+		model = defaultGoogleAIModel
+		if c.GoogleAIModel != nil && len(*c.GoogleAIModel) > 0 {
+			model = *c.GoogleAIModel
+		}
+		return geminiProvider{apiKey: *apiKey, model: model}, model, nil
+	case insightProviderOpenAI:
+		if c.OpenAIModel == nil || len(*c.OpenAIModel) <= 0 {
+			return nil, "", fmt.Errorf("`openai_model` is required for insight provider '%s'", c.InsightProvider)
+		}
+		p := openAIProvider{
+			baseURL: defaultOpenAIBaseURL,
+			model:   *c.OpenAIModel,
+		}
+		if c.OpenAIBaseURL != nil && len(*c.OpenAIBaseURL) > 0 {
+			p.baseURL = *c.OpenAIBaseURL
+		}
+		if c.OpenAIAPIKey != nil {
+			p.apiKey = *c.OpenAIAPIKey
+		}
+		return p, p.model, nil
+	default:
+		return nil, "", fmt.Errorf("unknown insight provider: '%s'", c.InsightProvider)
+	}
+}
+
+// compile protocol parse regex, returns nil if it is not set or invalid
+func (c *config) protocolRegex() *regexp.Regexp {
+	if c.ProtocolParseRegex == nil || len(*c.ProtocolParseRegex) <= 0 {
+		return nil
+	}
+
+	re, err := regexp.Compile(*c.ProtocolParseRegex)
+	if err != nil {
+		logWarn("Ignoring invalid `protocol_parse_regex`: %s", err)
+		return nil
+	}
+
+	return re
+}
+
+// parse given protocol string with the regex,
+//
+// returns the value of `protocol` group (or the whole string if there is none) and other named groups as tags
+func parseProtocol(re *regexp.Regexp, protocol string) (parsed string, tags map[string]string) {
+	parsed = protocol
+	if re == nil {
+		return parsed, nil
+	}
+
+	matches := re.FindStringSubmatch(protocol)
+	if matches == nil {
+		return parsed, nil
+	}
+
+	tags = map[string]string{}
+	for i, name := range re.SubexpNames() {
+		if i == 0 || name == "" {
+			continue
+		}
+
+		if name == "protocol" {
+			if len(matches[i]) > 0 {
+				parsed = matches[i]
+			}
+		} else {
+			tags[name] = matches[i]
+		}
+	}
+
+	return parsed, tags
+}
+
 func init() {
 	flag.Usage = showUsage
 }
@@ -244,14 +660,162 @@ func showUsage() {
 # save a ban action
 $ %[1]s -action save -ip <ip> -protocol <name>
 
-# generate a report (format = plain, json, telegraph)
+# (action can also be given as the first argument)
+$ %[1]s save -ip <ip> -protocol <name>
+
+# save a ban action with the name of its fail2ban jail
+$ %[1]s -action save -ip <ip> -protocol <protocol> -jail <name>
+
+# save a ban action with its protocol inferred from the jail (with 'jail_protocol_map', or the jail name itself)
+$ %[1]s -action save -ip <ip> -jail <name>
+
+# save a ban action with given host name (default: $BALOG_HOST or the hostname)
+$ %[1]s -action save -ip <ip> -protocol <name> -host <host>
+
+# exit with code 2 if the location is unknown (the ban action is saved anyway)
+$ %[1]s -action save -ip <ip> -protocol <name> -strict
+
+# print what would be saved without saving anything
+$ %[1]s -action save -ip <ip> -protocol <name> -dry-run
+
+# skip saving if the same ip and protocol was already saved within given seconds
+$ %[1]s -action save -ip <ip> -protocol <name> -dedupe-window <seconds>
+
+# save an unban action (when a ban is lifted)
+$ %[1]s -action unban -ip <ip> -protocol <name>
+
+# save ban actions from a json file (array of {"protocol", "ip", "timestamp"})
+$ %[1]s -action save -file <json_filepath>
+
+# save ban actions from stdin (newline-delimited {"protocol", "ip", "timestamp"})
+$ cat bans.ndjson | %[1]s -action save -format json
+
+# generate a report (format = plain, json, telegraph, msgpack, markdown, html)
 $ %[1]s -action report -format <format>
 
-# perform maintenance (job = list_unknown_ips, resolve_unknown_ips, purge_logs)
+# generate a report grouped by a tag extracted with 'protocol_parse_regex'
+$ %[1]s -action report -format <format> -group-by tag:<name>
+
+# generate a report with given windows (in number of days; default: 7,30)
+$ %[1]s -action report -format <format> -report-days <days1,days2,...>
+
+# generate a report of an absolute period (RFC3339 or YYYY-MM-DD; until now if -until is omitted)
+$ %[1]s -action report -format <format> -since <datetime> -until <datetime>
+
+# generate a report with given number of top offending ips (default: 10)
+$ %[1]s -action report -format <format> -top <number>
+
+# generate a report with protocols and countries of fewer counts collapsed into 'Other' (except json and msgpack)
+$ %[1]s -action report -format <format> -min-count <number>
+
+# generate a report with masked ips (last octet of ipv4, last 80 bits of ipv6)
+$ %[1]s -action report -format <format> -anonymize
+
+# generate a json report with daily counts (in UTC, including days without bans) of the largest window
+$ %[1]s -action report -format json -timeseries
+
+# generate a report with times in given timezone and layout (default: UTC, '2006-01-02 15:04:05')
+$ %[1]s -action report -format <format> -tz <timezone> -time-format <layout>
+
+# generate a json report with ISO 3166-1 alpha-2 codes of countries (empty for unmapped ones)
+$ %[1]s -action report -format json -iso-codes
+
+# generate a report of ban actions with given protocol and/or from given country only
+$ %[1]s -action report -format <format> -filter-protocol <protocol> -filter-country <country>
+
+# deliver a report to a telegram chat instead of stdout (deliverer = telegram)
+$ %[1]s -action report -format plain -deliver <deliverer>
+
+# write a report to a file instead of stdout (truncated, or appended with -append)
+$ %[1]s -action report -format <format> -out <filepath> [-append]
+
+# generate a report with given sort order (sort = count, count-asc, name)
+$ %[1]s -action report -format <format> -sort <sort>
+
+# generate a report without insights (or with insights even if not in 'report_sections')
+$ %[1]s -action report -format <format> -no-insight
+$ %[1]s -action report -format <format> -insight
+
+# print the system instruction and prompt sent for insight generation to stderr
+$ %[1]s -action report -format <format> -show-prompt
+
+# print them without sending anything to the model
+$ %[1]s -action report -format <format> -show-prompt -dry-run
+
+# compare with peer hosts' json reports (format = plain, json)
+$ %[1]s -action report -format <format> -peer <report1.json,report2.json,...>
+
+# compare counts per protocol and country with the prior period of the same length (format = plain, json; default: 7 days)
+$ %[1]s -action report -format <format> -compare [-report-days <days>]
+
+# perform maintenance (job = list_unknown_ips, resolve_unknown_ips, purge_logs, stats_locations, detect_gaps, apply_retention, anonymize_old, audit_locations, export, import, resolve_single, sync_locations, vacuum, dedupe_locations, delete_ip)
 $ %[1]s -action maintenance -job <job>
 
+# list unknown ips with their first seen times and numbers of bans (format = plain, json)
+$ %[1]s -action maintenance -job list_unknown_ips -format <format>
+
+# list unknown ips page by page
+$ %[1]s -action maintenance -job list_unknown_ips -limit <number> -offset <number>
+
+# (re)resolve the location of an ip, and update its ban action logs
+$ %[1]s -action maintenance -job resolve_single -ip <ip>
+
+# refresh unknown locations of ban actions with cached ones (eg. after resolving unknown ips)
+$ %[1]s -action maintenance -job sync_locations
+
+# resolve unknown ips in bounded chunks (unresolved ones will be tried last in the next run)
+$ %[1]s -action maintenance -job resolve_unknown_ips -max <number>
+
+# resolve unknown ips with at most given number of geolocation requests per second (default: 2, 0 for no limit)
+$ %[1]s -action maintenance -job resolve_unknown_ips -rps <number>
+
+# print statistics of the location cache (format = plain, json)
+$ %[1]s -action maintenance -job stats_locations -format <format>
+
+# detect gaps in logging (format = plain, json)
+$ %[1]s -action maintenance -job detect_gaps -format <format>
+
+# audit logs and cached locations without each other (format = plain, json)
+$ %[1]s -action maintenance -job audit_locations -format <format>
+
+# merge cached locations of ips which differ only by normalization (list only with -dry-run; format = plain, json)
+$ %[1]s -action maintenance -job dedupe_locations [-dry-run] -format <format>
+
+# delete all logs of an ip (eg. banned by mistake), and also its cached location with -with-location
+$ %[1]s -action maintenance -job delete_ip -ip <ip> [-with-location]
+
+# compact the database file (eg. after purging lots of logs)
+$ %[1]s -action maintenance -job vacuum
+
+# export a consistent snapshot of the database (gzipped if the filename ends with .gz)
+$ %[1]s -action maintenance -job export -out <filepath>
+
+# import ban actions and locations from another database (cached locations are kept)
+$ %[1]s -action maintenance -job import -from <filepath>
+
+# query ban actions from ip addresses in given cidr (format = plain, json)
+$ %[1]s -action query -cidr <cidr> -format <format>
+
+# print all-time statistics of ban actions (format = plain, json)
+$ %[1]s -action stats -format <format>
+
+# print the effective config (with secrets redacted)
+$ %[1]s -action config
+
+# validate the config by retrieving its secrets (exits with 1 if any configured one can't be obtained)
+$ %[1]s -action validate
+
+# print the version
+$ %[1]s -version
+
+# print diagnostics (to stderr) of given level and above (level = debug, info, warn, error; default: info)
+$ %[1]s -log-level <level> ...
+
 # for loading config file from a location you want (default: $XDG_CONFIG_HOME/%[2]s/%[3]s)
 $ %[1]s -config <config_filepath> ...
+
+# for using a database file (or an in-memory database with ':memory:') other than the one in the config
+$ %[1]s -db <db_filepath> ...
 `, filepath.Base(os.Args[0]), applicationName, defaultConfigFilename, version.Minimum())
 }
 
@@ -262,11 +826,77 @@ func run(_ []string) {
 	var action *string = flag.String(paramAction, "", "Action to perform")
 	var ip *string = flag.String(paramIP, "", "IP address of the ban action")
 	var protocol *string = flag.String(paramProtocol, "", "Protocol of the ban action")
+	var jail *string = flag.String(paramJail, "", "Name of the fail2ban jail of the ban action")
+	var host *string = flag.String(paramHost, "", "Host name to be saved with ban actions (default: $BALOG_HOST or the hostname)")
 	var format *string = flag.String(paramFormat, "", "Output format of the report")
 	var job *string = flag.String(paramJob, "", "Maintenance job to perform")
+	var groupBy *string = flag.String(paramGroupBy, "", "Group reports by given tag (eg. 'tag:region')")
+	var sortBy *string = flag.String(paramSort, "", "Sort order of the report (count, count-asc, name)")
+	var maxIPs *int = flag.Int(paramMax, 0, "Maximum number of IPs to resolve (0 for no limit)")
+	var limit *int = flag.Int(paramLimit, 0, "Maximum number of unknown IPs to list (0 for no limit)")
+	var offset *int = flag.Int(paramOffset, 0, "Number of unknown IPs to skip before listing")
+	var rps *float64 = flag.Float64(paramRPS, defaultResolveRequestsPerSecond, "Maximum number of geolocation requests per second when resolving unknown IPs (0 for no limit)")
+	var peer *string = flag.String(paramPeer, "", "Comma-separated filepaths of peer hosts' json reports to compare with")
+	var compare *bool = flag.Bool(paramCompare, false, "Compare counts of the report window with the prior window of the same length")
+	var cidr *string = flag.String(paramCIDR, "", "CIDR of IP addresses to query")
+	var file *string = flag.String(paramFile, "", "Filepath of a json array of ban actions to save")
+	var showPrompt *bool = flag.Bool(paramShowPrompt, false, "Print the prompt for insight generation to stderr")
+	var days *int = flag.Int(paramDays, 0, "Purge only logs older than given days (0 for all logs, with confirmation)")
+	var reportDays *string = flag.String(paramReportDays, "", "Comma-separated number of days of report windows (default: 7,30)")
+	var since *string = flag.String(paramSince, "", "Start of the report period (RFC3339 or YYYY-MM-DD)")
+	var until *string = flag.String(paramUntil, "", "End of the report period (RFC3339 or YYYY-MM-DD; default: now)")
+	var dryRun *bool = flag.Bool(paramDryRun, false, "Print what would be saved without saving anything (or the prompt for insights without sending it, with -show-prompt)")
+	var strict *bool = flag.Bool(paramStrict, false, "Exit with code 2 if the location of the saved ban action is unknown")
+	var dedupeWindow *int = flag.Int(paramDedupe, 0, "Skip saving if the same ip and protocol was saved within this number of seconds (0 for no deduplication)")
+	var top *int = flag.Int(paramTop, defaultNumTopIPs, "Number of top offending ips in reports")
+	var anonymize *bool = flag.Bool(paramAnonymize, false, "Mask ips in reports")
+	var timeseries *bool = flag.Bool(paramTimeseries, false, "Include daily counts of the largest window in json reports")
+	var tz *string = flag.String(paramTZ, "", "IANA timezone of times in reports (eg. 'Asia/Seoul'; default: UTC)")
+	var timeFormat *string = flag.String(paramTimeFormat, "", "Go layout of times in reports (default: '"+defaultReportTimeFormat+"')")
+	var isoCodes *bool = flag.Bool(paramISOCodes, false, "Include ISO 3166-1 alpha-2 codes of countries in json reports")
+	var minCount *int = flag.Int(paramMinCount, 0, "Collapse protocols and countries with fewer counts into 'Other' in rendered reports (0 for no collapsing)")
+	var forceInsight *bool = flag.Bool(paramInsight, false, "Generate insights in reports even if the insight section is not in report_sections")
+	var noInsight *bool = flag.Bool(paramNoInsight, false, "Skip generating insights in reports even if an insight provider is configured")
+	var filterProtocol *string = flag.String(paramFilterProtocol, "", "Report only ban actions of this protocol")
+	var filterCountry *string = flag.String(paramFilterCountry, "", "Report only ban actions from this country")
+	var showVersion *bool = flag.Bool(paramVersion, false, "Print the version")
+	var dbFilepath *string = flag.String(paramDB, "", "Database filepath (or DSN, eg. ':memory:') overriding the config")
+	var logLevel *string = flag.String(paramLogLevel, "", "Level of diagnostics printed to stderr (debug, info, warn, error; default: $BALOG_LOG_LEVEL or info)")
+	var out *string = flag.String(paramOut, "", "Output filepath (eg. of reports, or exported database)")
+	var appendOut *bool = flag.Bool(paramAppend, false, "Append to the output file of reports instead of truncating it")
+	var deliver *string = flag.String(paramDeliver, "", "Deliver reports with given deliverer (telegram) instead of printing them")
+	var from *string = flag.String(paramFrom, "", "Filepath of another database to import from")
+	var withLocation *bool = flag.Bool(paramWithLocation, false, "Also delete the cached location of the IP when deleting its logs")
 	flag.Parse()
 
-	if config, err := loadConfig(configFilepath); err == nil {
+	// action can also be given as the first positional argument (eg. `balog save -ip ...`)
+	if err := parseAction(flag.CommandLine, action); err != nil {
+		lexit(1, "Invalid action: %s", err)
+	}
+
+	// set the level of diagnostics
+	if len(*logLevel) <= 0 {
+		*logLevel = os.Getenv(envLogLevel)
+	}
+	if len(*logLevel) > 0 {
+		if err := setLogLevel(*logLevel); err != nil {
+			lexit(1, "Invalid value for `-%s`: %s", paramLogLevel, err)
+		}
+	}
+
+	// print the version (not requiring the config)
+	if *showVersion || *action == string(actionVersion) {
+		lexit(0, "%s %s", applicationName, version.Build(version.OS|version.Architecture|version.Revision))
+	}
+
+	// validate the database filepath given from the command line
+	if len(*dbFilepath) > 0 {
+		if err := validateDBFilepath(*dbFilepath); err != nil {
+			lexit(1, "Invalid value for `-%s`: %s", paramDB, err)
+		}
+	}
+
+	if config, err := loadConfig(configFilepath, *dbFilepath); err == nil {
 		if config.DBFilepath == nil {
 			// https://xdgbasedirectoryspecification.com
 			configDir := os.Getenv("XDG_CONFIG_HOME")
@@ -276,36 +906,215 @@ func run(_ []string) {
 				homedir, _ := os.UserHomeDir()
 				fallbackDBFilepath := filepath.Join(homedir, fallbackConfigDir, defaultDBFilename)
 
-				l("`db_filepath` is missing in config file, using default: '%s'", fallbackDBFilepath)
+				logInfo("`db_filepath` is missing in config file, using default: '%s'", fallbackDBFilepath)
 
 				config.DBFilepath = &fallbackDBFilepath
 			} else {
-				*config.DBFilepath = filepath.Join(configDir, applicationName, defaultDBFilename)
+				defaultDBFilepath := filepath.Join(configDir, applicationName, defaultDBFilename)
+				config.DBFilepath = &defaultDBFilepath
 			}
 		}
 
-		db, err := OpenDB(*config.DBFilepath)
+		// print the effective config (not requiring the database)
+		if *action == string(actionConfig) {
+			processShowConfig(config)
+		}
+
+		// validate secrets of the config (not requiring the database)
+		if *action == string(actionValidate) {
+			processValidateConfig(config)
+		}
+
+		db, err := OpenDB(*config.DBFilepath, dbOptions{
+			BusyTimeoutMillis: config.DBBusyTimeoutMillis,
+			JournalMode:       config.DBJournalMode,
+		})
 		if err != nil {
 			lexit(1, "Failed to open database: %s", err)
 		}
 
+		// host name to be saved with new logs
+		db.SetHost(hostName(*host))
+
 		switch *action {
 		case string(actionSave):
-			checkArg(ip, paramIP, actionSave)
-			checkArg(protocol, paramProtocol, actionSave)
-			apiKey, _ := config.GetIPGeolocationAPIKey()
-			processSave(db, protocol, ip, apiKey)
+			geolocator, err := config.GetGeolocator()
+			if err != nil {
+				lexit(1, "Failed to initialize geolocation providers: %s", err)
+			}
+			opts := saveOptions{
+				ProtocolRegex:    config.protocolRegex(),
+				DeferGeolocation: config.SaveDeferGeolocation,
+				Geolocator:       geolocator,
+
+				AbuseIPDBKey: config.AbuseIPDBKey,
+
+				PostSaveHook:               config.PostSaveHook,
+				PostSaveHookTimeoutSeconds: config.PostSaveHookTimeoutSeconds,
+				PostSaveHookAsync:          config.PostSaveHookAsync,
+
+				WebhookURL:        config.WebhookURL,
+				WebhookAuthHeader: config.WebhookAuthHeader,
+
+				MaxLogRows: config.MaxLogRows,
+
+				DryRun: *dryRun,
+				Strict: *strict,
+
+				DedupeWindow: time.Duration(*dedupeWindow) * time.Second,
+
+				Whitelist: parseWhitelist(config.Whitelist),
+			}
+			if opts.DryRun && (len(*file) > 0 || *format == string(reportFormatJSON)) {
+				lexit(1, "`-%s` is only supported for saving a single ban action.", paramDryRun)
+			}
+			if len(*file) > 0 {
+				processSaveFromFile(db, *file, opts)
+			} else if *format == string(reportFormatJSON) {
+				processSaveFromStdin(db, opts)
+			} else {
+				checkArg(ip, paramIP, actionSave)
+				if len(*protocol) <= 0 && len(*jail) > 0 {
+					*protocol = config.protocolOfJail(*jail)
+				}
+				checkArg(protocol, paramProtocol, actionSave)
+				processSave(db, protocol, ip, jail, opts)
+			}
+		case string(actionUnban):
+			checkArg(ip, paramIP, actionUnban)
+			if len(*protocol) <= 0 && len(*jail) > 0 {
+				*protocol = config.protocolOfJail(*jail)
+			}
+			checkArg(protocol, paramProtocol, actionUnban)
+			processUnban(db, protocol, ip, jail, config.protocolRegex(), parseWhitelist(config.Whitelist))
 		case string(actionReport):
 			checkArg(format, paramFormat, actionReport)
 			accessToken, _ := config.GetTelegraphAccessToken()
-			apiKey, _ := config.GetGoogleAIAPIKey()
-			processReport(db, format, accessToken, apiKey, 0)
+			insightProvider, insightModel, err := config.GetInsightProvider()
+			if err != nil {
+				logWarn("Failed to initialize insight provider: %s", err)
+			}
+			opts := reportOptions{}
+			opts.InsightCacheTTL = defaultInsightCacheTTLHours * time.Hour
+			if config.InsightCacheTTLHours != nil {
+				opts.InsightCacheTTL = time.Duration(*config.InsightCacheTTLHours) * time.Hour
+			}
+			if opts.InsightSystemInstruction, opts.InsightPromptTemplate, err = config.GetInsightPrompts(); err != nil {
+				logWarn("Invalid insight prompts, insights will be skipped: %s", err)
+				insightProvider = nil
+			}
+			if len(*groupBy) > 0 {
+				if !strings.HasPrefix(*groupBy, groupByTagPrefix) || len(*groupBy) <= len(groupByTagPrefix) {
+					logError("Unsupported value for `-%s`: '%s'", paramGroupBy, *groupBy)
+					showUsage()
+				}
+				opts.GroupBy = *groupBy
+			}
+			opts.TelegraphWindows = config.TelegraphWindows
+			opts.TelegraphSkipEmpty = config.TelegraphSkipEmpty
+			opts.ShowPrompt = *showPrompt
+			opts.DryRun = *dryRun
+			opts.NumTopIPs = *top
+			opts.Anonymize = *anonymize
+			opts.Timeseries = *timeseries
+			opts.ISOCodes = *isoCodes
+			opts.MinCount = *minCount
+			if len(*tz) > 0 {
+				if opts.Location, err = time.LoadLocation(*tz); err != nil {
+					lexit(1, "Invalid value for `-%s`: %s", paramTZ, err)
+				}
+			}
+			opts.TimeFormat = *timeFormat
+			opts.FilterProtocol = *filterProtocol
+			opts.FilterCountry = *filterCountry
+			if len(*reportDays) > 0 {
+				if opts.Days, err = parseReportDays(*reportDays); err != nil {
+					logError("Invalid value for `-%s`: %s", paramReportDays, err)
+					showUsage()
+				}
+			}
+			if len(*since) > 0 {
+				s, err := parseDatetime(*since)
+				if err != nil {
+					lexit(1, "Invalid value for `-%s`: %s", paramSince, err)
+				}
+				u := time.Now()
+				if len(*until) > 0 {
+					if u, err = parseDatetime(*until); err != nil {
+						lexit(1, "Invalid value for `-%s`: %s", paramUntil, err)
+					}
+				}
+				if !s.Before(u) {
+					lexit(1, "`-%s` (%s) must be before `-%s` (%s).", paramSince, s.Format(time.RFC3339), paramUntil, u.Format(time.RFC3339))
+				}
+				opts.Since, opts.Until = &s, &u
+			} else if len(*until) > 0 {
+				lexit(1, "`-%s` requires `-%s`.", paramUntil, paramSince)
+			}
+			opts.TrustedCountries = config.TrustedCountries
+			for _, section := range config.ReportSections {
+				if !slices.Contains(defaultReportSections, reportSection(section)) {
+					lexit(1, "Unknown report section in `report_sections`: '%s'", section)
+				}
+				opts.Sections = append(opts.Sections, reportSection(section))
+			}
+			if *forceInsight && *noInsight {
+				lexit(1, "`-%s` and `-%s` cannot be used together.", paramInsight, paramNoInsight)
+			} else if *noInsight {
+				insightProvider = nil
+			} else if *forceInsight {
+				if insightProvider == nil {
+					lexit(1, "`-%s` was given, but no insight provider is available.", paramInsight)
+				}
+				if !opts.hasSection(reportSectionInsight) {
+					opts.Sections = append(opts.Sections, reportSectionInsight)
+				}
+			}
+			if len(*sortBy) <= 0 && config.ReportSort != nil {
+				sortBy = config.ReportSort
+			}
+			switch sortOrder(*sortBy) {
+			case "":
+				opts.Sort = sortByCount
+			case sortByCount, sortByCountAsc, sortByName:
+				opts.Sort = sortOrder(*sortBy)
+			default:
+				logError("Unsupported sort order was given: '%s'", *sortBy)
+				showUsage()
+			}
+			var deliverer Deliverer
+			if len(*deliver) > 0 {
+				if *format == string(reportFormatMsgpack) || *format == string(reportFormatTelegraph) {
+					lexit(1, "`-%s` is not supported for format: '%s'", paramDeliver, *format)
+				}
+				if deliverer, err = config.GetDeliverer(*deliver); err != nil {
+					lexit(1, "Failed to initialize deliverer: %s", err)
+				}
+			}
+			if *compare {
+				if len(*peer) > 0 || opts.Since != nil {
+					lexit(1, "`-%s` cannot be used with `-%s` or `-%s`.", paramCompare, paramPeer, paramSince)
+				}
+				processComparison(db, format, opts)
+			} else if len(*peer) > 0 {
+				processPeerComparison(db, format, strings.Split(*peer, ","), opts)
+			} else {
+				processReport(db, format, accessToken, insightProvider, insightModel, 0, opts, *out, *appendOut, deliverer)
+			}
 		case string(actionMaintenance):
 			checkArg(job, paramJob, actionMaintenance)
-			apiKey, _ := config.GetIPGeolocationAPIKey()
-			processMaintenance(db, job, apiKey)
+			geolocator, err := config.GetGeolocator()
+			if err != nil {
+				lexit(1, "Failed to initialize geolocation providers: %s", err)
+			}
+			processMaintenance(db, job, format, geolocator, *ip, *maxIPs, *limit, *offset, *rps, *days, *out, *from, *dryRun, *withLocation, config)
+		case string(actionQuery):
+			checkArg(cidr, paramCIDR, actionQuery)
+			processQuery(db, cidr, format)
+		case string(actionStats):
+			processStats(db, format)
 		default:
-			l("Unknown action was given: '%s'", *action)
+			logError("Unknown action was given: '%s'", *action)
 			showUsage()
 		}
 
@@ -314,38 +1123,211 @@ func run(_ []string) {
 	}
 }
 
-// check argument's existence and exit program if it's missing
-func checkArg(arg *string, expectedArg, action action) {
-	if len(*arg) <= 0 {
-		l("Parameter `-%s` is required for action '%s'.", expectedArg, action)
-		showUsage()
+// host name to be saved with ban actions: given one, `BALOG_HOST`, or the hostname (in that order)
+func hostName(host string) string {
+	if len(host) > 0 {
+		return host
+	}
+	if env := os.Getenv(envHost); len(env) > 0 {
+		return env
 	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return ""
 }
 
-// loadConfig loads config, if it doesn't exist, create it
-func loadConfig(customConfigFilepath *string) (cfg config, err error) {
-	var configFilepath string
-	if customConfigFilepath == nil || len(*customConfigFilepath) <= 0 {
-		// https://xdgbasedirectoryspecification.com
-		configDir := os.Getenv("XDG_CONFIG_HOME")
+// print the effective config with its secrets redacted, then exit
+func processShowConfig(cfg config) {
+	// retrieve secrets (from infisical if needed)
+	_, _ = cfg.GetTelegraphAccessToken()
+	_, _ = cfg.GetIPGeolocationAPIKey()
+	_, _ = cfg.GetGoogleAIAPIKey()
 
-		// If the value of the environment variable is unset, empty, or not an absolute path, use the default
-		if configDir == "" || configDir[0:1] != "/" {
-			var homedir string
-			homedir, err = os.UserHomeDir()
-			if err == nil {
-				configFilepath = filepath.Join(homedir, fallbackConfigDir, defaultConfigFilename)
-			} else {
-				return cfg, err
-			}
-		} else {
-			configFilepath = filepath.Join(configDir, applicationName, defaultConfigFilename)
-		}
+	if bytes, err := json.MarshalIndent(cfg.redacted(), "", "  "); err == nil {
+		lexit(0, "%s", string(bytes))
 	} else {
-		configFilepath = *customConfigFilepath
+		lexit(1, "Failed to marshal config: %s", err)
 	}
+}
 
-	if _, err = os.Stat(configFilepath); err == nil {
+// try retrieving secrets of the config, print the results, then exit
+//
+// exits with 1 if any configured (inline or in infisical) secret can't be obtained
+func processValidateConfig(cfg config) {
+	failed := false
+	results := []string{}
+
+	// check a secret with its getter
+	check := func(name string, value *string, keyPath func() *string, get func() (*string, error)) {
+		configured := value != nil && len(*value) > 0 ||
+			cfg.Infisical != nil && keyPath() != nil
+		if !configured {
+			results = append(results, fmt.Sprintf("* %s: missing", name))
+			return
+		}
+
+		if secret, err := get(); err != nil {
+			failed = true
+			results = append(results, fmt.Sprintf("* %s: failed (%s)", name, err))
+		} else if secret == nil || len(*secret) <= 0 {
+			failed = true
+			results = append(results, fmt.Sprintf("* %s: failed (empty value)", name))
+		} else {
+			results = append(results, fmt.Sprintf("* %s: ok", name))
+		}
+	}
+	check("telegraph access token", cfg.TelegraphAccessToken,
+		func() *string { return cfg.Infisical.TelegraphAccessTokenKeyPath },
+		cfg.GetTelegraphAccessToken)
+	check("ipgeolocation api key", cfg.IPGeolocationAPIKey,
+		func() *string { return cfg.Infisical.IPGeolocationAPIKeyKeyPath },
+		cfg.GetIPGeolocationAPIKey)
+	check("google ai api key", cfg.GoogleAIAPIKey,
+		func() *string { return cfg.Infisical.GoogleAIAPIKeyKeyPath },
+		cfg.GetGoogleAIAPIKey)
+
+	// geolocation providers
+	if _, err := cfg.GetGeolocator(); err != nil {
+		failed = true
+		results = append(results, fmt.Sprintf("* geolocation providers: failed (%s)", err))
+	} else {
+		results = append(results, "* geolocation providers: ok")
+	}
+
+	// insight provider
+	if provider, model, err := cfg.GetInsightProvider(); err != nil {
+		failed = true
+		results = append(results, fmt.Sprintf("* insight provider: failed (%s)", err))
+	} else if provider == nil {
+		results = append(results, "* insight provider: not configured")
+	} else {
+		results = append(results, fmt.Sprintf("* insight provider: ok (%s)", model))
+	}
+	if _, _, err := cfg.GetInsightPrompts(); err != nil {
+		failed = true
+		results = append(results, fmt.Sprintf("* insight prompts: failed (%s)", err))
+	} else if cfg.InsightSystemInstruction != nil || cfg.InsightPromptTemplate != nil {
+		results = append(results, "* insight prompts: ok (custom)")
+	}
+
+	if failed {
+		lexit(1, "%s", strings.Join(results, "\n"))
+	}
+	lexit(0, "%s", strings.Join(results, "\n"))
+}
+
+// check argument's existence and exit program if it's missing
+func checkArg(arg *string, expectedArg, action action) {
+	if len(*arg) <= 0 {
+		logError("Parameter `-%s` is required for action '%s'.", expectedArg, action)
+		showUsage()
+	}
+}
+
+// set the action from the first positional argument of given flags (if any), and parse the flags after it
+//
+// returns an error if it conflicts with the one given with `-action`.
+func parseAction(flags *flag.FlagSet, action *string) error {
+	if positional := flags.Arg(0); len(positional) > 0 {
+		if err := flags.Parse(flags.Args()[1:]); err != nil {
+			return err
+		}
+
+		if len(*action) > 0 && *action != positional {
+			return fmt.Errorf("conflicting actions were given: `-%s %s` and '%s'", paramAction, *action, positional)
+		}
+		*action = positional
+	}
+
+	return nil
+}
+
+// parse comma-separated number of days of report windows (eg. "7,30,90")
+func parseReportDays(str string) (result []int, err error) {
+	result = []int{}
+
+	for _, s := range strings.Split(str, ",") {
+		var days int
+		if days, err = strconv.Atoi(strings.TrimSpace(s)); err != nil || days <= 0 {
+			return nil, fmt.Errorf("'%s' is not a positive number", s)
+		}
+		if !slices.Contains(result, days) {
+			result = append(result, days)
+		}
+	}
+
+	return result, nil
+}
+
+// parse given string as a datetime in RFC3339 or YYYY-MM-DD (in local time) format
+func parseDatetime(str string) (result time.Time, err error) {
+	if result, err = time.Parse(time.RFC3339, str); err == nil {
+		return result, nil
+	}
+	if result, err = time.ParseInLocation("2006-01-02", str, time.Local); err == nil {
+		return result, nil
+	}
+
+	return result, fmt.Errorf("'%s' is not in RFC3339 or YYYY-MM-DD format", str)
+}
+
+// loadConfig loads config from the config file and environment variables
+//
+// values from environment variables (`BALOG_*`) take precedence over the ones in the config file,
+// and `dbFilepath` (if not empty) takes precedence over all of them.
+func loadConfig(customConfigFilepath *string, dbFilepath string) (cfg config, err error) {
+	if cfg, err = loadConfigFile(customConfigFilepath, len(dbFilepath) <= 0); err == nil {
+		cfg.applyEnvVars()
+
+		if len(dbFilepath) > 0 {
+			cfg.DBFilepath = &dbFilepath
+		}
+	}
+
+	return cfg, err
+}
+
+// override config values with non-empty environment variables
+func (c *config) applyEnvVars() {
+	for env, value := range map[string]**string{
+		envDBFilepath:          &c.DBFilepath,
+		envTelegraphToken:      &c.TelegraphAccessToken,
+		envIPGeolocationAPIKey: &c.IPGeolocationAPIKey,
+		envGoogleAIAPIKey:      &c.GoogleAIAPIKey,
+	} {
+		if v := os.Getenv(env); len(v) > 0 {
+			*value = &v
+		}
+	}
+}
+
+// load config file, if it doesn't exist, create it
+//
+// (a default config file won't be created if `createDefault` is false, or `BALOG_DB_FILEPATH` is set)
+func loadConfigFile(customConfigFilepath *string, createDefault bool) (cfg config, err error) {
+	var configFilepath string
+	if customConfigFilepath == nil || len(*customConfigFilepath) <= 0 {
+		// https://xdgbasedirectoryspecification.com
+		configDir := os.Getenv("XDG_CONFIG_HOME")
+
+		// If the value of the environment variable is unset, empty, or not an absolute path, use the default
+		if configDir == "" || configDir[0:1] != "/" {
+			var homedir string
+			homedir, err = os.UserHomeDir()
+			if err == nil {
+				configFilepath = filepath.Join(homedir, fallbackConfigDir, defaultConfigFilename)
+			} else {
+				return cfg, err
+			}
+		} else {
+			configFilepath = filepath.Join(configDir, applicationName, defaultConfigFilename)
+		}
+	} else {
+		configFilepath = *customConfigFilepath
+	}
+
+	if _, err = os.Stat(configFilepath); err == nil {
 		// read config file
 		var bytes []byte
 		if bytes, err = os.ReadFile(configFilepath); err == nil {
@@ -356,10 +1338,15 @@ func loadConfig(customConfigFilepath *string) (cfg config, err error) {
 			}
 		}
 	} else if os.IsNotExist(err) {
+		// run without a config file
+		if !createDefault || len(os.Getenv(envDBFilepath)) > 0 {
+			return cfg, nil
+		}
+
 		// create a config directory recursively
 		configDirpath := filepath.Dir(configFilepath)
 		if err := os.MkdirAll(configDirpath, fs.ModePerm); err != nil {
-			l("Failed to create config directory '%s': %s", configDirpath, err)
+			logWarn("Failed to create config directory '%s': %s", configDirpath, err)
 		}
 
 		// create a default config file
@@ -377,7 +1364,7 @@ func loadConfig(customConfigFilepath *string) (cfg config, err error) {
 			var bytes []byte
 			if bytes, err = json.Marshal(cfg); err == nil {
 				if _, err = file.Write(bytes); err == nil {
-					l("Created default config file: '%s'", configFilepath)
+					logInfo("Created default config file: '%s'", configFilepath)
 				}
 				return cfg, nil
 			}
@@ -387,80 +1374,523 @@ func loadConfig(customConfigFilepath *string) (cfg config, err error) {
 	return cfg, err
 }
 
+// save options
+type saveOptions struct {
+	ProtocolRegex    *regexp.Regexp // for parsing protocol strings
+	DeferGeolocation bool           // if true, don't fetch locations (they will be resolved later)
+
+	Geolocator Geolocator // for fetching locations of newly-seen ips
+
+	AbuseIPDBKey *string // for fetching abuse confidence scores of newly-seen ips (not fetched if nil)
+
+	PostSaveHook               *string // command to run after a successful save
+	PostSaveHookTimeoutSeconds int
+	PostSaveHookAsync          bool
+
+	WebhookURL        *string // url to post a saved ban action to
+	WebhookAuthHeader *string
+
+	MaxLogRows int64 // maximum number of logs to keep (0 for no limit)
+
+	DryRun bool // if true, nothing will be saved (to logs, or location cache)
+	Strict bool // if true, exit with `exitCodeUnknownLocation` when the location is unknown (the ban action is saved anyway)
+
+	DedupeWindow time.Duration // if positive, skip saving when the same ip and protocol was saved within this duration
+
+	Whitelist ipWhitelist // ban actions of these ips won't be saved (nor geolocated)
+}
+
 // process save job
-func processSave(db *Database, protocol, ip, geolocAPIKey *string) {
+func processSave(db *Database, protocol, ip, jail *string, opts saveOptions) {
+	parsed, tags := parseProtocol(opts.ProtocolRegex, *protocol)
+
+	// use the canonical form of the ip from here (eg. for hooks)
+	normalized, err := normalizeIP(*ip)
+	if err != nil {
+		lexit(1, "Failed to save ban action: %s", err)
+	}
+	ip = &normalized
+
+	// skip whitelisted ips (eg. own office or vpn ranges)
+	if opts.Whitelist.contains(*ip) {
+		lexit(0, "[whitelisted] Skipped ban action: ip = %s, protocol = %s", *ip, parsed)
+	}
+
+	// skip duplicated ban actions (eg. fired on every matched line)
+	if opts.DedupeWindow > 0 {
+		if saved, err := db.RecentlySaved(*ip, parsed, opts.DedupeWindow); err != nil {
+			logWarn("Failed to check duplicated ban actions: %s", err)
+		} else if saved {
+			lexit(0, "Skipped ban action: ip = %s, protocol = %s was already saved within %s", *ip, parsed, opts.DedupeWindow)
+		}
+	}
+
+	// print what would be saved, without saving anything
+	if opts.DryRun {
+		location, err := resolveLocation(db, *ip, opts)
+		if err != nil {
+			logWarn("[dry-run] Failed to lookup location of '%s': %s", *ip, err)
+		}
+		lexit(0, "[dry-run] Would save ban action: ip = %s, protocol = %s, jail = %s, tags = %v, location = %s", *ip, parsed, *jail, tags, location)
+	}
+
+	located := false
+
 	// save,
-	if id, err := db.SaveBanAction(*protocol, *ip); err != nil {
+	if id, err := db.SaveBanAction(parsed, *ip, tags, *jail); err != nil {
 		lexit(1, "Failed to save ban action: %s", err)
 	} else {
 		// then resolve its geo location
-		if cached, err := db.LookupLocation(*ip); err == nil {
-			var fetched string
-			var err error
-			// if there is no cache for it, fetch it from ipgeolocation.io,
-			if cached.ID == 0 {
-				fetched, err = FetchLocation(geolocAPIKey, *ip)
-				if err != nil {
-					l("Failed to fetch location: %s", err)
-				}
+		if location, err := resolveLocation(db, *ip, opts); err == nil {
+			located = location != unknownLocation
+
+			// and update the ban action's location
+			if err = db.UpdateBanActionLocation(id, location); err != nil {
+				logWarn("Failed to update location of ban action '%d': %s", id, err)
+			}
+
+			// fetch its abuse confidence score (failures are logged only)
+			updateAbuseScore(db, *ip, opts)
 
-				if fetched == "" {
-					fetched = unknownLocation
+			// run post-save hook (failures are logged only)
+			if opts.PostSaveHook != nil && len(*opts.PostSaveHook) > 0 {
+				if err = runPostSaveHook(*opts.PostSaveHook, opts.PostSaveHookTimeoutSeconds, opts.PostSaveHookAsync, *ip, parsed, location); err != nil {
+					logWarn("Failed to run post-save hook: %s", err)
 				}
+			}
 
-				// and save to cache
-				if _, err = db.SaveLocation(*ip, fetched); err != nil {
-					l("Failed to save location for '%s': %s", *ip, err)
+			// post to webhook (failures are logged only)
+			if opts.WebhookURL != nil && len(*opts.WebhookURL) > 0 {
+				if err = postWebhook(*opts.WebhookURL, opts.WebhookAuthHeader, *ip, parsed, location, time.Now()); err != nil {
+					logWarn("Failed to post to webhook: %s", err)
 				}
-			} else {
-				fetched = cached.CountryName
 			}
+		} else {
+			logWarn("Failed to lookup location of '%s': %s", *ip, err)
+		}
 
-			// and update the ban action's location
-			if err = db.UpdateBanActionLocation(id, fetched); err != nil {
-				l("Failed to update location of ban action '%d': %s", id, err)
+		// check the number of logs periodically
+		if opts.MaxLogRows > 0 && id%logRowsCheckInterval == 0 {
+			trimLogs(db, opts.MaxLogRows)
+		}
+	}
+
+	if opts.Strict && !located {
+		lexit(exitCodeUnknownLocation, "Saved ban action, but the location of '%s' is unknown.", *ip)
+	}
+}
+
+// delete the oldest logs exceeding `maxRows`
+func trimLogs(db *Database, maxRows int64) {
+	if trimmed, err := db.TrimLogs(maxRows); err != nil {
+		logWarn("Failed to trim logs: %s", err)
+	} else if trimmed > 0 {
+		logInfo("Trimmed %d oldest log(s) for keeping at most %d logs.", trimmed, maxRows)
+	}
+}
+
+// process unban job
+func processUnban(db *Database, protocol, ip, jail *string, protocolRegex *regexp.Regexp, whitelist ipWhitelist) {
+	parsed, tags := parseProtocol(protocolRegex, *protocol)
+
+	// skip whitelisted ips (they are not logged at all)
+	if whitelist.contains(*ip) {
+		lexit(0, "[whitelisted] Skipped unban action: ip = %s, protocol = %s", *ip, parsed)
+	}
+
+	if id, err := db.SaveBanEvent(parsed, *ip, eventTypeUnban, tags, *jail); err != nil {
+		lexit(1, "Failed to save unban action: %s", err)
+	} else {
+		// update its location from the cache (without fetching)
+		if cached, err := db.LookupLocation(*ip); err == nil && cached.ID != 0 {
+			if err = db.UpdateBanActionLocation(id, cached.CountryName); err != nil {
+				logWarn("Failed to update location of unban action '%d': %s", id, err)
 			}
+		}
+	}
+}
+
+// lookup the location of given ip from the cache,
+//
+// if there is no cache for it, fetch it from ipgeolocation.io and save it to the cache
+// (or leave it unknown for `resolve_unknown_ips` if deferred)
+func resolveLocation(db *Database, ip string, opts saveOptions) (location string, err error) {
+	fetched, cached, err := lookupOrFetchLocation(db, ip, opts)
+	if err != nil {
+		return fetched.CountryName, err
+	}
+
+	// save to cache
+	if !cached && !opts.DryRun {
+		cacheLocations(db, map[string]GeoLocation{ip: fetched})
+	}
+
+	return fetched.CountryName, nil
+}
+
+// lookup the location of given ip from the cache, or fetch it if there is no cache for it (without saving it to the cache)
+func lookupOrFetchLocation(db *Database, ip string, opts saveOptions) (location GeoLocation, cached bool, err error) {
+	var c Location
+	if c, err = db.LookupLocation(ip); err != nil {
+		return GeoLocation{CountryName: unknownLocation}, false, err
+	}
+	if c.ID != 0 {
+		return GeoLocation{CountryName: c.CountryName}, true, nil
+	}
+
+	if isReservedIP(ip) {
+		location.CountryName = reservedLocation
+	} else if !opts.DeferGeolocation {
+		if location, err = FetchLocation(opts.Geolocator, ip); err != nil {
+			logWarn("Failed to fetch location: %s", err)
+		}
+	}
+	if location.CountryName == "" {
+		location.CountryName = unknownLocation
+	}
+
+	return location, false, nil
+}
+
+// lookup (or fetch) locations of given ips, each unique ip only once
+//
+// nothing is written to the database, so this can be done before opening a transaction:
+// returns the country names of the ips, and the fetched locations to be saved with `cacheLocations`.
+func resolveLocations(db *Database, ips []string, opts saveOptions) (countries map[string]string, fetched map[string]GeoLocation) {
+	countries, fetched = map[string]string{}, map[string]GeoLocation{}
+
+	for _, ip := range ips {
+		if _, exists := countries[ip]; exists {
+			continue
+		}
+
+		location, cached, err := lookupOrFetchLocation(db, ip, opts)
+		if err != nil {
+			logWarn("Failed to lookup location of '%s': %s", ip, err)
+		} else if !cached {
+			fetched[ip] = location
+		}
+		countries[ip] = location.CountryName
+	}
+
+	return countries, fetched
+}
+
+// save given locations to the cache
+func cacheLocations(db *Database, locations map[string]GeoLocation) {
+	for ip, location := range locations {
+		if _, err := db.SaveLocation(ip, location); err != nil {
+			logWarn("Failed to save location for '%s': %s", ip, err)
+		}
+	}
+}
+
+// fetch and save the abuse confidence score of given ip, if it is not fetched yet
+func updateAbuseScore(db *Database, ip string, opts saveOptions) {
+	if opts.AbuseIPDBKey == nil || len(*opts.AbuseIPDBKey) <= 0 || opts.DeferGeolocation || isReservedIP(ip) {
+		return
+	}
+
+	if cached, err := db.LookupLocation(ip); err != nil || cached.ID == 0 || cached.AbuseScore != nil {
+		return
+	}
+
+	if score, err := fetchAbuseScore(*opts.AbuseIPDBKey, ip); err == nil {
+		if err = db.SetAbuseScore(ip, score); err != nil {
+			logWarn("Failed to save abuse score of '%s': %s", ip, err)
+		}
+	} else {
+		logWarn("Failed to fetch abuse score of '%s': %s", ip, err)
+	}
+}
+
+// a ban action to be saved in bulk
+type bulkBanAction struct {
+	Protocol  string `json:"protocol"`
+	IP        string `json:"ip"`
+	Jail      string `json:"jail,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"` // RFC3339 (now if empty)
+}
+
+// validate the ban action and return its timestamp
+func (a bulkBanAction) validate() (timestamp time.Time, err error) {
+	if len(a.Protocol) <= 0 {
+		return timestamp, fmt.Errorf("protocol is missing")
+	}
+	if _, err = netip.ParseAddr(a.IP); err != nil {
+		return timestamp, fmt.Errorf("invalid ip '%s'", a.IP)
+	}
+	timestamp = time.Now()
+	if len(a.Timestamp) > 0 {
+		if timestamp, err = time.Parse(time.RFC3339, a.Timestamp); err != nil {
+			return timestamp, fmt.Errorf("invalid timestamp '%s'", a.Timestamp)
+		}
+	}
+
+	return timestamp, nil
+}
+
+// process save job with a json file of ban actions
+func processSaveFromFile(db *Database, filepath string, opts saveOptions) {
+	saved, skipped, whitelisted, err := saveFromFile(db, filepath, opts)
+	if err != nil {
+		lexit(1, "Failed to save ban actions from file: %s", err)
+	}
+
+	if opts.MaxLogRows > 0 {
+		trimLogs(db, opts.MaxLogRows)
+	}
+
+	lexit(0, "Saved %d ban action(s), skipped %d invalid row(s) and %d whitelisted row(s).", saved, skipped, whitelisted)
+}
+
+// save ban actions in a json file in a single transaction
+//
+// invalid and whitelisted rows are skipped, but nothing is saved if the file is malformed or any row fails to be saved.
+// each unique ip is geolocated at most once before the (short) transaction is opened.
+func saveFromFile(db *Database, filepath string, opts saveOptions) (saved, skipped, whitelisted int, err error) {
+	var bytes []byte
+	if bytes, err = os.ReadFile(filepath); err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to read file: %s", err)
+	}
+
+	var actions []bulkBanAction
+	if err = json.Unmarshal(bytes, &actions); err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to parse file as a json array of ban actions: %s", err)
+	}
+
+	// validate
+	logs, ips := []BanActionLog{}, []string{}
+	for i, action := range actions {
+		timestamp, err := action.validate()
+		if err != nil {
+			logWarn("Skipping row %d: %s", i, err)
+			skipped++
+			continue
+		}
+		if opts.Whitelist.contains(action.IP) {
+			logInfo("[whitelisted] Skipping row %d: %s", i, action.IP)
+			whitelisted++
+			continue
+		}
+
+		parsed, tags := parseProtocol(opts.ProtocolRegex, action.Protocol)
+		log, err := newBanActionLog(parsed, action.IP, eventTypeBan, tags, optionalJail([]string{action.Jail}), timestamp)
+		if err != nil {
+			logWarn("Skipping row %d: %s", i, err)
+			skipped++
+			continue
+		}
+		logs = append(logs, log)
+		ips = append(ips, log.IP)
+	}
+
+	// resolve locations (cache-first), without holding the write lock during lookups
+	countries, fetched := resolveLocations(db, ips, opts)
+	for i := range logs {
+		country := countries[logs[i].IP]
+		logs[i].Location = &country
+	}
+
+	// and save them
+	if err = db.Transaction(func(tx *Database) (err error) {
+		cacheLocations(tx, fetched)
+
+		saved, err = tx.SaveBanActionsBatch(logs)
+		return err
+	}); err != nil {
+		return 0, skipped, whitelisted, err
+	}
+
+	return saved, skipped, whitelisted, nil
+}
+
+// process save job with newline-delimited json objects of ban actions from stdin
+//
+// each unique ip is geolocated at most once before saving, then all rows are saved in a single (short) transaction.
+func processSaveFromStdin(db *Database, opts saveOptions) {
+	logs := []BanActionLog{}
+	skipped, whitelisted := 0, 0
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) <= 0 {
+			continue
+		}
+
+		var action bulkBanAction
+		if err := json.Unmarshal([]byte(line), &action); err != nil {
+			logWarn("Skipping line %d: failed to parse as json: %s", i, err)
+			skipped++
+			continue
+		}
+		timestamp, err := action.validate()
+		if err != nil {
+			logWarn("Skipping line %d: %s", i, err)
+			skipped++
+			continue
+		}
+		if opts.Whitelist.contains(action.IP) {
+			logInfo("[whitelisted] Skipping line %d: %s", i, action.IP)
+			whitelisted++
+			continue
+		}
+
+		parsed, tags := parseProtocol(opts.ProtocolRegex, action.Protocol)
+		if log, err := newBanActionLog(parsed, action.IP, eventTypeBan, tags, optionalJail([]string{action.Jail}), timestamp); err == nil {
+			logs = append(logs, log)
 		} else {
-			l("Failed to lookup location of '%s': %s", *ip, err)
+			logWarn("Skipping line %d: %s", i, err)
+			skipped++
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		lexit(1, "Failed to read from stdin: %s", err)
+	}
+
+	// resolve locations (cache-first) of unique ips, without holding the write lock during lookups
+	ips := []string{}
+	for _, log := range logs {
+		ips = append(ips, log.IP)
+	}
+	countries, fetched := resolveLocations(db, ips, opts)
+	for i := range logs {
+		country := countries[logs[i].IP]
+		logs[i].Location = &country
+	}
+
+	inserted := 0
+	if err := db.Transaction(func(tx *Database) (err error) {
+		cacheLocations(tx, fetched)
+
+		inserted, err = tx.SaveBanActionsBatch(logs)
+		return err
+	}); err != nil {
+		lexit(1, "Failed to save ban actions: %s", err)
+	}
+
+	if opts.MaxLogRows > 0 {
+		trimLogs(db, opts.MaxLogRows)
+	}
+
+	lexit(0, "Saved %d ban action(s), skipped %d invalid line(s) and %d whitelisted line(s).", inserted, skipped, whitelisted)
 }
 
 // process report job
-func processReport(db *Database, format *string, telegraphAccessToken, googleAIAPIKey *string, offsetDays int) {
+//
+// if `deliverer` is given, the report will be delivered with it,
+// or if `out` is given, the report will be written to the file (appended if `appendOut` is true) instead of stdout.
+func processReport(db *Database, format *string, telegraphAccessToken *string, insightProvider InsightProvider, insightModel string, offsetDays int, opts reportOptions, out string, appendOut bool, deliverer Deliverer) {
 	var err error
 	var recent, older, insight, report []byte
 
+	// generate a report of the current period, or of the older period (for insights) if `older` is true:
+	// `numDaysBeforeForOlderReport` days before, or the period of the same length right before the absolute period
+	generate := func(relative func(int, reportOptions) ([]byte, error), absolute func(time.Time, time.Time, reportOptions) ([]byte, error), older bool) ([]byte, error) {
+		if opts.Since != nil && opts.Until != nil {
+			since, until := *opts.Since, *opts.Until
+			if older {
+				since, until = since.Add(-until.Sub(since)), since
+			}
+			return absolute(since, until, opts)
+		}
+		if older {
+			return relative(offsetDays-numDaysBeforeForOlderReport, opts)
+		}
+		return relative(offsetDays, opts)
+	}
+
 	switch *format {
 	case string(reportFormatPlain):
-		recent, err = db.GetReportAsPlain(offsetDays, numDaysForReport1, numDaysForReport2)
-
-		// generate some insights from older/recent reports with google ai model
-		if googleAIAPIKey != nil {
-			if older, _ = db.GetReportAsPlain(offsetDays-numDaysBeforeForOlderReport, numDaysForReport1, numDaysForReport2); older != nil {
-				if insight, err = generateInsight(*googleAIAPIKey, older, recent); err != nil {
-					l("Failed to generate insights: %s", err)
+		recent, err = generate(db.GetReportAsPlain, db.GetReportAsPlainRange, false)
+
+		// generate some insights from older/recent reports with ai model
+		if insightProvider != nil && opts.hasSection(reportSectionInsight) {
+			if older, _ = generate(db.GetReportAsPlain, db.GetReportAsPlainRange, true); older != nil {
+				var insightErr error
+				if insight, insightErr = generateInsight(db, insightProvider, insightModel, older, recent, opts); insightErr != nil {
+					logWarn("Failed to generate insights: %s", insightErr)
 				}
 			}
 		}
 
 		// final report
-		report = db.GetFinalReportAsPlain(recent, insight)
+		report = db.GetFinalReportAsPlain(recent, insight, insightModel)
 	case string(reportFormatJSON):
-		recent, err = db.GetReportAsJSON(offsetDays, numDaysForReport1, numDaysForReport2)
-
-		// generate some insights from older/recent reports with google ai model
-		if googleAIAPIKey != nil {
-			if older, _ = db.GetReportAsJSON(offsetDays-numDaysBeforeForOlderReport, numDaysForReport1, numDaysForReport2); older != nil {
-				if insight, err = generateInsight(*googleAIAPIKey, older, recent); err != nil {
-					l("Failed to generate insights: %s", err)
+		recent, err = generate(db.GetReportAsJSON, db.GetReportAsJSONRange, false)
+
+		// generate some insights from older/recent reports with ai model
+		if insightProvider != nil && opts.hasSection(reportSectionInsight) {
+			if older, _ = generate(db.GetReportAsJSON, db.GetReportAsJSONRange, true); older != nil {
+				var insightErr error
+				if insight, insightErr = generateInsight(db, insightProvider, insightModel, older, recent, opts); insightErr != nil {
+					logWarn("Failed to generate insights: %s", insightErr)
 				}
 			}
 		}
 
 		// final report
 		report = db.GetFinalReportAsJSON(recent, insight)
+	case string(reportFormatMarkdown):
+		recent, err = generate(db.GetReportAsMarkdown, db.GetReportAsMarkdownRange, false)
+
+		// generate some insights from older/recent reports with ai model (both in json)
+		if err == nil && insightProvider != nil && opts.hasSection(reportSectionInsight) {
+			if older, _ = generate(db.GetReportAsJSON, db.GetReportAsJSONRange, true); older != nil {
+				if recentJSON, _ := generate(db.GetReportAsJSON, db.GetReportAsJSONRange, false); recentJSON != nil {
+					var insightErr error
+					if insight, insightErr = generateInsight(db, insightProvider, insightModel, older, recentJSON, opts); insightErr != nil {
+						logWarn("Failed to generate insights: %s", insightErr)
+					}
+				}
+			}
+		}
+
+		// final report
+		report = db.GetFinalReportAsMarkdown(recent, insight, insightModel)
+	case string(reportFormatHTML):
+		recent, err = generate(db.GetReportAsHTML, db.GetReportAsHTMLRange, false)
+
+		// generate some insights from older/recent reports with ai model (in json, not in verbose html)
+		if err == nil && insightProvider != nil && opts.hasSection(reportSectionInsight) {
+			if older, _ = generate(db.GetReportAsJSON, db.GetReportAsJSONRange, true); older != nil {
+				if recentJSON, _ := generate(db.GetReportAsJSON, db.GetReportAsJSONRange, false); recentJSON != nil {
+					var insightErr error
+					if insight, insightErr = generateInsight(db, insightProvider, insightModel, older, recentJSON, opts); insightErr != nil {
+						logWarn("Failed to generate insights: %s", insightErr)
+					}
+				}
+			}
+		}
+
+		// final report
+		report = db.GetFinalReportAsHTML(recent, insight, insightModel)
+	case string(reportFormatMsgpack):
+		recent, err = generate(db.GetReportAsJSON, db.GetReportAsJSONRange, false)
+
+		// generate some insights from older/recent reports with ai model
+		if insightProvider != nil && opts.hasSection(reportSectionInsight) {
+			if older, _ = generate(db.GetReportAsJSON, db.GetReportAsJSONRange, true); older != nil {
+				var insightErr error
+				if insight, insightErr = generateInsight(db, insightProvider, insightModel, older, recent, opts); insightErr != nil {
+					logWarn("Failed to generate insights: %s", insightErr)
+				}
+			}
+		}
+
+		// final report (encoded from the json one)
+		if err == nil {
+			report, err = db.GetFinalReportAsMsgpack(recent, insight)
+		}
 	case string(reportFormatTelegraph):
+		// skip posting empty reports if configured
+		if opts.TelegraphSkipEmpty {
+			if current, err := db.GenerateReport(offsetDays, opts); err == nil && current.Empty {
+				lexit(0, "%s (skipped posting to telegra.ph)", emptyReportMessage)
+			}
+		}
+
 		var client *telegraph.Client
 		if telegraphAccessToken == nil {
 			if client, err = telegraph.Create("balog", "Ban Action Logger", ""); err == nil { // NOTE: generate a new access token
@@ -474,42 +1904,138 @@ func processReport(db *Database, format *string, telegraphAccessToken, googleAIA
 			}
 		}
 
-		if recent, err = db.GetReportAsTelegraph(telegraphAccessToken, offsetDays, numDaysForReport1, numDaysForReport2); err == nil {
-			// generate some insights from older/recent reports with google ai model
-			if googleAIAPIKey != nil {
-				if older, _ = db.GetReportAsJSON(offsetDays-numDaysBeforeForOlderReport, numDaysForReport1, numDaysForReport2); older != nil {
-					if insight, err = generateInsight(*googleAIAPIKey, older, recent); err != nil {
-						l("Failed to generate insights: %s", err)
+		if recent, err = generate(
+			func(offsetDays int, opts reportOptions) ([]byte, error) {
+				return db.GetReportAsTelegraph(telegraphAccessToken, offsetDays, opts)
+			},
+			func(since, until time.Time, opts reportOptions) ([]byte, error) {
+				return db.GetReportAsTelegraphRange(telegraphAccessToken, since, until, opts)
+			},
+			false,
+		); err == nil {
+			// generate some insights from older/recent reports with ai model
+			if insightProvider != nil && opts.hasSection(reportSectionInsight) {
+				if older, _ = generate(db.GetReportAsJSON, db.GetReportAsJSONRange, true); older != nil {
+					var insightErr error
+					if insight, insightErr = generateInsight(db, insightProvider, insightModel, older, recent, opts); insightErr != nil {
+						logWarn("Failed to generate insights: %s", insightErr)
 					}
 				}
 			}
 
 			// final report
-			report = db.GetFinalReportAsTelegraph(recent, insight)
+			report = db.GetFinalReportAsTelegraph(recent, insight, insightModel)
 
 			var url string
-			if url, err = postToTelegraphAndReturnURL(client, report, offsetDays); err == nil {
+			if url, err = postToTelegraphAndReturnURL(client, report, offsetDays, opts); err == nil {
 				report = []byte(url)
 			}
 		}
 	default:
-		l("Unknown format was given: '%s'", *format)
+		logError("Unknown format was given: '%s'", *format)
 		showUsage()
 	}
 
 	if err != nil {
 		lexit(1, "Failed to generate report: %s", err)
 	} else {
-		os.Stdout.Write(report)
-		os.Stdout.Write([]byte("\n"))
+		if *format != string(reportFormatMsgpack) { // NOTE: no trailing newline for binary output
+			report = append(report, '\n')
+		}
+
+		if deliverer != nil {
+			if err = deliverReport(deliverer, report); err != nil {
+				lexit(1, "Failed to deliver report: %s", err)
+			}
+			logInfo("Delivered report.")
+		} else if len(out) > 0 {
+			if err = writeToFile(out, report, appendOut); err != nil {
+				lexit(1, "Failed to write report to '%s': %s", out, err)
+			}
+			logInfo("Wrote report to: '%s'", out)
+		} else {
+			os.Stdout.Write(report)
+		}
+	}
+}
+
+// write given bytes to a file (truncated, or appended if `appendTo` is true), creating its parent directories if needed
+func writeToFile(path string, bytes []byte, appendTo bool) (err error) {
+	if err = os.MkdirAll(filepath.Dir(path), fs.ModePerm); err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendTo {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+
+	var file *os.File
+	if file, err = os.OpenFile(path, flags, 0o644); err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(bytes)
+	return err
+}
+
+// process report job for comparing with peers' reports
+func processPeerComparison(db *Database, format *string, peerFilepaths []string, opts reportOptions) {
+	peers, err := loadPeerReports(peerFilepaths)
+	if err != nil {
+		lexit(1, "Failed to load peer reports: %s", err)
+	}
+
+	report, err := db.GenerateReport(0, opts)
+	if err != nil {
+		lexit(1, "Failed to generate report: %s", err)
+	}
+
+	comparison := compareWithPeers(report, peerFilepaths, peers)
+
+	switch *format {
+	case string(reportFormatPlain):
+		lexit(0, "%s", comparison.plain())
+	case string(reportFormatJSON):
+		if bytes, err := json.Marshal(comparison); err == nil {
+			lexit(0, "%s", string(bytes))
+		} else {
+			lexit(1, "Failed to marshal comparison: %s", err)
+		}
+	default:
+		logError("Unsupported format for comparing with peers: '%s'", *format)
+		showUsage()
+	}
+}
+
+// process report job for comparing with the prior period
+func processComparison(db *Database, format *string, opts reportOptions) {
+	comparison, err := db.CompareReports(0, opts.days()[0], opts)
+	if err != nil {
+		lexit(1, "Failed to compare reports: %s", err)
+	}
+
+	switch *format {
+	case string(reportFormatPlain):
+		lexit(0, "%s", comparison.plain())
+	case string(reportFormatJSON):
+		if bytes, err := json.Marshal(comparison); err == nil {
+			lexit(0, "%s", string(bytes))
+		} else {
+			lexit(1, "Failed to marshal comparison: %s", err)
+		}
+	default:
+		logError("Unsupported format for comparing periods: '%s'", *format)
+		showUsage()
 	}
 }
 
 // post given html page to telegra.ph and return the generated URL
-func postToTelegraphAndReturnURL(client *telegraph.Client, bytes []byte, offsetDays int) (url string, err error) {
+func postToTelegraphAndReturnURL(client *telegraph.Client, bytes []byte, offsetDays int, opts reportOptions) (url string, err error) {
 	var title string
 	hostname, _ := os.Hostname()
-	timestamp := time.Now().AddDate(0, 0, -offsetDays).Format("2006-01-02 15:04:05")
+	timestamp := opts.formatTime(time.Now().AddDate(0, 0, -offsetDays))
 	if len(hostname) > 0 {
 		title = fmt.Sprintf("[%s] Balog Report: %s", hostname, timestamp)
 	} else {
@@ -530,23 +2056,178 @@ func postToTelegraphAndReturnURL(client *telegraph.Client, bytes []byte, offsetD
 	return "", err
 }
 
+// process query job
+func processQuery(db *Database, cidr, format *string) {
+	prefix, err := netip.ParsePrefix(*cidr)
+	if err != nil {
+		lexit(1, "Invalid CIDR was given: %s", err)
+	}
+
+	logs, err := db.QueryByCIDR(prefix)
+	if err != nil {
+		lexit(1, "Failed to query ban actions: %s", err)
+	}
+
+	// aggregate counts
+	ips, protocols, countries := KeyValues{}, KeyValues{}, KeyValues{}
+	for _, log := range logs {
+		count, _ := ips.Get(log.IP)
+		ips.Set(log.IP, count+1)
+		count, _ = protocols.Get(log.Protocol)
+		protocols.Set(log.Protocol, count+1)
+		if log.Location != nil {
+			count, _ = countries.Get(*log.Location)
+			countries.Set(*log.Location, count+1)
+		}
+	}
+
+	if *format == string(reportFormatJSON) {
+		type entry struct {
+			IP        string    `json:"ip"`
+			Protocol  string    `json:"protocol"`
+			Location  *string   `json:"location,omitempty"`
+			CreatedAt time.Time `json:"created_at"`
+		}
+		result := struct {
+			CIDR           string    `json:"cidr"`
+			TotalCount     int       `json:"total_count"`
+			IPCounts       KeyValues `json:"ip_counts"`
+			ProtocolCounts KeyValues `json:"protocol_counts"`
+			CountryCounts  KeyValues `json:"country_counts"`
+			Logs           []entry   `json:"logs"`
+		}{
+			CIDR:           prefix.Masked().String(),
+			TotalCount:     len(logs),
+			IPCounts:       sortKeyValues(ips, sortByCount),
+			ProtocolCounts: sortKeyValues(protocols, sortByCount),
+			CountryCounts:  sortKeyValues(countries, sortByCount),
+			Logs:           []entry{},
+		}
+		for _, log := range logs {
+			result.Logs = append(result.Logs, entry{log.IP, log.Protocol, log.Location, log.CreatedAt})
+		}
+
+		if bytes, err := json.Marshal(result); err == nil {
+			lexit(0, "%s", string(bytes))
+		} else {
+			lexit(1, "Failed to marshal query result: %s", err)
+		}
+	}
+
+	lines := []string{}
+	for _, log := range logs {
+		location := unknownLocation
+		if log.Location != nil {
+			location = *log.Location
+		}
+		lines = append(lines, fmt.Sprintf("  %s  %s  %s  %s", log.CreatedAt.Format("2006-01-02 15:04:05"), log.IP, log.Protocol, location))
+	}
+
+	lexit(0, `>>> Ban actions in %[1]s
+
+* Total: %[2]d ban action(s) from %[3]d ip(s)
+
+* IPs:
+%[4]s
+
+* Protocols:
+%[5]s
+
+* Originating Countries:
+%[6]s
+
+* Logs:
+%[7]s`, prefix.Masked().String(), len(logs), len(ips),
+		strings.Join(keyValueLines(sortKeyValues(ips, sortByCount), "  "), "\n"),
+		strings.Join(keyValueLines(sortKeyValues(protocols, sortByCount), "  "), "\n"),
+		strings.Join(keyValueLines(sortKeyValues(countries, sortByCount), "  "), "\n"),
+		strings.Join(lines, "\n"))
+}
+
+// process stats job
+func processStats(db *Database, format *string) {
+	stats, err := db.GetStats()
+	if err != nil {
+		lexit(1, "Failed to get stats: %s", err)
+	}
+
+	if *format == string(reportFormatJSON) {
+		if bytes, err := json.Marshal(stats); err == nil {
+			lexit(0, "%s", string(bytes))
+		} else {
+			lexit(1, "Failed to marshal stats: %s", err)
+		}
+	}
+
+	if stats.TotalCount <= 0 {
+		lexit(0, "%s", emptyReportMessage)
+	}
+
+	lexit(0, `>>> All-time statistics
+
+* Total: %[1]d ban action(s)
+* Distinct IPs: %[2]d
+* Distinct countries: %[3]d
+* First ban: %[4]s
+* Last ban: %[5]s
+* Most-banned IP: %[6]s (%[7]d times)`, stats.TotalCount, stats.DistinctIPs, stats.DistinctCountries,
+		stats.FirstBanAt.Format("2006-01-02 15:04:05"), stats.LastBanAt.Format("2006-01-02 15:04:05"),
+		*stats.TopIP, stats.TopIPCount)
+}
+
 // process maintenance job
-func processMaintenance(db *Database, job, geolocAPIKey *string) {
+func processMaintenance(db *Database, job, format *string, geolocator Geolocator, ip string, maxIPs, limit, offset int, rps float64, days int, out, from string, dryRun, withLocation bool, config config) {
 	switch *job {
 	case string(maintenanceJobListUnknownIPs):
-		if ips, err := db.ListUnknownIPs(); err == nil {
+		if limit < 0 || offset < 0 {
+			lexit(1, "Parameters `-%s` and `-%s` should not be negative.", paramLimit, paramOffset)
+		}
+
+		if ips, total, err := db.ListUnknownIPsPaged(limit, offset); err == nil {
+			// (eg. "101-200 of 3456")
+			page := fmt.Sprintf("%d-%d of %d", min(int64(offset+1), total), int64(offset+len(ips)), total)
+			if len(ips) <= 0 {
+				page = fmt.Sprintf("none of %d", total)
+			}
+
+			if *format == string(reportFormatJSON) {
+				if bytes, err := json.Marshal(ips); err == nil {
+					// (page range goes to stderr, for keeping the output parsable)
+					logInfo("Unknown IPs: %s", page)
+
+					lexit(0, "%s", string(bytes))
+				} else {
+					lexit(1, "Failed to marshal unknown IPs: %s", err)
+				}
+			}
+
 			unknowns := []string{}
 			for _, ip := range ips {
 				unknowns = append(unknowns, ip.IP)
 			}
-			lexit(0, `Unknown IPs:
+			lexit(0, `Unknown IPs (%s):
 
-%s`, strings.Join(unknowns, "\n"))
+%s`, page, strings.Join(unknowns, "\n"))
 		} else {
 			lexit(1, "Failed to list unknown IPs: %s", err)
 		}
+	case string(maintenanceJobResolveSingle):
+		if len(ip) <= 0 {
+			logError("Parameter `-%s` is required for job '%s'.", paramIP, maintenanceJobResolveSingle)
+			showUsage()
+		}
+
+		if location, err := db.ResolveIP(geolocator, ip); err == nil {
+			lexit(0, "Resolved '%s': %s", location.IP, location.CountryName)
+		} else {
+			lexit(1, "Failed to resolve IP: %s", err)
+		}
 	case string(maintenanceJobResolveUnknownIPs):
-		if ips, err := db.ResolveUnknownIPs(geolocAPIKey); err == nil {
+		// stop gracefully on SIGINT/SIGTERM (already resolved ips are kept)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		if ips, skipped, err := db.ResolveUnknownIPs(ctx, geolocator, maxIPs, config.resolveBackoff(), rps); err == nil || errors.Is(err, context.Canceled) {
 			resolved := []Location{}
 			unresolved := []Location{}
 			for _, ip := range ips {
@@ -556,70 +2237,317 @@ func processMaintenance(db *Database, job, geolocAPIKey *string) {
 					unresolved = append(unresolved, ip)
 				}
 			}
-			lexit(0, `Newly resolved IPs: %d 
-Still unresolved: %d`, len(resolved), len(unresolved))
+			summary := fmt.Sprintf(`Retried IPs: %d
+Newly resolved IPs: %d
+Still unresolved: %d
+Skipped due to backoff: %d`, len(ips), len(resolved), len(unresolved), skipped)
+			if err != nil {
+				lexit(130, "Interrupted, resolved IPs so far were saved.\n\n%s", summary)
+			}
+			lexit(0, "%s", summary)
 		} else {
 			lexit(1, "Failed to resolve unknown IPs: %s", err)
 		}
+	case string(maintenanceJobDeleteIP):
+		if len(ip) <= 0 {
+			logError("Parameter `-%s` is required for job '%s'.", paramIP, maintenanceJobDeleteIP)
+			showUsage()
+		}
+
+		numDeleted, err := db.DeleteByIP(ip)
+		if err != nil {
+			lexit(1, "Failed to delete logs of IP: %s", err)
+		}
+		if !withLocation {
+			lexit(0, "Deleted %d logs of '%s'.", numDeleted, ip)
+		}
+
+		if numLocations, err := db.DeleteLocationByIP(ip); err == nil {
+			lexit(0, "Deleted %d logs and %d cached locations of '%s'.", numDeleted, numLocations, ip)
+		} else {
+			lexit(1, "Deleted %d logs of '%s', but failed to delete its cached location: %s", numDeleted, ip, err)
+		}
 	case string(maintenanceJobPurgeLogs):
-		if numPurged, err := db.PurgeLogs(); err == nil {
+		var numPurged int64
+		var err error
+		if days > 0 {
+			numPurged, err = db.PurgeLogsOlderThan(days)
+		} else {
+			if !confirm("Purge ALL logs?") {
+				lexit(0, "Purging logs was canceled. (use `-%s` for purging only older logs)", paramDays)
+			}
+			numPurged, err = db.PurgeLogs()
+		}
+		if err == nil {
 			lexit(0, "Purged %d logs.", numPurged)
 		} else {
 			lexit(1, "Failed to purge logs: %s", err)
 		}
+	case string(maintenanceJobStatsLocations):
+		if stats, err := db.GetLocationStats(); err == nil {
+			if *format == string(reportFormatJSON) {
+				if bytes, err := json.Marshal(stats); err == nil {
+					lexit(0, "%s", string(bytes))
+				} else {
+					lexit(1, "Failed to marshal location stats: %s", err)
+				}
+			}
+
+			timestamp := func(t *time.Time) string {
+				if t == nil {
+					return "-"
+				}
+				return t.Format("2006-01-02 15:04:05")
+			}
+			lexit(0, `Cached IPs: %d
+  Resolved: %d
+  Unknown: %d
+  Reserved: %d
+
+Oldest resolution: %s
+Newest resolution: %s
+
+Countries:
+%s`, stats.TotalCount, stats.ResolvedCount, stats.UnknownCount, stats.ReservedCount,
+				timestamp(stats.OldestResolved), timestamp(stats.NewestResolved),
+				strings.Join(keyValueLines(stats.CountryCounts, "  "), "\n"))
+		} else {
+			lexit(1, "Failed to get location stats: %s", err)
+		}
+	case string(maintenanceJobDetectGaps):
+		threshold := defaultGapThresholdHours
+		if config.GapThresholdHours != nil {
+			threshold = *config.GapThresholdHours
+		}
+
+		if gaps, err := db.DetectGaps(time.Duration(threshold)*time.Hour, config.GapQuietHours); err == nil {
+			if *format == string(reportFormatJSON) {
+				if bytes, err := json.Marshal(gaps); err == nil {
+					lexit(0, "%s", string(bytes))
+				} else {
+					lexit(1, "Failed to marshal gaps: %s", err)
+				}
+			}
+
+			if len(gaps) <= 0 {
+				lexit(0, "No gaps longer than %d hour(s) were detected.", threshold)
+			}
+
+			lines := []string{}
+			for _, gap := range gaps {
+				lines = append(lines, fmt.Sprintf("  %s ~ %s (%s)", gap.Start.Format("2006-01-02 15:04:05"), gap.End.Format("2006-01-02 15:04:05"), gap.Duration))
+			}
+			lexit(0, `Suspected logging outages (longer than %d hour(s)):
+
+%s`, threshold, strings.Join(lines, "\n"))
+		} else {
+			lexit(1, "Failed to detect gaps: %s", err)
+		}
+	case string(maintenanceJobApplyRetention):
+		defaultDays := 0
+		if config.RetentionDays != nil {
+			defaultDays = *config.RetentionDays
+		}
+		if defaultDays <= 0 && len(config.RetentionByProtocol) <= 0 {
+			lexit(1, "No retention policy was configured: set `retention_days` and/or `retention_by_protocol` in the config file.")
+		}
+
+		if purged, err := db.PurgeLogsByRetention(defaultDays, config.RetentionByProtocol); err == nil {
+			total := 0
+			for _, kv := range purged {
+				total += kv.Value
+			}
+			lexit(0, `Purged %d logs.
+
+%s`, total, strings.Join(keyValueLines(sortKeyValues(purged, sortByName), "  "), "\n"))
+		} else {
+			lexit(1, "Failed to apply retention policies: %s", err)
+		}
+	case string(maintenanceJobAnonymizeOld):
+		if config.AnonymizeAfterDays == nil || *config.AnonymizeAfterDays <= 0 {
+			lexit(1, "`anonymize_after_days` is not configured.")
+		}
+
+		if anonymized, err := db.AnonymizeLogsOlderThan(*config.AnonymizeAfterDays); err == nil {
+			lexit(0, "Anonymized %d logs.", anonymized)
+		} else {
+			lexit(1, "Failed to anonymize logs: %s", err)
+		}
+	case string(maintenanceJobAuditLocations):
+		if audit, err := db.AuditLocations(numSampleIPsForAudit); err == nil {
+			if *format == string(reportFormatJSON) {
+				if bytes, err := json.Marshal(audit); err == nil {
+					lexit(0, "%s", string(bytes))
+				} else {
+					lexit(1, "Failed to marshal audit result: %s", err)
+				}
+			}
+
+			lexit(0, `Logs without cached locations: %d
+  %s
+
+Cached locations without logs: %d
+  %s`, audit.OrphanLogsCount, strings.Join(audit.OrphanLogIPs, "\n  "),
+				audit.OrphanLocationsCount, strings.Join(audit.OrphanLocationIPs, "\n  "))
+		} else {
+			lexit(1, "Failed to audit locations: %s", err)
+		}
+	case string(maintenanceJobExport):
+		if len(out) <= 0 {
+			logError("Parameter `-%s` is required for job '%s'.", paramOut, maintenanceJobExport)
+			showUsage()
+		}
+		if _, err := os.Stat(out); err == nil {
+			lexit(1, "Export file already exists: '%s'", out)
+		}
+
+		if strings.HasSuffix(out, ".gz") {
+			// snapshot to a temporary file, then compress it
+			tmp, err := os.CreateTemp(filepath.Dir(out), "."+applicationName+"-export-*")
+			if err != nil {
+				lexit(1, "Failed to create temporary file: %s", err)
+			}
+			tmp.Close()
+
+			if err = db.BackupTo(tmp.Name()); err != nil {
+				os.Remove(tmp.Name())
+				lexit(1, "Failed to export database: %s", err)
+			}
+			if err = gzipFile(tmp.Name(), out); err != nil {
+				os.Remove(tmp.Name())
+				lexit(1, "Failed to compress exported database: %s", err)
+			}
+			os.Remove(tmp.Name())
+		} else {
+			if err := db.BackupTo(out); err != nil {
+				lexit(1, "Failed to export database: %s", err)
+			}
+		}
+
+		lexit(0, "Exported database to: '%s'", out)
+	case string(maintenanceJobImport):
+		if len(from) <= 0 {
+			logError("Parameter `-%s` is required for job '%s'.", paramFrom, maintenanceJobImport)
+			showUsage()
+		}
+
+		if bans, skippedBans, locations, skippedLocations, err := db.ImportFrom(from); err == nil {
+			lexit(0, `Imported ban actions: %d
+Skipped ban actions (already imported): %d
+Imported locations: %d
+Skipped locations (already cached): %d`, bans, skippedBans, locations, skippedLocations)
+		} else {
+			lexit(1, "Failed to import database: %s", err)
+		}
+	case string(maintenanceJobDedupeLocations):
+		if duplicates, collapsed, err := db.DedupeLocations(dryRun); err == nil {
+			if *format == string(reportFormatJSON) {
+				if bytes, err := json.Marshal(duplicates); err == nil {
+					lexit(0, "%s", string(bytes))
+				} else {
+					lexit(1, "Failed to marshal duplicate locations: %s", err)
+				}
+			}
+
+			lines := []string{}
+			for _, duplicate := range duplicates {
+				lines = append(lines, fmt.Sprintf("* %s: %s (keeping '%s': %s)", duplicate.IP, strings.Join(duplicate.IPs, ", "), duplicate.Kept, duplicate.CountryName))
+			}
+			if dryRun {
+				lines = append(lines, fmt.Sprintf("Duplicate locations to be collapsed: %d (dry run, nothing was changed)", collapsed))
+			} else {
+				lines = append(lines, fmt.Sprintf("Collapsed duplicate locations: %d", collapsed))
+			}
+			lexit(0, "%s", strings.Join(lines, "\n"))
+		} else {
+			lexit(1, "Failed to dedupe locations: %s", err)
+		}
+	case string(maintenanceJobVacuum):
+		before, err := db.FileSize()
+		if err != nil {
+			lexit(1, "Failed to get the size of database: %s", err)
+		}
+		if err = db.Vacuum(); err != nil {
+			lexit(1, "Failed to vacuum database: %s", err)
+		}
+		after, err := db.FileSize()
+		if err != nil {
+			lexit(1, "Failed to get the size of database: %s", err)
+		}
+
+		lexit(0, "Vacuumed database: %s -> %s (reclaimed %s)", formatBytes(before), formatBytes(after), formatBytes(max(before-after, 0)))
+	case string(maintenanceJobSyncLocations):
+		if updated, err := db.SyncBanActionLocations(); err == nil {
+			lexit(0, "Refreshed locations of ban actions: %d", updated)
+		} else {
+			lexit(1, "Failed to sync locations of ban actions: %s", err)
+		}
 	default:
-		l("Unknown job was given: '%s'", *job)
+		logError("Unknown job was given: '%s'", *job)
 		showUsage()
 	}
 }
 
-// generate insights with google api model
-func generateInsight(googleAIAPIKey string, olderReport, recentReport []byte) (insight []byte, err error) {
-	generated := ""
-
-	ctx := context.TODO()
-
-	// gemini-things client
-	var gtc *gt.Client
-	if gtc, err = gt.NewClient(googleAIAPIKey, googleAIModel); err != nil {
-		return nil, fmt.Errorf("error initializing gemini-things client: %s", err)
+// generate insights from older/recent reports with given provider, using the system instruction and prompt template of `opts`
+//
+// if `opts.ShowPrompt` is true, the system instruction and prompt will be printed to stderr before generation.
+// insights of identical reports are reused from the database for `opts.InsightCacheTTL`.
+// transient failures (eg. rate limits) are retried, and an `*InsightError` is returned on failure.
+func generateInsight(db *Database, provider InsightProvider, model string, olderReport, recentReport []byte, opts reportOptions) (insight []byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), insightGenerationTimeoutSeconds*time.Second)
+	defer cancel()
+
+	systemInstruction, promptTemplate := opts.InsightSystemInstruction, opts.InsightPromptTemplate
+	if len(systemInstruction) <= 0 {
+		systemInstruction = systemInstructionForInsightGeneration
+	}
+	if len(promptTemplate) <= 0 {
+		promptTemplate = promptTemplateForInsightGeneration
 	}
-	defer gtc.Close()
-	gtc.SetTimeout(insightGenerationTimeoutSeconds)
-	gtc.SetSystemInstructionFunc(func() string {
-		return systemInstructionForInsightGeneration
-	})
 
-	prompt := fmt.Sprintf(`Following are summarized reports of ban action logs and the geolocations of the logs.
-Analyze these reports and offer system or security insights based on the analysis.
-Highlight and explain any unusual patterns or noteworthy findings.
+	prompt := fmt.Sprintf(promptTemplate, string(olderReport), string(recentReport))
 
-<older_report>
+	if opts.ShowPrompt {
+		fmt.Fprintf(os.Stderr, `>>> System instruction:
 %[1]s
-</older_report>
 
-<recent_report>
+>>> Prompt:
 %[2]s
-</recent_report>`, string(olderReport), string(recentReport))
-
-	var res *genai.GenerateContentResponse
-	if res, err = gtc.Generate(ctx, prompt, nil); err == nil {
-		if len(res.Candidates) > 0 {
-			parts := res.Candidates[0].Content.Parts
-
-			for _, part := range parts {
-				if text, ok := part.(genai.Text); ok {
-					generated += string(text) + "\n"
-				} else if data, ok := part.(genai.Blob); ok {
-					generated += fmt.Sprintf("%d byte(s) of %s\n", len(data.Data), data.MIMEType)
-				} else {
-					err = fmt.Errorf("unsupported type of part returned from Gemini API: %+v", part)
-				}
-			}
-		} else {
-			err = fmt.Errorf("no candidate returned from Gemini API")
+`, systemInstruction, prompt)
+	}
+
+	// don't send anything to the provider
+	if opts.DryRun {
+		logInfo("Skipping insight generation (dry run).")
+		return nil, nil
+	}
+
+	// reuse the cached insight of identical reports
+	hash := insightHash(model, systemInstruction, prompt)
+	if opts.InsightCacheTTL > 0 {
+		if cached, err := db.GetCachedInsight(hash, opts.InsightCacheTTL); err != nil {
+			logWarn("Failed to lookup cached insight: %s", err)
+		} else if cached != nil {
+			logInfo("Reusing cached insight: %s", hash)
+			return []byte(*cached), nil
 		}
 	}
 
-	return []byte(generated), err
+	var generated string
+	if generated, err = generateWithRetry(ctx, provider, systemInstruction, prompt); err != nil {
+		return nil, err
+	}
+
+	if opts.InsightCacheTTL > 0 && len(strings.TrimSpace(generated)) > 0 {
+		if err := db.SaveInsight(hash, generated); err != nil {
+			logWarn("Failed to cache insight: %s", err)
+		}
+	}
+
+	// no text was returned, so return an empty insight (report will be generated without it)
+	if len(strings.TrimSpace(generated)) <= 0 {
+		return nil, nil
+	}
+
+	return []byte(generated), nil
 }
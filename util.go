@@ -3,22 +3,261 @@
 package main
 
 import (
+	"compress/gzip"
 	"fmt"
+	"io"
+	"net/netip"
 	"os"
 	"strings"
 )
 
-// log string to stdout
+type logLevel int
+
+// log levels
+const (
+	logLevelDebug logLevel = iota
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+// names of log levels
+var logLevelNames = map[string]logLevel{
+	"debug": logLevelDebug,
+	"info":  logLevelInfo,
+	"warn":  logLevelWarn,
+	"error": logLevelError,
+}
+
+// diagnostics below this level will not be printed
+var currentLogLevel = logLevelInfo
+
+// set the log level with its name (eg. "warn")
+func setLogLevel(name string) error {
+	if level, exists := logLevelNames[strings.ToLower(name)]; exists {
+		currentLogLevel = level
+		return nil
+	}
+	return fmt.Errorf("unknown log level: '%s'", name)
+}
+
+// log string to stdout (for outputs, eg. reports)
 func l(format string, v ...interface{}) {
-	if !strings.HasSuffix(format, "\n") {
-		format += "\n"
+	fmt.Fprint(os.Stdout, withNewline(fmt.Sprintf(format, v...)))
+}
+
+// log diagnostics to stderr if given level is enabled
+func logAt(level logLevel, format string, v ...interface{}) {
+	if level >= currentLogLevel {
+		fmt.Fprint(os.Stderr, withNewline(fmt.Sprintf(format, v...)))
 	}
+}
 
-	fmt.Printf(format, v...)
+// log debug messages to stderr
+func logDebug(format string, v ...interface{}) {
+	logAt(logLevelDebug, format, v...)
 }
 
-// log string to stdout, and exit with given exit code
+// log informational messages to stderr
+func logInfo(format string, v ...interface{}) {
+	logAt(logLevelInfo, format, v...)
+}
+
+// log warnings (eg. non-fatal failures) to stderr
+func logWarn(format string, v ...interface{}) {
+	logAt(logLevelWarn, format, v...)
+}
+
+// log errors to stderr
+func logError(format string, v ...interface{}) {
+	logAt(logLevelError, format, v...)
+}
+
+// append a newline to given string if it doesn't end with one
+func withNewline(str string) string {
+	if !strings.HasSuffix(str, "\n") {
+		str += "\n"
+	}
+	return str
+}
+
+// log string and exit with given exit code
+//
+// it is printed to stdout when `exit` is 0, or to stderr otherwise (regardless of the log level).
 func lexit(exit int, format string, v ...interface{}) {
-	l(format, v...)
+	if exit == 0 {
+		l(format, v...)
+	} else {
+		fmt.Fprint(os.Stderr, withNewline(fmt.Sprintf(format, v...)))
+	}
 	os.Exit(exit)
 }
+
+// check if given slice contains the value (case-insensitively)
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// mask given ip address: the last octet of ipv4, or the last 80 bits of ipv6
+//
+// returns the given string as it is if it is not a valid ip address
+func maskIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+
+	bits := 48 // ipv6: 128 - 80
+	if addr.Is4() {
+		bits = 24
+	}
+	if prefix, err := addr.Prefix(bits); err == nil {
+		return prefix.Addr().String()
+	}
+
+	return ip
+}
+
+// ask for a confirmation on stdin, and return true only if it was answered with 'y' or 'yes'
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+
+	var answer string
+	fmt.Scanln(&answer)
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// CGNAT (shared address space) range of RFC 6598
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// check if given ip address is in reserved ranges which cannot be geolocated:
+// loopback, private (RFC 1918 and ipv6 ULA), link-local, CGNAT, and unspecified addresses
+func isReservedIP(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	return addr.IsLoopback() ||
+		addr.IsPrivate() ||
+		addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() ||
+		addr.IsUnspecified() ||
+		cgnatPrefix.Contains(addr)
+}
+
+// ipWhitelist is a set of ips and cidrs whose ban actions won't be logged
+type ipWhitelist struct {
+	addrs    map[netip.Addr]bool // single ips (looked up directly)
+	prefixes []netip.Prefix      // cidrs
+}
+
+// parse given ips and cidrs (eg. "192.0.2.1", "198.51.100.0/24", "2001:db8::/32") into a whitelist
+//
+// invalid entries are warned and ignored.
+func parseWhitelist(entries []string) (result ipWhitelist) {
+	result.addrs = map[netip.Addr]bool{}
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+
+		if strings.Contains(entry, "/") {
+			if prefix, err := netip.ParsePrefix(entry); err == nil {
+				if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+					prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+				}
+				result.prefixes = append(result.prefixes, prefix.Masked())
+			} else {
+				logWarn("Ignoring invalid cidr in `whitelist`: '%s' (%s)", entry, err)
+			}
+		} else {
+			if addr, err := netip.ParseAddr(entry); err == nil {
+				result.addrs[addr.Unmap()] = true
+			} else {
+				logWarn("Ignoring invalid ip in `whitelist`: '%s' (%s)", entry, err)
+			}
+		}
+	}
+
+	return result
+}
+
+// check if given ip address is whitelisted
+func (w ipWhitelist) contains(ip string) bool {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	if w.addrs[addr] {
+		return true
+	}
+	for _, prefix := range w.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize given ip address to its canonical form (eg. "2001:db8::1" for "2001:0DB8:0000::1")
+//
+// ipv4-mapped ipv6 addresses are converted to ipv4 ones (eg. "1.2.3.4" for "::ffff:1.2.3.4").
+func normalizeIP(ip string) (string, error) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return "", fmt.Errorf("invalid ip address '%s': %s", ip, err)
+	}
+
+	return addr.Unmap().String(), nil
+}
+
+// compress file at `src` into a gzip file at `dst`
+func gzipFile(src, dst string) (err error) {
+	var in *os.File
+	if in, err = os.Open(src); err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var out *os.File
+	if out, err = os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600); err != nil {
+		return err
+	}
+	defer out.Close()
+
+	writer := gzip.NewWriter(out)
+	if _, err = io.Copy(writer, in); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
+
+// format given number of bytes in a human-readable form (eg. "1.5 MiB")
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
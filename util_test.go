@@ -0,0 +1,73 @@
+// util_test.go
+
+package main
+
+import (
+	"testing"
+)
+
+func TestMaskIP(t *testing.T) {
+	for _, test := range []struct {
+		ip       string
+		expected string
+	}{
+		// ipv4 (last octet)
+		{"192.0.2.123", "192.0.2.0"},
+		{"198.51.100.0", "198.51.100.0"},
+
+		// ipv6 (last 80 bits)
+		{"2001:db8:1234:5678:9abc:def0:1234:5678", "2001:db8:1234::"},
+		{"2001:DB8::1", "2001:db8::"},
+
+		// ipv4-mapped ipv6 (masked as ipv4)
+		{"::ffff:192.0.2.123", "192.0.2.0"},
+
+		// malformed (returned as they are)
+		{"", ""},
+		{"not-an-ip", "not-an-ip"},
+		{"192.0.2.256", "192.0.2.256"},
+		{"192.0.2.0/24", "192.0.2.0/24"},
+	} {
+		if masked := maskIP(test.ip); masked != test.expected {
+			t.Errorf("maskIP(%q): expected %q, got %q", test.ip, test.expected, masked)
+		}
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	for _, test := range []struct {
+		ip       string
+		expected string
+		fails    bool
+	}{
+		{ip: "192.0.2.1", expected: "192.0.2.1"},
+		{ip: " 192.0.2.1\n", expected: "192.0.2.1"},
+
+		// uppercase hex
+		{ip: "2001:DB8::ABCD", expected: "2001:db8::abcd"},
+
+		// zero compression
+		{ip: "2001:0db8:0000:0000:0000:0000:0000:0001", expected: "2001:db8::1"},
+		{ip: "2001:0DB8:0000::1", expected: "2001:db8::1"},
+
+		// ipv4-mapped ipv6
+		{ip: "::ffff:192.0.2.1", expected: "192.0.2.1"},
+		{ip: "::FFFF:c000:0201", expected: "192.0.2.1"},
+
+		// malformed
+		{ip: "", fails: true},
+		{ip: "not-an-ip", fails: true},
+		{ip: "2001:db8::g", fails: true},
+	} {
+		normalized, err := normalizeIP(test.ip)
+		if test.fails {
+			if err == nil {
+				t.Errorf("normalizeIP(%q): expected an error, got %q", test.ip, normalized)
+			}
+		} else if err != nil {
+			t.Errorf("normalizeIP(%q): unexpected error: %s", test.ip, err)
+		} else if normalized != test.expected {
+			t.Errorf("normalizeIP(%q): expected %q, got %q", test.ip, test.expected, normalized)
+		}
+	}
+}